@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	config "github.com/dpindur/get-good/config"
+	lib "github.com/dpindur/get-good/libgetgood"
+	. "github.com/dpindur/get-good/logger"
+	logrus "github.com/sirupsen/logrus"
+)
+
+func agentCommand(args []string) int {
+	hostname, _ := os.Hostname()
+	flags := newFlagSet("agent [flags]")
+	coordinator := flags.String("coordinator", "", "address of the coordinator to lease requests from, for example 10.0.0.1:8091")
+	token := flags.String("token", "", "token the coordinator was started with")
+	name := flags.String("name", fmt.Sprintf("%v-%v", hostname, os.Getpid()), "name of this agent as shown in the coordinator's logs")
+	workers := flags.Int("workers", 5, "number of worker threads")
+	rate := flags.Int("rate", 0, "maximum requests per second across this agent's workers, specify zero for no limit")
+	timeout := flags.Int("timeout", 10, "http timeout in seconds, specify zero for no timeout")
+	batchSize := flags.Int("batch-size", 50, "number of requests to lease and report in one go")
+	logFile := flags.String("log-file", "", "log file to output progress to, as well as standard output")
+	logLevel := flags.String("log-level", "info", "what level of logs and up should be logged (debug, info, warn, error, fatal, panic)")
+	positional, err := config.ParseFlags(flags, args)
+	if err != nil {
+		return configError(err)
+	}
+	if len(positional) > 0 {
+		fmt.Printf("unexpected arguments: %v\n", strings.Join(positional, " "))
+		return 1
+	}
+
+	level, err := logrus.ParseLevel(strings.ToLower(*logLevel))
+	if err != nil {
+		fmt.Printf("not a valid log level %v\n", *logLevel)
+		return 1
+	}
+	var file *os.File
+	if *logFile != "" {
+		file, err = os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+		if err != nil {
+			fmt.Printf("error opening logfile %v\n", *logFile)
+			return 1
+		}
+		defer file.Close()
+	}
+
+	agent, err := lib.NewAgent(&lib.AgentOptions{
+		Coordinator: *coordinator,
+		Token:       *token,
+		Name:        *name,
+		Workers:     *workers,
+		Rate:        *rate,
+		Timeout:     *timeout,
+		BatchSize:   *batchSize,
+	})
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	ConfigureConsoleLogger(level, file)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signalChan
+		Logger.Infof("Received %v, stopping...", sig)
+		cancel()
+	}()
+
+	err = agent.Run(ctx)
+	if err != nil {
+		Logger.Errorf("Error running agent")
+		Logger.Errorf("%v", err)
+		return 1
+	}
+	return 0
+}
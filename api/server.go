@@ -0,0 +1,331 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	lib "github.com/dpindur/get-good/libgetgood"
+	. "github.com/dpindur/get-good/logger"
+)
+
+// Server is a local http api for starting and controlling scans
+type Server struct {
+	server     *http.Server
+	listener   net.Listener
+	token      string
+	controller *lib.Controller
+}
+
+type scanStatus struct {
+	State    string       `json:"state"`
+	Config   *lib.Options `json:"config"`
+	Workers  int          `json:"workers"`
+	Rate     int          `json:"rate"`
+	Progress lib.Progress `json:"progress"`
+	Errors   []string     `json:"errors"`
+}
+
+func StartServer(addr string, token string, controller *lib.Controller) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	server := &Server{&http.Server{Addr: addr}, listener, token, controller}
+	mux.HandleFunc("/scan", server.handleScan)
+	mux.HandleFunc("/scan/pause", server.handlePause)
+	mux.HandleFunc("/scan/resume", server.handleResume)
+	mux.HandleFunc("/scan/stop", server.handleStop)
+	mux.HandleFunc("/scan/workers", server.handleWorkers)
+	mux.HandleFunc("/scan/rate", server.handleRate)
+	mux.HandleFunc("/findings", server.handleFindings)
+	mux.HandleFunc("/events", server.handleEvents)
+	server.server.Handler = server.authenticate(mux)
+
+	go server.work()
+	return server, nil
+}
+
+// GenerateToken returns a random token for when one isn't configured
+func GenerateToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (server *Server) Stop() {
+	Logger.Debugf("Sending api server stop signal")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.server.Shutdown(ctx)
+}
+
+func (server *Server) work() {
+	Logger.Debugf("Starting api server on %v", server.server.Addr)
+	err := server.server.Serve(server.listener)
+	if err != nil && err != http.ErrServerClosed {
+		Logger.Errorf("Error in api server")
+		Logger.Errorf("%v", err)
+	}
+	Logger.Debugf("Api server stopped")
+}
+
+// Requests must provide the token either as a bearer token or, for
+// clients such as EventSource which cannot set headers, a query parameter
+func (server *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(server.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (server *Server) handleScan(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		scan := server.controller.Scanner()
+		if scan == nil {
+			writeError(w, http.StatusNotFound, "no scan has been started")
+			return
+		}
+		writeJSON(w, http.StatusOK, status(scan))
+	case http.MethodPost:
+		config := lib.DefaultOptions()
+		err := json.NewDecoder(r.Body).Decode(config)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid scan config: %v", err))
+			return
+		}
+		scan, err := server.controller.Start(config)
+		if err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, status(scan))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (server *Server) handlePause(w http.ResponseWriter, r *http.Request) {
+	server.withScan(w, r, func(scan *lib.Scanner) error {
+		scan.Pause()
+		return nil
+	})
+}
+
+func (server *Server) handleResume(w http.ResponseWriter, r *http.Request) {
+	server.withScan(w, r, func(scan *lib.Scanner) error {
+		scan.Resume()
+		return nil
+	})
+}
+
+func (server *Server) handleStop(w http.ResponseWriter, r *http.Request) {
+	server.withScan(w, r, func(scan *lib.Scanner) error {
+		scan.Stop()
+		return nil
+	})
+}
+
+func (server *Server) handleWorkers(w http.ResponseWriter, r *http.Request) {
+	server.withScan(w, r, func(scan *lib.Scanner) error {
+		body := struct {
+			Workers int `json:"workers"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			return err
+		}
+		return scan.SetWorkers(body.Workers)
+	})
+}
+
+func (server *Server) handleRate(w http.ResponseWriter, r *http.Request) {
+	server.withScan(w, r, func(scan *lib.Scanner) error {
+		body := struct {
+			Rate int `json:"rate"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			return err
+		}
+		return scan.SetRate(body.Rate)
+	})
+}
+
+// Run an action against the current scan and respond with its status
+func (server *Server) withScan(w http.ResponseWriter, r *http.Request, action func(*lib.Scanner) error) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	scan := server.controller.Scanner()
+	if scan == nil {
+		writeError(w, http.StatusNotFound, "no scan has been started")
+		return
+	}
+
+	err := action(scan)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, status(scan))
+}
+
+func (server *Server) handleFindings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	scan := server.controller.Scanner()
+	if scan == nil {
+		writeError(w, http.StatusNotFound, "no scan has been started")
+		return
+	}
+
+	filter, err := parseFindingFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Use a separate connection so findings can still be listed
+	// once the scan has finished and closed its own
+	db, err := lib.OpenDatabaseConnection(scan.Options().DBFile)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.CloseDatabaseConnection()
+
+	findings, err := db.GetFindings(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if r.URL.Query().Get("cluster") == "true" {
+		writeJSON(w, http.StatusOK, lib.ClusterFindings(findings))
+		return
+	}
+	writeJSON(w, http.StatusOK, findings)
+}
+
+func parseFindingFilter(r *http.Request) (lib.FindingFilter, error) {
+	query := r.URL.Query()
+	filter := lib.FindingFilter{Prefix: query.Get("prefix")}
+
+	if statuses := query.Get("status"); statuses != "" {
+		for _, s := range strings.Split(statuses, ",") {
+			status, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return filter, fmt.Errorf("invalid status %q", s)
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+
+	var err error
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 0 {
+			return filter, fmt.Errorf("invalid limit %q", limit)
+		}
+	}
+	if offset := query.Get("offset"); offset != "" {
+		filter.Offset, err = strconv.Atoi(offset)
+		if err != nil || filter.Offset < 0 {
+			return filter, fmt.Errorf("invalid offset %q", offset)
+		}
+	}
+
+	return filter, nil
+}
+
+// Stream scan events to the client using server sent events
+func (server *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	events := server.controller.Events()
+	eventChan := events.Subscribe()
+	defer events.Unsubscribe(eventChan)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-eventChan:
+			data, err := json.Marshal(event)
+			if err != nil {
+				Logger.Warnf("Error encoding event")
+				Logger.Warnf("%v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %v\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+func status(scan *lib.Scanner) *scanStatus {
+	errors := make([]string, 0)
+	for _, workerErr := range scan.Errors() {
+		errors = append(errors, fmt.Sprintf("%v: %v", workerErr.Worker, workerErr.Error))
+	}
+
+	return &scanStatus{
+		State:    scan.State(),
+		Config:   scan.Options(),
+		Workers:  scan.Workers(),
+		Rate:     scan.Rate(),
+		Progress: scan.Stats().Progress(),
+		Errors:   errors,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
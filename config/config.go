@@ -0,0 +1,386 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	toml "github.com/BurntSushi/toml"
+	lib "github.com/dpindur/get-good/libgetgood"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Prefix of the environment variables which override settings, for
+// example GETGOOD_WORKERS overrides the workers setting
+const envPrefix = "GETGOOD_"
+
+// Config holds every setting for a run of get-good. Settings are
+// layered, each overriding the last: defaults, the options stored in
+// the database being resumed, the config file, the selected profile,
+// environment variables and finally command line flags
+type Config struct {
+	lib.Options `yaml:",inline"`
+	LogFile     string `yaml:"log-file"`
+	LogLevel    string `yaml:"log-level"`
+	LogLines    int    `yaml:"log-lines"`
+	MetricsAddr string `yaml:"metrics-addr"`
+	API         bool   `yaml:"api"`
+	APIAddr     string `yaml:"api-addr"`
+	APIToken    string `yaml:"api-token"`
+}
+
+// File is the layout of a config file, the top level settings always
+// apply and a profile is applied on top of them when selected
+type File struct {
+	Config   `yaml:",inline"`
+	Profiles map[string]map[string]interface{} `yaml:"profiles"`
+}
+
+func Default() *Config {
+	return &Config{
+		Options:  *lib.DefaultOptions(),
+		LogFile:  "bust.log",
+		LogLevel: "info",
+		LogLines: 1000,
+		APIAddr:  "127.0.0.1:8090",
+	}
+}
+
+// LoadScan builds the config for a new scan from the command line
+// arguments. A database which already holds a scan is refused unless
+// it is being cleared, so two scans are never mixed together
+func LoadScan(args []string) (*Config, error) {
+	config, positional, err := load("scan", Default(), args)
+	if err != nil {
+		return nil, err
+	}
+	if len(positional) > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", strings.Join(positional, " "))
+	}
+	if config.URL == "" || config.ClearDB {
+		return config, nil
+	}
+
+	stored, err := storedOptions(config.DBFile)
+	if err != nil {
+		return nil, err
+	}
+	if stored != nil {
+		return nil, fmt.Errorf("%v already holds a scan of %v, use \"get-good resume %v\" to continue it or -clear-db to start again", config.DBFile, stored.URL, config.DBFile)
+	}
+	return config, nil
+}
+
+// LoadResume builds the config to resume the scan stored in the
+// database given in the arguments. The target and recursion always come
+// from the stored scan, the wordlist and extensions may only be changed
+// when extending the scan which the scanner checks when it starts
+func LoadResume(args []string) (*Config, error) {
+	_, positional, err := load("resume", Default(), args)
+	if err != nil {
+		return nil, err
+	}
+	if len(positional) != 1 {
+		return nil, errors.New("please provide the database to resume")
+	}
+
+	dbFile := positional[0]
+	if !strings.HasSuffix(dbFile, ".db") {
+		dbFile += ".db"
+	}
+	stored, err := storedOptions(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		return nil, fmt.Errorf("%v does not hold a scan to resume", dbFile)
+	}
+
+	base := Default()
+	base.Options = *stored
+	base.Extend = false
+	config, _, err := load("resume", base, args)
+	if err != nil {
+		return nil, err
+	}
+
+	config.URL = stored.URL
+	config.Recurse = stored.Recurse
+	if config.Wordlist != stored.Wordlist {
+		config.Words = nil
+	}
+	config.DBFile = dbFile
+	config.ClearDB = false
+	return config, nil
+}
+
+// Load the config for a command on top of the base, returning any
+// positional arguments
+func load(command string, base *Config, args []string) (*Config, []string, error) {
+	// The config file and profile are needed before anything else can
+	// be loaded, so the environment and flags are read once just to find
+	// them
+	var configFile, profile string
+	flags := base.clone().flagSet(command, &configFile, &profile)
+	err := applyEnv(flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = ParseFlags(flags, args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := base.clone()
+	profiles := make(map[string]map[string]interface{})
+	if configFile != "" {
+		profiles, err = config.loadFile(configFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if profile != "" {
+		err = config.applyProfile(profile, profiles)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	flags = config.flagSet(command, &configFile, &profile)
+	flags.SetOutput(ioutil.Discard)
+	err = applyEnv(flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	positional, err := ParseFlags(flags, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, positional, nil
+}
+
+// ParseFlags parses flags which may be mixed in with positional
+// arguments, returning the positional arguments
+func ParseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := make([]string, 0)
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// Copy the config so loading a layer never modifies the one beneath it
+func (config *Config) clone() *Config {
+	c := *config
+	c.Extensions = append([]string(nil), config.Extensions...)
+	c.Words = append([]string(nil), config.Words...)
+	c.Boost = append([]string(nil), config.Boost...)
+	c.Scope.Hosts = append([]string(nil), config.Scope.Hosts...)
+	c.Scope.Include = append([]string(nil), config.Scope.Include...)
+	c.Scope.Exclude = append([]string(nil), config.Scope.Exclude...)
+	c.Scope.BlockedExtensions = append([]string(nil), config.Scope.BlockedExtensions...)
+	c.Policies = nil
+	c.mergePolicies(config.Policies)
+	return &c
+}
+
+func (config *Config) loadFile(filename string) (map[string]map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+	if filepath.Ext(filename) == ".toml" {
+		data, err = tomlToYaml(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing config file %v: %v", filename, err)
+		}
+	}
+
+	policies := config.Policies
+	file := &File{Config: *config}
+	file.Policies = nil
+	err = yaml.UnmarshalStrict(data, file)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %v: %v", filename, err)
+	}
+
+	*config = file.Config
+	config.mergePolicies(policies)
+	return file.Profiles, nil
+}
+
+// TOML config files use the same setting names as yaml, so they're
+// converted to be checked and applied exactly as a yaml file would be
+func tomlToYaml(data []byte) ([]byte, error) {
+	settings := make(map[string]interface{})
+	_, err := toml.Decode(string(data), &settings)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(settings)
+}
+
+// Apply a profile from the config file, or a built in profile if the
+// file doesn't define one with that name
+func (config *Config) applyProfile(name string, profiles map[string]map[string]interface{}) error {
+	var data []byte
+	if profile, ok := profiles[name]; ok {
+		var err error
+		data, err = yaml.Marshal(profile)
+		if err != nil {
+			return err
+		}
+	} else if profile, ok := builtinProfiles[name]; ok {
+		data = []byte(profile)
+	} else {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+
+	policies := config.Policies
+	config.Policies = nil
+	err := yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return fmt.Errorf("error applying profile %v: %v", name, err)
+	}
+	config.mergePolicies(policies)
+	return nil
+}
+
+// Policies are only given for the components being changed, so keep
+// the existing policy for any component left out
+func (config *Config) mergePolicies(base map[string]lib.Policy) {
+	merged := make(map[string]lib.Policy)
+	for name, policy := range base {
+		merged[name] = policy
+	}
+	for name, policy := range config.Policies {
+		merged[name] = policy
+	}
+	config.Policies = merged
+}
+
+// Set any flag which has a matching environment variable
+func applyEnv(flags *flag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		value, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %v: %v", value, name, setErr)
+		}
+	})
+	return err
+}
+
+// Read the options stored in an existing database, returns nil if the
+// database doesn't exist or has no options stored
+func storedOptions(dbFile string) (*lib.Options, error) {
+	if !strings.HasSuffix(dbFile, ".db") {
+		dbFile += ".db"
+	}
+	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	db, err := lib.OpenDatabaseConnection(dbFile)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database connection: %v", err)
+	}
+	defer db.CloseDatabaseConnection()
+
+	err = db.CreateSchema()
+	if err != nil {
+		return nil, fmt.Errorf("error creating database schema: %v", err)
+	}
+
+	options, err := db.LoadOptions()
+	if err != nil {
+		return nil, fmt.Errorf("error loading stored options: %v", err)
+	}
+	return options, nil
+}
+
+// Validate returns every problem found with the config
+func (config *Config) Validate() []error {
+	problems := make([]error, 0)
+	if config.Workers < 1 && config.CoordinatorAddr == "" {
+		problems = append(problems, errors.New("please specify 1 or more worker threads, or 0 when coordinating agents"))
+	}
+	if config.Workers < 0 {
+		problems = append(problems, errors.New("please specify 0 or more worker threads"))
+	}
+	if config.URL == "" && !config.API {
+		problems = append(problems, errors.New("please provide a URL to perform the directory bust against"))
+	}
+	if config.URL != "" && config.Wordlist == "" && len(config.Words) == 0 {
+		problems = append(problems, errors.New("please provide a wordlist file"))
+	}
+	if config.QueueSize < 1 {
+		problems = append(problems, errors.New("please specify 1 or more for queue size"))
+	}
+	if config.PollerBatchSize < 1 {
+		problems = append(problems, errors.New("please specify 1 or more for poller batch size"))
+	}
+	if config.Timeout < 0 {
+		problems = append(problems, errors.New("please specify 0 or more for http client timeout"))
+	}
+	if config.LogLines < 1 {
+		problems = append(problems, errors.New("please specify 1 or more for log lines"))
+	}
+	if config.Rate < 0 {
+		problems = append(problems, errors.New("please specify 0 or more for rate limit"))
+	}
+	if config.MaxRestarts < 0 {
+		problems = append(problems, errors.New("please specify 0 or more for max restarts"))
+	}
+	if config.ClusterLimit < 0 {
+		problems = append(problems, errors.New("please specify 0 or more for cluster limit"))
+	}
+	if config.ShutdownTimeout < 0 {
+		problems = append(problems, errors.New("please specify 0 or more for shutdown timeout"))
+	}
+	if config.LeaseTimeout < 0 {
+		problems = append(problems, errors.New("please specify 0 or more for lease timeout"))
+	}
+	if config.URL != "" {
+		_, err := lib.NewScope(config.URL, config.Scope)
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if config.Strategy != "" {
+		_, err := lib.ParseStrategy(string(config.Strategy))
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if config.Redirects != "" {
+		_, err := lib.ParseRedirectPolicy(string(config.Redirects))
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if config.MaxRedirects < 0 {
+		problems = append(problems, errors.New("please specify 0 or more for max redirects"))
+	}
+	err := lib.ValidatePolicies(config.Policies)
+	if err != nil {
+		problems = append(problems, err)
+	}
+	return problems
+}
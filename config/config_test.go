@@ -0,0 +1,57 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func setEnv(t *testing.T, name string, value string) {
+	err := os.Setenv(name, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Unsetenv(name)
+	})
+}
+
+// The config file and profile can be chosen through the environment
+// like any other flag, and flags still override them
+func TestLoadConfigAndProfileFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "get-good.toml")
+	err := ioutil.WriteFile(configFile, []byte("rate = 7\n\n[profiles.careful]\nworkers = 3\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-url", "http://localhost", "-wordlist", "words.txt", "-db", filepath.Join(dir, "bust.db")}
+
+	setEnv(t, envPrefix+"PROFILE", "stealth")
+	config, err := LoadScan(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Workers != 2 || config.Rate != 5 {
+		t.Errorf("expected the stealth profile from the environment, got %v workers at %v r/s", config.Workers, config.Rate)
+	}
+
+	setEnv(t, envPrefix+"CONFIG", configFile)
+	setEnv(t, envPrefix+"PROFILE", "careful")
+	config, err = LoadScan(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Workers != 3 || config.Rate != 7 {
+		t.Errorf("expected the config file and profile from the environment, got %v workers at %v r/s", config.Workers, config.Rate)
+	}
+
+	config, err = LoadScan(append(args, "-profile", "fast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Workers != 50 || config.Rate != 7 {
+		t.Errorf("expected the profile flag to override the environment, got %v workers at %v r/s", config.Workers, config.Rate)
+	}
+}
@@ -0,0 +1,176 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	lib "github.com/dpindur/get-good/libgetgood"
+)
+
+// Profiles available without a config file
+var builtinProfiles = map[string]string{
+	"stealth": "workers: 2\nrate: 5\ntimeout: 20\n",
+	"fast":    "workers: 50\ntimeout: 5\nqueue-size: 20000\npoller-batch-size: 20000\n",
+	// Apis rarely use extensions and often answer any path the same way
+	"api": "extensions: []\nrecurse: true\ncluster-limit: 10\n",
+}
+
+// Usage lines for the commands which load a config
+var usages = map[string]string{
+	"scan":   "get-good scan [flags]",
+	"resume": "get-good resume <db> [flags]",
+}
+
+// Create the flags for a command, with defaults taken from the config
+// so flags which aren't given leave the config unchanged. When resuming
+// the flags which would change what is being scanned are left out
+func (config *Config) flagSet(command string, configFile *string, profile *string) *flag.FlagSet {
+	flags := flag.NewFlagSet("get-good "+command, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v\n", usages[command])
+		flags.PrintDefaults()
+		fmt.Fprintf(flags.Output(), "\nEvery flag can also be set with an environment variable, for example %vQUEUE_SIZE\n", envPrefix)
+	}
+
+	flags.StringVar(configFile, "config", *configFile, "yaml or toml config file to load settings from, toml when it has the .toml extension")
+	flags.StringVar(profile, "profile", *profile, "profile to apply, either one defined in the config file or a built in profile ("+strings.Join(profileNames(), ", ")+")")
+
+	if command == "resume" {
+		flags.BoolVar(&config.Extend, "extend", config.Extend, "extend the directory bust with a new wordlist or extensions, only the new combinations are requested beneath every directory found so far")
+	} else {
+		flags.BoolVar(&config.ClearDB, "clear-db", config.ClearDB, "clear the database before starting, the findings of the previous scan are kept as a session to diff against")
+		flags.StringVar(&config.DBFile, "db", config.DBFile, "database file to store results")
+		flags.StringVar(&config.URL, "url", config.URL, "url to perform directory bust against")
+		flags.BoolVar(&config.Recurse, "recurse", config.Recurse, "recursively search directories")
+	}
+	flags.StringVar(&config.Wordlist, "wordlist", config.Wordlist, "wordlist file to use")
+	flags.Var((*listValue)(&config.Extensions), "extensions", "comma separated `list` of extensions to append, auto chooses them from what the target is fingerprinted as running")
+	flags.StringVar(&config.TechWordlists, "tech-wordlists", config.TechWordlists, "`directory` of wordlists named after technologies, such as php.txt, java.txt or aspnet.txt, whose words are added when the target is fingerprinted as running them")
+	flags.Var((*strategyValue)(&config.Strategy), "strategy", "`strategy` deciding the order requests are made in, breadth finishes each level of directories before going deeper, depth finishes each directory found first and promising favours short words and directories producing hits")
+	flags.Var((*listValue)(&config.Boost), "boost", "comma separated `list` of words to request before any others, whatever the strategy")
+	flags.Var((*listValue)(&config.Scope.Hosts), "scope-hosts", "comma separated `list` of hosts which may be requested, *.example.com allows a domain and its subdomains, only the target's host if not provided")
+	flags.Var((*patternsValue)(&config.Scope.Include), "include", "`regex` a path must match to be requested, can be given more than once and a path need only match one")
+	flags.Var((*patternsValue)(&config.Scope.Exclude), "exclude", "`regex` of paths which are never requested, can be given more than once")
+	flags.Var((*listValue)(&config.Scope.BlockedExtensions), "block-extensions", "comma separated `list` of extensions which are never requested")
+	flags.Var((*redirectsValue)(&config.Redirects), "redirects", "`policy` for following redirects, none only records where they point, same-host follows redirects on the same host and all follows any redirect in scope")
+	flags.BoolVar(&config.Spider, "spider", config.Spider, "parse html and scripts for links to request, adding the words in their paths to the wordlist")
+	flags.BoolVar(&config.Detect, "detect", config.Detect, "check every directory for exposed source control and metadata files such as .git/HEAD, .svn/entries, .DS_Store and .env, confirming them by their content and requesting the paths they list")
+	flags.BoolVar(&config.DetectCase, "detect-case", config.DetectCase, "check each host for case insensitivity by requesting a hit with its case swapped, requests differing only by case are then made once")
+	flags.BoolVar(&config.Seed, "seed", config.Seed, "read robots.txt, including disallowed paths, sitemaps, security.txt and crossdomain.xml for paths to request before any others")
+	flags.IntVar(&config.ClusterLimit, "cluster-limit", config.ClusterLimit, "number of near identical hits reported before any more like them are recorded without being reported or recursed into, specify zero for no limit")
+	flags.IntVar(&config.MaxRedirects, "max-redirects", config.MaxRedirects, "number of redirects followed in a row before the last redirect is recorded as the response")
+
+	flags.IntVar(&config.Workers, "workers", config.Workers, "number of worker threads")
+	flags.StringVar(&config.LogFile, "log-file", config.LogFile, "log file to output progress to")
+	flags.StringVar(&config.LogLevel, "log-level", config.LogLevel, "what level of logs and up should be logged (debug, info, warn, error, fatal, panic)")
+	flags.IntVar(&config.QueueSize, "queue-size", config.QueueSize, "number of urls that can sit in the queue at one time")
+	flags.IntVar(&config.PollerBatchSize, "poller-batch-size", config.PollerBatchSize, "number of urls the poller can pull from the database in one go")
+	flags.IntVar(&config.Timeout, "timeout", config.Timeout, "http timeout in seconds, specify zero for no timeout")
+	flags.IntVar(&config.Rate, "rate", config.Rate, "maximum requests per second across all workers, specify zero for no limit")
+	flags.Var((*policiesValue)(&config.Policies), "policies", "comma separated component=`policy` pairs deciding how failures are handled, components are updater, expander, poller, monitor, http worker and coordinator, policies are restart, degrade and abort")
+	flags.IntVar(&config.MaxRestarts, "max-restarts", config.MaxRestarts, "number of times a component can be restarted before the directory bust is aborted")
+	flags.IntVar(&config.ShutdownTimeout, "shutdown-timeout", config.ShutdownTimeout, "seconds to wait for in-flight requests to complete when stopping")
+	flags.StringVar(&config.MetricsAddr, "metrics-addr", config.MetricsAddr, "address to serve prometheus metrics on, for example localhost:9090 (disabled by default)")
+	flags.IntVar(&config.LogLines, "log-lines", config.LogLines, "number of log lines kept in the terminal log pane")
+	flags.BoolVar(&config.API, "api", config.API, "enable the http control api, a url and wordlist are then optional as scans can be started through the api")
+	flags.StringVar(&config.APIAddr, "api-addr", config.APIAddr, "address for the http control api to listen on")
+	flags.StringVar(&config.APIToken, "api-token", config.APIToken, "token required to use the http control api, a random token is generated if not provided")
+	flags.StringVar(&config.CoordinatorAddr, "coordinator-addr", config.CoordinatorAddr, "address to listen for remote agents on, for example 0.0.0.0:8091, requests are then shared between the agents and the local workers (disabled by default)")
+	flags.StringVar(&config.CoordinatorToken, "coordinator-token", config.CoordinatorToken, "token agents must give to lease requests, a random token is generated if not provided")
+	flags.IntVar(&config.LeaseTimeout, "lease-timeout", config.LeaseTimeout, "seconds an agent has to report a batch of requests before they are handed to another agent")
+	return flags
+}
+
+func profileNames() []string {
+	names := make([]string, 0, len(builtinProfiles))
+	for name := range builtinProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A comma separated list flag
+type listValue []string
+
+func (list *listValue) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *listValue) Set(value string) error {
+	*list = strings.Split(value, ",")
+	return nil
+}
+
+// A flag which can be given more than once, each value is added to the
+// patterns from the config file
+type patternsValue []string
+
+func (patterns *patternsValue) String() string {
+	return strings.Join(*patterns, " ")
+}
+
+func (patterns *patternsValue) Set(value string) error {
+	_, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*patterns = append(*patterns, value)
+	return nil
+}
+
+// A request ordering strategy
+type strategyValue lib.Strategy
+
+func (strategy *strategyValue) String() string {
+	return string(*strategy)
+}
+
+func (strategy *strategyValue) Set(value string) error {
+	parsed, err := lib.ParseStrategy(value)
+	if err != nil {
+		return err
+	}
+	*strategy = strategyValue(parsed)
+	return nil
+}
+
+// A redirect policy
+type redirectsValue lib.RedirectPolicy
+
+func (redirects *redirectsValue) String() string {
+	return string(*redirects)
+}
+
+func (redirects *redirectsValue) Set(value string) error {
+	parsed, err := lib.ParseRedirectPolicy(value)
+	if err != nil {
+		return err
+	}
+	*redirects = redirectsValue(parsed)
+	return nil
+}
+
+// Component=policy pairs, applied on top of the existing policies
+type policiesValue map[string]lib.Policy
+
+func (policies *policiesValue) String() string {
+	pairs := make([]string, 0, len(*policies))
+	for name, policy := range *policies {
+		pairs = append(pairs, name+"="+string(policy))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (policies *policiesValue) Set(value string) error {
+	parsed, err := lib.ParsePolicies(*policies, value)
+	if err != nil {
+		return err
+	}
+	*policies = parsed
+	return nil
+}
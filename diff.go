@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+
+	config "github.com/dpindur/get-good/config"
+	lib "github.com/dpindur/get-good/libgetgood"
+)
+
+var diffTemplate = template.Must(template.New("diff").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>get-good diff</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.new { color: #080; }
+.gone { color: #a00; }
+.changed { color: #a60; }
+</style>
+</head>
+<body>
+<h1>{{.Old}} compared with {{.New}}</h1>
+<h2 class="new">New ({{len .Diff.New}})</h2>
+<table>
+<tr><th>Status</th><th>Size</th><th>Url</th></tr>
+{{range .Diff.New}}<tr><td>{{.Status}}</td><td>{{.Size}}</td><td>{{.Url}}</td></tr>
+{{end}}</table>
+<h2 class="gone">Gone ({{len .Diff.Gone}})</h2>
+<table>
+<tr><th>Status</th><th>Size</th><th>Url</th></tr>
+{{range .Diff.Gone}}<tr><td>{{.Status}}</td><td>{{.Size}}</td><td>{{.Url}}</td></tr>
+{{end}}</table>
+<h2 class="changed">Changed ({{len .Diff.Changed}})</h2>
+<table>
+<tr><th>Status</th><th>Size</th><th>Body</th><th>Url</th></tr>
+{{range .Diff.Changed}}<tr><td>{{.Old.Status}} &rarr; {{.New.Status}}</td><td>{{.Old.Size}} &rarr; {{.New.Size}}</td><td>{{if .BodyChanged}}changed{{end}}</td><td>{{.Url}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// One side of a diff, a session in a database
+type diffSource struct {
+	db      string
+	session int
+}
+
+func (source *diffSource) String() string {
+	return fmt.Sprintf("%v session %v", source.db, source.session)
+}
+
+func diffCommand(args []string) int {
+	flags := newFlagSet("diff [flags] <db> [new db]")
+	format := flags.String("format", "text", "output format (text, json, html)")
+	output := flags.String("output", "", "file to write the diff to, standard output if not provided")
+	oldSession := flags.Int("old", 0, "session of the older scan, by default the previous session when given one database or the latest session of the first database")
+	newSession := flags.Int("new", 0, "session of the newer scan, by default the latest session")
+	positional, err := config.ParseFlags(flags, args)
+	if err != nil {
+		return configError(err)
+	}
+	if len(positional) != 1 && len(positional) != 2 {
+		fmt.Printf("please provide one database to compare two of its sessions, or two databases to compare\n")
+		return 1
+	}
+	if *format != "text" && *format != "json" && *format != "html" {
+		fmt.Printf("unknown format %v, expected text, json or html\n", *format)
+		return 1
+	}
+
+	older, newer, err := diffSources(positional, *oldSession, *newSession)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	oldFindings, err := readFindings(older)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	newFindings, err := readFindings(newer)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			fmt.Printf("error creating %v: %v\n", *output, err)
+			return 1
+		}
+		defer out.Close()
+	}
+
+	err = writeDiff(out, *format, older, newer, lib.DiffFindings(oldFindings, newFindings))
+	if err != nil {
+		fmt.Printf("error writing diff: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// Work out which sessions are being compared, filling in the defaults
+// for any not given
+func diffSources(dbs []string, oldSession int, newSession int) (*diffSource, *diffSource, error) {
+	oldSessions, err := readSessions(dbs[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	older := &diffSource{dbs[0], oldSession}
+	newer := &diffSource{dbs[0], newSession}
+
+	if len(dbs) == 1 {
+		if newer.session == 0 {
+			newer.session = latestSession(oldSessions, 0)
+		}
+		if older.session == 0 {
+			older.session = latestSession(oldSessions, newer.session)
+		}
+		if older.session == 0 || older.session == newer.session {
+			return nil, nil, fmt.Errorf("%v only holds one session, give a second database to compare with", dbs[0])
+		}
+		return older, newer, nil
+	}
+
+	newSessions, err := readSessions(dbs[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	newer.db = dbs[1]
+	if older.session == 0 {
+		older.session = latestSession(oldSessions, 0)
+	}
+	if newer.session == 0 {
+		newer.session = latestSession(newSessions, 0)
+	}
+	return older, newer, nil
+}
+
+// The latest session before the given one, or the latest of all when
+// before is zero. Returns zero if there is no such session
+func latestSession(sessions []*lib.Session, before int) int {
+	latest := 0
+	for _, session := range sessions {
+		if before == 0 || session.ID < before {
+			latest = session.ID
+		}
+	}
+	return latest
+}
+
+func readSessions(filename string) ([]*lib.Session, error) {
+	db, err := openReadOnlyDatabase(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer db.CloseDatabaseConnection()
+
+	sessions, err := db.GetSessions()
+	if err != nil {
+		return nil, fmt.Errorf("error reading sessions from %v: %v", filename, err)
+	}
+	return sessions, nil
+}
+
+func readFindings(source *diffSource) ([]*lib.Finding, error) {
+	db, err := openReadOnlyDatabase(source.db)
+	if err != nil {
+		return nil, err
+	}
+	defer db.CloseDatabaseConnection()
+
+	findings, err := db.GetSessionFindings(source.session)
+	if err != nil {
+		return nil, fmt.Errorf("error reading findings from %v: %v", source, err)
+	}
+	return findings, nil
+}
+
+func writeDiff(out io.Writer, format string, older *diffSource, newer *diffSource, diff *lib.Diff) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(diff)
+	case "html":
+		return diffTemplate.Execute(out, struct {
+			Old  *diffSource
+			New  *diffSource
+			Diff *lib.Diff
+		}{older, newer, diff})
+	default:
+		fmt.Fprintf(out, "Comparing %v with %v\n", older, newer)
+		for _, finding := range diff.New {
+			fmt.Fprintf(out, "+ %v %v\n", finding.Status, finding.Url)
+		}
+		for _, finding := range diff.Gone {
+			fmt.Fprintf(out, "- %v %v\n", finding.Status, finding.Url)
+		}
+		for _, change := range diff.Changed {
+			status := fmt.Sprintf("%v", change.New.Status)
+			if change.StatusChanged() {
+				status = fmt.Sprintf("%v -> %v", change.Old.Status, change.New.Status)
+			}
+
+			if change.SizeChanged() {
+				fmt.Fprintf(out, "~ %v %v (size %v -> %v)\n", status, change.Url, change.Old.Size, change.New.Size)
+			} else if change.BodyChanged() {
+				fmt.Fprintf(out, "~ %v %v (body changed)\n", status, change.Url)
+			} else {
+				fmt.Fprintf(out, "~ %v %v\n", status, change.Url)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	config "github.com/dpindur/get-good/config"
+	lib "github.com/dpindur/get-good/libgetgood"
+)
+
+func exportCommand(args []string) int {
+	flags := newFlagSet("export [flags] <db>")
+	format := flags.String("format", "text", "output format (text, json, csv)")
+	output := flags.String("output", "", "file to write the findings to, standard output if not provided")
+	statuses := flags.String("status", "", "comma separated http statuses to export, anything other than a 404 if not provided")
+	prefix := flags.String("prefix", "", "only export urls starting with this prefix")
+	cluster := flags.Bool("cluster", false, "export one finding for each cluster of near identical responses along with the number of findings in it")
+	positional, err := config.ParseFlags(flags, args)
+	if err != nil {
+		return configError(err)
+	}
+	if len(positional) != 1 {
+		fmt.Printf("please provide the database to export\n")
+		return 1
+	}
+	if *format != "text" && *format != "json" && *format != "csv" {
+		fmt.Printf("unknown format %v, expected text, json or csv\n", *format)
+		return 1
+	}
+
+	filter := lib.FindingFilter{Prefix: *prefix}
+	filter.Statuses, err = parseStatuses(*statuses)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	db, err := openReadOnlyDatabase(positional[0])
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	defer db.CloseDatabaseConnection()
+
+	findings, err := db.GetFindings(filter)
+	if err != nil {
+		fmt.Printf("error reading findings: %v\n", err)
+		return 1
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			fmt.Printf("error creating %v: %v\n", *output, err)
+			return 1
+		}
+		defer out.Close()
+	}
+
+	if *cluster {
+		err = writeClusters(out, *format, lib.ClusterFindings(findings))
+	} else {
+		err = writeFindings(out, *format, findings)
+	}
+	if err != nil {
+		fmt.Printf("error writing findings: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func writeFindings(out io.Writer, format string, findings []*lib.Finding) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(findings)
+	case "csv":
+		writer := csv.NewWriter(out)
+		writer.Write([]string{"url", "status", "size", "bodyHash", "redirects", "source", "detected", "simhash"})
+		for _, finding := range findings {
+			writer.Write([]string{finding.Url, strconv.Itoa(finding.Status), strconv.FormatInt(finding.Size, 10), finding.BodyHash, redirectChain(finding), finding.Source, finding.Detected, finding.Simhash})
+		}
+		writer.Flush()
+		return writer.Error()
+	default:
+		for _, finding := range findings {
+			line := fmt.Sprintf("%v %v", finding.Status, finding.Url)
+			if len(finding.Redirects) > 0 {
+				line += " -> " + redirectChain(finding)
+			}
+			if finding.Detected != "" {
+				line += " [" + finding.Detected + "]"
+			}
+			_, err := fmt.Fprintf(out, "%v\n", line)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func writeClusters(out io.Writer, format string, clusters []*lib.Cluster) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(clusters)
+	case "csv":
+		writer := csv.NewWriter(out)
+		writer.Write([]string{"url", "status", "size", "bodyHash", "redirects", "source", "detected", "simhash", "count"})
+		for _, cluster := range clusters {
+			finding := cluster.Representative
+			writer.Write([]string{finding.Url, strconv.Itoa(finding.Status), strconv.FormatInt(finding.Size, 10), finding.BodyHash, redirectChain(finding), finding.Source, finding.Detected, finding.Simhash, strconv.Itoa(cluster.Count)})
+		}
+		writer.Flush()
+		return writer.Error()
+	default:
+		for _, cluster := range clusters {
+			finding := cluster.Representative
+			line := fmt.Sprintf("%v %v", finding.Status, finding.Url)
+			if len(finding.Redirects) > 0 {
+				line += " -> " + redirectChain(finding)
+			}
+			if finding.Detected != "" {
+				line += " [" + finding.Detected + "]"
+			}
+			if cluster.Count > 1 {
+				line += fmt.Sprintf(" (+%v similar)", cluster.Count-1)
+			}
+			_, err := fmt.Fprintf(out, "%v\n", line)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// The urls a finding was redirected through, separated by arrows
+func redirectChain(finding *lib.Finding) string {
+	urls := make([]string, 0, len(finding.Redirects))
+	for _, redirect := range finding.Redirects {
+		urls = append(urls, redirect.Url)
+	}
+	return strings.Join(urls, " -> ")
+}
+
+// Parse a comma separated list of http statuses
+func parseStatuses(str string) ([]int, error) {
+	statuses := make([]int, 0)
+	if str == "" {
+		return statuses, nil
+	}
+	for _, s := range strings.Split(str, ",") {
+		status, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %q", s)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
@@ -0,0 +1,371 @@
+package libgetgood
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/dpindur/get-good/logger"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// Number of times in a row the coordinator may be unreachable before
+// the agent gives up
+const agentMaxRetries = 5
+
+// Base delay between attempts to reach the coordinator, multiplied by
+// the number of attempts so far
+const agentRetryDelay = 2 * time.Second
+
+// Time between reporting batches of responses to the coordinator
+const reportInterval = 500 * time.Millisecond
+
+// Time between logging the agent's progress
+const agentLogInterval = 10 * time.Second
+
+var errUnauthorised = errors.New("coordinator rejected the token")
+
+// AgentOptions configure a remote agent
+type AgentOptions struct {
+	Coordinator string
+	Token       string
+	Name        string
+	Workers     int
+	Rate        int
+	Timeout     int
+	BatchSize   int
+	Logger      logrus.FieldLogger
+}
+
+func (options *AgentOptions) Validate() error {
+	if options.Coordinator == "" {
+		return errors.New("coordinator is required")
+	}
+	if !strings.Contains(options.Coordinator, "://") {
+		options.Coordinator = "http://" + options.Coordinator
+	}
+	options.Coordinator = strings.TrimSuffix(options.Coordinator, "/")
+	if options.Token == "" {
+		return errors.New("token is required")
+	}
+	if options.Workers < 1 {
+		return errors.New("workers must be 1 or more")
+	}
+	if options.Rate < 0 {
+		return errors.New("rate must be 0 or more")
+	}
+	if options.Timeout < 0 {
+		return errors.New("timeout must be 0 or more")
+	}
+	if options.BatchSize < 1 {
+		return errors.New("batch size must be 1 or more")
+	}
+	if options.Logger == nil {
+		options.Logger = Logger
+	}
+	return nil
+}
+
+// Agent leases batches of requests from a coordinator, makes them with
+// its own http workers and reports the responses back. The coordinator
+// owns the database, the agent keeps no state of its own
+type Agent struct {
+	options      *AgentOptions
+	client       *http.Client
+	api          *http.Client
+	stats        *Stats
+	throttle     *Throttle
+	supervisor   *Supervisor
+	scope        *Scope
+	httpWg       *sync.WaitGroup
+	mutex        *sync.Mutex
+	workerErr    *WorkerError
+	stopChan     chan int
+	requestChan  chan *Request
+	responseChan chan *Response
+	logger       logrus.FieldLogger
+}
+
+func NewAgent(options *AgentOptions) (*Agent, error) {
+	err := options.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	agent := &Agent{
+		options:      options,
+		api:          &http.Client{Timeout: leaseWait + 30*time.Second},
+		stats:        NewStats(),
+		throttle:     NewThrottle(options.Rate),
+		httpWg:       &sync.WaitGroup{},
+		mutex:        &sync.Mutex{},
+		stopChan:     make(chan int, 1),
+		requestChan:  make(chan *Request, options.BatchSize),
+		responseChan: make(chan *Response, options.BatchSize),
+		logger:       options.Logger,
+	}
+	agent.supervisor = NewSupervisor(DefaultPolicies(), DefaultOptions().MaxRestarts, agent.abort, options.Logger)
+	return agent, nil
+}
+
+// Run leases and makes requests until the coordinator's scan stops, the
+// coordinator can't be reached or ctx is cancelled. Requests leased but
+// not yet made when the agent stops are reclaimed by the coordinator
+// once their lease expires
+func (agent *Agent) Run(ctx context.Context) error {
+	options := agent.options
+	agent.logger.Infof("Starting get-good agent %v", options.Name)
+	agent.logger.Infof("Coordinator: %v", options.Coordinator)
+	agent.logger.Infof("Worker threads: %v", options.Workers)
+	agent.logger.Infof("Batch size: %v", options.BatchSize)
+	agent.logger.Infof("Rate limit: %v", options.Rate)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	reportWg := &sync.WaitGroup{}
+	reportWg.Add(1)
+	go agent.report(reportWg)
+
+	err := agent.lease(ctx, requestCtx)
+
+	// Stop taking requests, giving in-flight requests until the request
+	// timeout to complete before aborting them
+	cancel()
+	grace := time.Duration(options.Timeout) * time.Second
+	if !waitTimeout(agent.httpWg, grace) {
+		agent.logger.Warnf("In-flight requests did not complete in time, aborting them")
+	}
+	cancelRequests()
+	agent.httpWg.Wait()
+	close(agent.responseChan)
+	reportWg.Wait()
+	if agent.client != nil {
+		CleanupClient(agent.client)
+	}
+
+	agent.mutex.Lock()
+	workerErr := agent.workerErr
+	agent.mutex.Unlock()
+	if err == nil && workerErr != nil {
+		err = fmt.Errorf("error in %v: %v", workerErr.Worker, workerErr.Error)
+	}
+	agent.logger.Infof("Agent stopped after %v requests", agent.stats.Requests())
+	return err
+}
+
+// Stop signals the agent to stop leasing requests
+func (agent *Agent) Stop() {
+	select {
+	case agent.stopChan <- 0:
+		break
+	default:
+		break
+	}
+}
+
+func (agent *Agent) Stats() *Stats {
+	return agent.stats
+}
+
+// Called by the supervisor when an http worker fails too often
+func (agent *Agent) abort(workerErr *WorkerError) {
+	agent.mutex.Lock()
+	if agent.workerErr == nil {
+		agent.workerErr = workerErr
+	}
+	agent.mutex.Unlock()
+	agent.Stop()
+}
+
+// The http workers are started once the scope, redirect policy and
+// whether to spider and detect have been received from the coordinator,
+// so every request is made the same way as by the coordinator's own
+// workers
+func (agent *Agent) startWorkers(ctx context.Context, requestCtx context.Context, lease *Lease) error {
+	rules := ScopeRules{}
+	if lease.Scope != nil {
+		rules = *lease.Scope
+	}
+	scope, err := NewScope(lease.Target, rules)
+	if err != nil {
+		return fmt.Errorf("error reading scope from coordinator: %v", err)
+	}
+	redirects := lease.Redirects
+	if redirects == "" {
+		redirects = RedirectNone
+	}
+	agent.logger.Infof("Target: %v", lease.Target)
+	agent.logger.Infof("Redirects: %v, max redirects: %v", redirects, lease.MaxRedirects)
+	agent.logger.Infof("Spider: %v", lease.Spider)
+	agent.logger.Infof("Detect exposed metadata files: %v", lease.Detect)
+	agent.logger.Infof("Detect case insensitive hosts: %v", lease.DetectCase)
+
+	agent.scope = scope
+	agent.client = NewClient(agent.options.Timeout, redirects, lease.MaxRedirects, scope, agent.logger)
+	var caseChecker *CaseChecker
+	if lease.DetectCase {
+		caseChecker = NewCaseChecker(nil)
+	}
+	for i := 0; i < agent.options.Workers; i++ {
+		StartHttpWorker(ctx, requestCtx, agent.httpWg, nil, agent.client, agent.scope, lease.Spider, lease.Detect, caseChecker, agent.supervisor, agent.requestChan, agent.responseChan, agent.throttle, agent.stats, agent.logger)
+	}
+	return nil
+}
+
+// Lease requests for the http workers whenever the queue has room,
+// returns once the coordinator says the scan is done
+func (agent *Agent) lease(ctx context.Context, requestCtx context.Context) error {
+	logTicker := time.NewTicker(agentLogInterval)
+	defer logTicker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-agent.stopChan:
+			return nil
+		case <-logTicker.C:
+			agent.logger.Infof("Completed %v requests", agent.stats.Requests())
+			break
+		default:
+			break
+		}
+
+		size := cap(agent.requestChan) - len(agent.requestChan)
+		if size == 0 {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		lease := &Lease{}
+		err := agent.post(ctx, "/agent/lease", &LeaseRequest{agent.options.Name, size}, lease)
+		if err == errUnauthorised {
+			return err
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			failures++
+			if failures > agentMaxRetries {
+				return fmt.Errorf("giving up on coordinator after %v attempts: %v", failures, err)
+			}
+			agent.logger.Warnf("Error leasing requests, retrying")
+			agent.logger.Warnf("%v", err)
+			time.Sleep(time.Duration(failures) * agentRetryDelay)
+			continue
+		}
+		failures = 0
+
+		if lease.Done {
+			agent.logger.Infof("Coordinator has stopped handing out requests")
+			return nil
+		}
+		if agent.scope == nil {
+			err = agent.startWorkers(ctx, requestCtx, lease)
+			if err != nil {
+				return err
+			}
+		}
+		if len(lease.Urls) == 0 {
+			continue
+		}
+		agent.logger.Debugf("Leased %v requests, lease %v expires in %vs", len(lease.Urls), lease.ID, lease.Expires)
+		for _, url := range lease.Urls {
+			agent.requestChan <- &Request{Url: url}
+		}
+	}
+}
+
+// Send responses to the coordinator in batches until the response
+// channel is closed
+func (agent *Agent) report(wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Response, 0, agent.options.BatchSize)
+	running := true
+	for running {
+		select {
+		case response, ok := <-agent.responseChan:
+			if !ok {
+				running = false
+				break
+			}
+			batch = append(batch, response)
+			if len(batch) < agent.options.BatchSize {
+				break
+			}
+			batch = agent.send(batch)
+			break
+		case <-ticker.C:
+			batch = agent.send(batch)
+			break
+		}
+	}
+	agent.send(batch)
+}
+
+// Send a batch of responses, returning an empty batch to fill. Results
+// that can't be sent are dropped, their lease expires and the
+// coordinator hands them out again
+func (agent *Agent) send(batch []*Response) []*Response {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	var err error
+	for attempt := 1; attempt <= agentMaxRetries; attempt++ {
+		err = agent.post(context.Background(), "/agent/results", &Results{agent.options.Name, batch}, &Lease{})
+		if err == nil || err == errUnauthorised {
+			break
+		}
+		time.Sleep(time.Duration(attempt) * agentRetryDelay)
+	}
+	if err != nil {
+		agent.logger.Errorf("Error reporting %v responses to coordinator", len(batch))
+		agent.logger.Errorf("%v", err)
+	}
+	return batch[:0]
+}
+
+func (agent *Agent) post(ctx context.Context, path string, body interface{}, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, agent.options.Coordinator+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+agent.options.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := agent.api.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return errUnauthorised
+	}
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("coordinator responded %v: %v", res.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,90 @@
+package libgetgood
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// CaseChecker tracks the hosts checked for case insensitivity so each
+// is only checked once, by whichever worker gets a hit on it first
+type CaseChecker struct {
+	mutex       *sync.Mutex
+	checked     map[string]bool
+	insensitive map[string]bool
+}
+
+// NewCaseChecker creates a checker treating the given origins, those
+// recorded in earlier runs of the scan, as already checked
+func NewCaseChecker(checked map[string]bool) *CaseChecker {
+	checker := &CaseChecker{&sync.Mutex{}, make(map[string]bool), make(map[string]bool)}
+	for origin, insensitive := range checked {
+		checker.checked[origin] = true
+		checker.insensitive[origin] = insensitive
+	}
+	return checker
+}
+
+// Claim the check of an origin, returning false if it has been checked
+// or another worker is checking it
+func (checker *CaseChecker) claim(origin string) bool {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	if _, ok := checker.checked[origin]; ok {
+		return false
+	}
+	checker.checked[origin] = false
+	return true
+}
+
+// Finish the check of an origin, a check that couldn't be made is left
+// for the next hit
+func (checker *CaseChecker) release(origin string, checked bool, insensitive bool) {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	if !checked {
+		delete(checker.checked, origin)
+		return
+	}
+	checker.checked[origin] = true
+	checker.insensitive[origin] = insensitive
+}
+
+// Returns whether a url's host has been found to ignore case
+func (checker *CaseChecker) ignoresCase(rawURL string) bool {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	return checker.insensitive[urlOrigin(rawURL)]
+}
+
+// The scheme and host of a url, which requests are grouped by when
+// deciding whether they differ only by case
+func urlOrigin(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + strings.ToLower(u.Host)
+}
+
+// Swap the case of every letter in a url's path, returning false if the
+// path has no letters to swap
+func flipCase(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	flipped := strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, u.Path)
+	if flipped == u.Path {
+		return "", false
+	}
+	u.Path = flipped
+	u.RawPath = ""
+	return u.String(), true
+}
@@ -0,0 +1,226 @@
+package libgetgood
+
+import (
+	"bytes"
+	"hash/fnv"
+	"math/bits"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// Responses whose similarity hashes differ by at most this many bits
+// are treated as the same page
+const clusterDistance = 3
+
+// Number of 16 bit blocks a hash is split into to find clusters with,
+// hashes within clusterDistance bits of each other always share one
+// block unchanged as there are more blocks than differing bits
+const simhashBlocks = 4
+
+// Number of the largest clusters included in each report
+const reportedClusters = 5
+
+var tokenPattern = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// Cluster is a group of findings with the same status whose responses
+// are near identical, represented by the first of them found
+type Cluster struct {
+	Representative *Finding `json:"representative"`
+	Count          int      `json:"count"`
+	Urls           []string `json:"urls,omitempty"`
+}
+
+// Simhash returns a 64 bit similarity hash of a body in hex. It's built
+// from overlapping runs of three words, so pages differing in only a
+// few words, such as a template echoing back the path, hash to values
+// differing in only a few bits
+func Simhash(body []byte) string {
+	tokens := tokenPattern.FindAll(bytes.ToLower(body), -1)
+	shingles := len(tokens) - 2
+	if shingles < 1 {
+		shingles = 1
+	}
+
+	var weights [64]int
+	for i := 0; i < shingles; i++ {
+		end := i + 3
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		hash := fnv.New64a()
+		hash.Write(bytes.Join(tokens[i:end], []byte(" ")))
+		feature := hash.Sum64()
+		for bit := 0; bit < 64; bit++ {
+			if feature&(1<<uint(bit)) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+
+	var simhash uint64
+	for bit := 0; bit < 64; bit++ {
+		if weights[bit] > 0 {
+			simhash |= 1 << uint(bit)
+		}
+	}
+	return strconv.FormatUint(simhash, 16)
+}
+
+// The hash of a finding, false if it has none. Responses which weren't
+// hashed, such as redirects or those recorded by older versions, are
+// never clustered
+func findingSimhash(finding *Finding) (uint64, bool) {
+	if finding.Simhash == "" {
+		return 0, false
+	}
+	simhash, err := strconv.ParseUint(finding.Simhash, 16, 64)
+	return simhash, err == nil
+}
+
+// Whether two similarity hashes in hex are close enough to be the same
+// page, responses without a hash are never similar
+func similarSimhash(a string, b string) bool {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return false
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	return err == nil && bits.OnesCount64(x^y) <= clusterDistance
+}
+
+// Groups findings of clustered responses with their hashes, a finding
+// joins the first cluster with the same status and a close enough hash.
+// Clusters are indexed by each block of their hash so only those
+// sharing a block with a finding's hash are compared with it
+type clusterSet struct {
+	clusters []*Cluster
+	hashes   []uint64
+	blocks   map[clusterBlock][]int
+}
+
+type clusterBlock struct {
+	status int
+	block  int
+	value  uint16
+}
+
+func newClusterSet() *clusterSet {
+	return &clusterSet{make([]*Cluster, 0), make([]uint64, 0), make(map[clusterBlock][]int)}
+}
+
+func (set *clusterSet) add(finding *Finding, keepUrls bool) *Cluster {
+	simhash, ok := findingSimhash(finding)
+	if ok {
+		if i := set.find(finding.Status, simhash); i >= 0 {
+			cluster := set.clusters[i]
+			cluster.Count++
+			if keepUrls {
+				cluster.Urls = append(cluster.Urls, finding.Url)
+			}
+			return cluster
+		}
+	}
+
+	cluster := &Cluster{finding, 1, nil}
+	if keepUrls {
+		cluster.Urls = []string{finding.Url}
+	}
+	if ok {
+		for block := 0; block < simhashBlocks; block++ {
+			key := clusterBlock{finding.Status, block, uint16(simhash >> uint(16*block))}
+			set.blocks[key] = append(set.blocks[key], len(set.clusters))
+		}
+		set.clusters = append(set.clusters, cluster)
+		set.hashes = append(set.hashes, simhash)
+	}
+	return cluster
+}
+
+// The index of the first cluster with the status and a close enough
+// hash, or -1 if there's none. Each block's clusters are held in the
+// order they were added, so only the first match of each is needed
+func (set *clusterSet) find(status int, simhash uint64) int {
+	first := -1
+	for block := 0; block < simhashBlocks; block++ {
+		key := clusterBlock{status, block, uint16(simhash >> uint(16*block))}
+		for _, i := range set.blocks[key] {
+			if first >= 0 && i >= first {
+				break
+			}
+			if bits.OnesCount64(set.hashes[i]^simhash) <= clusterDistance {
+				first = i
+				break
+			}
+		}
+	}
+	return first
+}
+
+// ClusterFindings groups findings whose responses are near identical,
+// returning the clusters in the order their first finding appears.
+// Findings which weren't hashed are each in a cluster of their own
+func ClusterFindings(findings []*Finding) []*Cluster {
+	set := newClusterSet()
+	clusters := make([]*Cluster, 0)
+	for _, finding := range findings {
+		cluster := set.add(finding, true)
+		if cluster.Count == 1 {
+			clusters = append(clusters, cluster)
+		}
+	}
+	return clusters
+}
+
+// Clusters groups a scan's hits as they arrive. Once a cluster holds
+// more hits than the limit, hits like them are suppressed. No limit is
+// set by a limit of zero
+type Clusters struct {
+	mutex  *sync.Mutex
+	limit  int
+	set    *clusterSet
+	logger logrus.FieldLogger
+}
+
+func NewClusters(limit int, logger logrus.FieldLogger) *Clusters {
+	return &Clusters{&sync.Mutex{}, limit, newClusterSet(), logger}
+}
+
+// Add a hit, returning whether it's suppressed
+func (clusters *Clusters) add(finding *Finding) bool {
+	clusters.mutex.Lock()
+	defer clusters.mutex.Unlock()
+	cluster := clusters.set.add(finding, false)
+	if clusters.limit == 0 || cluster.Count <= clusters.limit {
+		return false
+	}
+	if cluster.Count == clusters.limit+1 {
+		clusters.logger.Warnf("Suppressing hits like %v, more than %v similar responses found", cluster.Representative.Url, clusters.limit)
+	}
+	return true
+}
+
+// Largest returns copies of the biggest clusters of more than one hit,
+// largest first
+func (clusters *Clusters) Largest(n int) []*Cluster {
+	clusters.mutex.Lock()
+	defer clusters.mutex.Unlock()
+	largest := make([]*Cluster, 0)
+	for _, cluster := range clusters.set.clusters {
+		if cluster.Count > 1 {
+			largest = append(largest, &Cluster{cluster.Representative, cluster.Count, nil})
+		}
+	}
+	sort.SliceStable(largest, func(i, j int) bool {
+		return largest[i].Count > largest[j].Count
+	})
+	if len(largest) > n {
+		largest = largest[:n]
+	}
+	return largest
+}
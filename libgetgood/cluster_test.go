@@ -0,0 +1,55 @@
+package libgetgood
+
+import (
+	"math/bits"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// Looking clusters up by the blocks of their hashes finds the same
+// cluster as comparing with every one, including hashes differing by
+// up to clusterDistance bits spread across the blocks
+func TestClusterSetMatchesLinear(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	seeds := make([]uint64, 20)
+	for i := range seeds {
+		seeds[i] = random.Uint64()
+	}
+
+	set := newClusterSet()
+	indexes := make(map[*Cluster]int)
+	statuses := make([]int, 0)
+	hashes := make([]uint64, 0)
+	for i := 0; i < 2000; i++ {
+		hash := seeds[random.Intn(len(seeds))]
+		for flips := random.Intn(clusterDistance + 3); flips > 0; flips-- {
+			hash ^= 1 << uint(random.Intn(64))
+		}
+		status := 200
+		if random.Intn(4) == 0 {
+			status = 403
+		}
+
+		expected := len(hashes)
+		for j := range hashes {
+			if statuses[j] == status && bits.OnesCount64(hashes[j]^hash) <= clusterDistance {
+				expected = j
+				break
+			}
+		}
+		if expected == len(hashes) {
+			statuses = append(statuses, status)
+			hashes = append(hashes, hash)
+		}
+
+		finding := &Finding{Url: "http://localhost/" + strconv.Itoa(i), Status: status, Simhash: strconv.FormatUint(hash, 16)}
+		cluster := set.add(finding, false)
+		if cluster.Count == 1 {
+			indexes[cluster] = len(set.clusters) - 1
+		}
+		if indexes[cluster] != expected {
+			t.Fatalf("finding %v joined cluster %v, expected %v", i, indexes[cluster], expected)
+		}
+	}
+}
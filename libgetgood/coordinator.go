@@ -0,0 +1,362 @@
+package libgetgood
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// Longest a lease request waits for requests to become available
+const leaseWait = 1 * time.Second
+
+// Time between checks for expired leases
+const reapInterval = 1 * time.Second
+
+// LeaseRequest is sent by an agent asking for a batch of requests
+type LeaseRequest struct {
+	Agent string `json:"agent"`
+	Size  int    `json:"size"`
+}
+
+// Lease is a batch of urls handed to an agent. If the agent doesn't
+// report their results before the lease expires they are reclaimed and
+// handed out again. Done is set once the scan is stopping. The target,
+// scope rules, redirect policy and whether to spider and detect are
+// sent with every lease so agents make requests the same way as the
+// coordinator
+type Lease struct {
+	ID           string         `json:"id"`
+	Urls         []string       `json:"urls"`
+	Expires      int            `json:"expires"`
+	Done         bool           `json:"done"`
+	Target       string         `json:"target"`
+	Scope        *ScopeRules    `json:"scope"`
+	Redirects    RedirectPolicy `json:"redirects"`
+	MaxRedirects int            `json:"maxRedirects"`
+	Spider       bool           `json:"spider"`
+	Detect       bool           `json:"detect"`
+	DetectCase   bool           `json:"detectCase"`
+}
+
+// Results are the responses reported by an agent
+type Results struct {
+	Agent     string      `json:"agent"`
+	Responses []*Response `json:"responses"`
+}
+
+type lease struct {
+	id      string
+	agent   string
+	urls    map[string]bool
+	expires time.Time
+}
+
+// Coordinator hands out leased batches of requests from the queue to
+// remote agents over http, in the same way the poller feeds local
+// workers, and passes the agents' responses on to the updater
+type Coordinator struct {
+	running      bool
+	wg           *sync.WaitGroup
+	ctx          context.Context
+	cancel       context.CancelFunc
+	requestCtx   context.Context
+	db           *DBConn
+	supervisor   *Supervisor
+	requestChan  chan *Request
+	responseChan chan *Response
+	throttle     *Throttle
+	stats        *Stats
+	server       *http.Server
+	listener     net.Listener
+	token        string
+	leaseTimeout time.Duration
+	target       string
+	scope        ScopeRules
+	redirects    RedirectPolicy
+	maxRedirects int
+	spider       bool
+	detect       bool
+	detectCase   bool
+	mutex        *sync.Mutex
+	leases       map[string]*lease
+	leased       map[string]*lease
+	agents       map[string]bool
+	nextLease    int
+	logger       logrus.FieldLogger
+}
+
+// StartCoordinator listens for agents on addr. Like the http workers it
+// stops handing out requests once ctx is cancelled, but keeps accepting
+// results for outstanding leases until requestCtx is cancelled
+func StartCoordinator(ctx context.Context, requestCtx context.Context, wg *sync.WaitGroup, db *DBConn, supervisor *Supervisor, requestChan chan *Request, responseChan chan *Response, throttle *Throttle, stats *Stats, addr string, token string, leaseTimeout time.Duration, target string, scope ScopeRules, redirects RedirectPolicy, maxRedirects int, spider bool, detect bool, detectCase bool, logger logrus.FieldLogger) (*Coordinator, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	mux := http.NewServeMux()
+	coordinator := &Coordinator{true, wg, ctx, cancel, requestCtx, db, supervisor, requestChan, responseChan, throttle, stats, &http.Server{Addr: addr, Handler: mux}, listener, token, leaseTimeout, target, scope, redirects, maxRedirects, spider, detect, detectCase, &sync.Mutex{}, make(map[string]*lease), make(map[string]*lease), make(map[string]bool), 0, logger}
+	mux.HandleFunc("/agent/lease", coordinator.handleLease)
+	mux.HandleFunc("/agent/results", coordinator.handleResults)
+
+	go coordinator.serve()
+	wg.Add(1)
+	go coordinator.work()
+	return coordinator, nil
+}
+
+func (coordinator *Coordinator) Stop() {
+	coordinator.logger.Debugf("Sending coordinator stop signal")
+	coordinator.cancel()
+}
+
+func (coordinator *Coordinator) serve() {
+	err := coordinator.server.Serve(coordinator.listener)
+	if err != nil && err != http.ErrServerClosed {
+		coordinator.logger.Errorf("Error in coordinator server")
+		coordinator.logger.Errorf("%v", err)
+	}
+}
+
+func (coordinator *Coordinator) work() {
+	defer coordinator.wg.Done()
+	coordinator.supervisor.Supervise(coordinator.ctx, "coordinator", coordinator.run)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	coordinator.server.Shutdown(ctx)
+}
+
+func (coordinator *Coordinator) run() error {
+	coordinator.logger.Debugf("Starting coordinator")
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	running := true
+	var err error
+	for running {
+		select {
+		case <-ticker.C:
+			err = coordinator.reap()
+			if err != nil {
+				return err
+			}
+			break
+		case <-coordinator.ctx.Done():
+			running = false
+			break
+		}
+	}
+
+	// No more leases are handed out, wait for the outstanding ones to
+	// be reported until in-flight requests are aborted
+	for coordinator.Outstanding() > 0 {
+		select {
+		case <-ticker.C:
+			err = coordinator.reap()
+			if err != nil {
+				return err
+			}
+			break
+		case <-coordinator.requestCtx.Done():
+			coordinator.logger.Debugf("Coordinator stopped")
+			return nil
+		}
+	}
+	coordinator.logger.Debugf("Coordinator stopped")
+	return nil
+}
+
+// Outstanding returns the number of leased requests without results
+func (coordinator *Coordinator) Outstanding() int {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+	return len(coordinator.leased)
+}
+
+// Reclaim the requests of expired leases so the poller hands them out again
+func (coordinator *Coordinator) reap() error {
+	now := time.Now()
+	expired := make([]string, 0)
+	coordinator.mutex.Lock()
+	for id, lease := range coordinator.leases {
+		if now.Before(lease.expires) {
+			continue
+		}
+		coordinator.logger.Warnf("Lease %v of agent %v expired, reclaiming %v requests", id, lease.agent, len(lease.urls))
+		for url := range lease.urls {
+			expired = append(expired, url)
+			delete(coordinator.leased, url)
+		}
+		delete(coordinator.leases, id)
+	}
+	coordinator.mutex.Unlock()
+
+	if len(expired) == 0 {
+		return nil
+	}
+	start := time.Now()
+	err := coordinator.db.ResetRequests(expired)
+	coordinator.stats.RecordDBWrite(time.Since(start))
+	return err
+}
+
+func (coordinator *Coordinator) handleLease(w http.ResponseWriter, r *http.Request) {
+	if !coordinator.authorised(w, r) {
+		return
+	}
+
+	leaseRequest := &LeaseRequest{}
+	err := json.NewDecoder(r.Body).Decode(leaseRequest)
+	if err != nil || leaseRequest.Size < 1 {
+		http.Error(w, "invalid lease request", http.StatusBadRequest)
+		return
+	}
+
+	if coordinator.ctx.Err() != nil {
+		writeCoordinatorJSON(w, coordinator.newLease("", nil, true))
+		return
+	}
+	if coordinator.throttle.Paused() {
+		writeCoordinatorJSON(w, coordinator.newLease("", make([]string, 0), false))
+		return
+	}
+
+	urls := coordinator.take(leaseRequest.Size)
+	if len(urls) == 0 {
+		writeCoordinatorJSON(w, coordinator.newLease("", urls, coordinator.ctx.Err() != nil))
+		return
+	}
+
+	coordinator.mutex.Lock()
+	if !coordinator.agents[leaseRequest.Agent] {
+		coordinator.agents[leaseRequest.Agent] = true
+		coordinator.logger.Infof("Agent %v connected", leaseRequest.Agent)
+	}
+	coordinator.nextLease++
+	l := &lease{strconv.Itoa(coordinator.nextLease), leaseRequest.Agent, make(map[string]bool), time.Now().Add(coordinator.leaseTimeout)}
+	for _, url := range urls {
+		l.urls[url] = true
+		coordinator.leased[url] = l
+	}
+	coordinator.leases[l.id] = l
+	coordinator.mutex.Unlock()
+
+	coordinator.logger.Debugf("Leased %v requests to agent %v", len(urls), leaseRequest.Agent)
+	writeCoordinatorJSON(w, coordinator.newLease(l.id, urls, false))
+}
+
+func (coordinator *Coordinator) newLease(id string, urls []string, done bool) *Lease {
+	return &Lease{id, urls, int(coordinator.leaseTimeout / time.Second), done, coordinator.target, &coordinator.scope, coordinator.redirects, coordinator.maxRedirects, coordinator.spider, coordinator.detect, coordinator.detectCase}
+}
+
+// Take up to size requests from the queue, waiting briefly for the first
+func (coordinator *Coordinator) take(size int) []string {
+	urls := make([]string, 0, size)
+	select {
+	case request := <-coordinator.requestChan:
+		urls = append(urls, request.Url)
+		break
+	case <-time.After(leaseWait):
+		return urls
+	case <-coordinator.ctx.Done():
+		return urls
+	}
+
+	for len(urls) < size {
+		select {
+		case request := <-coordinator.requestChan:
+			urls = append(urls, request.Url)
+			break
+		default:
+			return urls
+		}
+	}
+	return urls
+}
+
+func (coordinator *Coordinator) handleResults(w http.ResponseWriter, r *http.Request) {
+	if !coordinator.authorised(w, r) {
+		return
+	}
+
+	results := &Results{}
+	err := json.NewDecoder(r.Body).Decode(results)
+	if err != nil {
+		http.Error(w, "invalid results", http.StatusBadRequest)
+		return
+	}
+
+	for _, response := range results.Responses {
+		// A result reported after its lease expired may be for a request
+		// already handed to another agent, only that agent's is kept
+		if !coordinator.complete(results.Agent, response.Url) {
+			coordinator.logger.Warnf("Dropping result of %v from agent %v, it isn't leased to the agent", response.Url, results.Agent)
+			continue
+		}
+		if response.OutOfScope {
+			coordinator.logger.Warnf("Agent %v refused to request %v as it is out of scope", results.Agent, response.Url)
+		} else if response.Success {
+			coordinator.stats.RecordResponse(response.Status, response.Latency)
+		} else {
+			coordinator.stats.RecordErrorClass(response.Error, response.Latency)
+		}
+
+		select {
+		case coordinator.responseChan <- response:
+			break
+		case <-coordinator.requestCtx.Done():
+			http.Error(w, "scan has stopped", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	writeCoordinatorJSON(w, coordinator.newLease("", nil, coordinator.ctx.Err() != nil))
+}
+
+// Remove a url from the agent's lease, reporting a result also renews
+// the lease. Returns false if the url isn't leased to the agent
+func (coordinator *Coordinator) complete(agent string, url string) bool {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+
+	l, ok := coordinator.leased[url]
+	if !ok || l.agent != agent {
+		return false
+	}
+	delete(coordinator.leased, url)
+	delete(l.urls, url)
+	l.expires = time.Now().Add(coordinator.leaseTimeout)
+	if len(l.urls) == 0 {
+		delete(coordinator.leases, l.id)
+	}
+	return true
+}
+
+func (coordinator *Coordinator) authorised(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(coordinator.token)) != 1 {
+		http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func writeCoordinatorJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,257 @@
+package libgetgood
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/dpindur/get-good/logger"
+)
+
+const testToken = "token"
+
+// An address nothing is listening on, for the coordinator to take
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// Lease requests as an agent which then dies without reporting them,
+// retrying until the coordinator is listening and has requests queued
+func leaseAndDie(t *testing.T, addr string) []string {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		body, _ := json.Marshal(&LeaseRequest{"dead", 5})
+		req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/agent/lease", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testToken)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		lease := &Lease{}
+		err = json.NewDecoder(res.Body).Decode(lease)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lease.Urls) > 0 {
+			return lease.Urls
+		}
+	}
+	t.Fatal("coordinator never leased any requests")
+	return nil
+}
+
+// Agents share out the scan between them, and the requests leased by an
+// agent that dies are reclaimed once its lease expires and made by the
+// others, so the scan still completes
+func TestCoordinatorWithAgents(t *testing.T) {
+	server := nestedServer()
+	defer server.Close()
+
+	words := []string{"a", "b", "c", "d"}
+	options := testOptions(t, server.URL, words)
+	options.Recurse = true
+	options.Workers = 0
+	options.QueueSize = 10
+	options.PollerBatchSize = 10
+	options.CoordinatorAddr = freeAddr(t)
+	options.CoordinatorToken = testToken
+	options.LeaseTimeout = 1
+
+	scanner, err := NewScanner(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- scanner.Run(context.Background())
+	}()
+
+	dead := leaseAndDie(t, options.CoordinatorAddr)
+
+	agents := make([]*Agent, 0)
+	agentErrs := make(chan error, 2)
+	wg := &sync.WaitGroup{}
+	for _, name := range []string{"one", "two"} {
+		agent, err := NewAgent(&AgentOptions{options.CoordinatorAddr, testToken, name, 2, 0, 5, 5, nil})
+		if err != nil {
+			t.Fatal(err)
+		}
+		agents = append(agents, agent)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agentErrs <- agent.Run(context.Background())
+		}()
+	}
+
+	select {
+	case err = <-done:
+	case <-time.After(60 * time.Second):
+		scanner.Stop()
+		t.Fatal("scan never completed")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanner.State() != ScanCompleted {
+		t.Fatalf("scan finished in state %v", scanner.State())
+	}
+
+	// Agents stop once told the scan is done
+	if !waitTimeout(wg, 30*time.Second) {
+		t.Fatal("agents never stopped")
+	}
+	close(agentErrs)
+	for err := range agentErrs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := OpenDatabaseConnection(options.DBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseDatabaseConnection()
+
+	total, err := db.GetTotalRequestCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	completed, err := db.GetCompletedRequestCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := len(words) + len(words)*len(words) + len(words)*len(words)*len(words)
+	if total != expected || completed != expected {
+		t.Fatalf("expected %v requests to be completed, %v of %v were", expected, completed, total)
+	}
+
+	// The dead agent leased from the first level, which is all hits, so
+	// its requests being reclaimed and made shows up in the findings
+	findings, err := db.GetFindings(FindingFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, finding := range findings {
+		found[finding.Url] = true
+	}
+	for _, url := range dead {
+		if !found[url] {
+			t.Errorf("request %v leased by the dead agent was never made", url)
+		}
+	}
+
+	// Every request was made by the live agents
+	made := 0
+	for _, agent := range agents {
+		requests := agent.Stats().Requests()
+		if requests == 0 {
+			t.Errorf("agent made no requests")
+		}
+		made += requests
+	}
+	if made < expected {
+		t.Errorf("expected the agents to make %v requests, they made %v", expected, made)
+	}
+}
+
+// Post a request to one of the coordinator's handlers as an agent
+func postToCoordinator(t *testing.T, handler http.HandlerFunc, body interface{}, reply interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	recorder := httptest.NewRecorder()
+	handler(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("coordinator replied %v: %v", recorder.Code, recorder.Body.String())
+	}
+	err = json.NewDecoder(recorder.Body).Decode(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// An agent reporting after its lease expired and the request was leased
+// to another agent has its result dropped, as does one reporting a
+// request never leased to it, leaving the other agent's lease in place
+func TestCoordinatorDropsStaleResults(t *testing.T) {
+	db := testDatabase(t)
+	defer db.CloseDatabaseConnection()
+	url := "http://localhost/admin"
+	err := db.AddRequests("http://localhost/", []string{url}, []int{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.db.Exec("UPDATE requests SET status = ?", Inflight)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestChan := make(chan *Request, 1)
+	responseChan := make(chan *Response, 2)
+	coordinator := &Coordinator{
+		ctx:          context.Background(),
+		requestCtx:   context.Background(),
+		db:           db,
+		requestChan:  requestChan,
+		responseChan: responseChan,
+		throttle:     NewThrottle(0),
+		stats:        NewStats(),
+		token:        testToken,
+		leaseTimeout: time.Minute,
+		mutex:        &sync.Mutex{},
+		leases:       make(map[string]*lease),
+		leased:       make(map[string]*lease),
+		agents:       make(map[string]bool),
+		logger:       Logger,
+	}
+
+	// The slow agent's lease expires and the request goes to the fast one
+	requestChan <- &Request{Url: url}
+	postToCoordinator(t, coordinator.handleLease, &LeaseRequest{"slow", 1}, &Lease{})
+	for _, l := range coordinator.leases {
+		l.expires = time.Now()
+	}
+	err = coordinator.reap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestChan <- &Request{Url: url}
+	postToCoordinator(t, coordinator.handleLease, &LeaseRequest{"fast", 1}, &Lease{})
+
+	postToCoordinator(t, coordinator.handleResults, &Results{"slow", []*Response{{Url: url, Success: true, Status: 200}}}, &Lease{})
+	postToCoordinator(t, coordinator.handleResults, &Results{"fast", []*Response{{Url: "http://localhost/other", Success: true, Status: 200}}}, &Lease{})
+	if len(responseChan) != 0 {
+		t.Fatalf("expected the stale results to be dropped, %v were passed on", len(responseChan))
+	}
+	if coordinator.Outstanding() != 1 {
+		t.Fatalf("expected the fast agent's lease to still be outstanding, %v requests are", coordinator.Outstanding())
+	}
+
+	postToCoordinator(t, coordinator.handleResults, &Results{"fast", []*Response{{Url: url, Success: true, Status: 404}}}, &Lease{})
+	if len(responseChan) != 1 || coordinator.Outstanding() != 0 {
+		t.Fatalf("expected the fast agent's result to be passed on, %v were and %v requests are outstanding", len(responseChan), coordinator.Outstanding())
+	}
+	response := <-responseChan
+	if response.Status != 404 {
+		t.Fatalf("expected the fast agent's result, got status %v", response.Status)
+	}
+}
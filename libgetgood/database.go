@@ -1,10 +1,17 @@
 package libgetgood
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
 type RequestStatus int
@@ -14,56 +21,523 @@ const (
 	Inflight    RequestStatus = 1
 	Failed      RequestStatus = 2
 	Processed   RequestStatus = 3
+	Skipped     RequestStatus = 4
+	OutOfScope  RequestStatus = 5
+	// A detector checked the response and the body didn't match
+	Unconfirmed RequestStatus = 6
 )
 
+type TargetProgress struct {
+	Target    string `json:"target"`
+	Completed int    `json:"completed"`
+	Total     int    `json:"total"`
+}
+
+// Session is one scan run in a database, each scan started by clearing
+// the database begins a new session
+type Session struct {
+	ID           int       `json:"id"`
+	URL          string    `json:"url"`
+	Started      time.Time `json:"started"`
+	Technologies []string  `json:"technologies"`
+}
+
+type FindingFilter struct {
+	Statuses []int
+	Prefix   string
+	Limit    int
+	Offset   int
+}
+
 type DBConn struct {
 	db    *sql.DB
 	mutex *sync.Mutex
 }
 
+// Number of attempts made at a write while the database is locked, for
+// example by another process reading the results
+const lockedAttempts = 5
+
+// Delay before the first retry of a locked write, doubled after each retry
+const lockedDelay = 100 * time.Millisecond
+
+// Run fn, retrying it while sqlite reports the database as locked
+func retryLocked(fn func() error) error {
+	delay := lockedDelay
+	err := fn()
+	for attempt := 1; attempt < lockedAttempts && isLocked(err); attempt++ {
+		time.Sleep(delay)
+		delay *= 2
+		err = fn()
+	}
+	return err
+}
+
+func isLocked(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// Execute a statement, retrying while the database is locked
+func (conn *DBConn) exec(query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := retryLocked(func() error {
+		var err error
+		res, err = conn.db.Exec(query, args...)
+		return err
+	})
+	return res, err
+}
+
+// Execute a statement once for each set of arguments in a single
+// transaction, retrying the transaction while the database is locked
+func (conn *DBConn) execBatch(query string, args [][]interface{}) error {
+	return retryLocked(func() error {
+		tx, err := conn.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		stmt, err := tx.Prepare(query)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		defer stmt.Close()
+
+		for _, a := range args {
+			_, err = stmt.Exec(a...)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		return tx.Commit()
+	})
+}
+
+// Tables created by CreateSchema
+var schemaTables = []string{"requests", "config", "sessions", "history", "words", "hosts", "directories"}
+
+// Columns added to tables since they were first created
+var migratedColumns = map[string]map[string]string{
+	"requests": {
+		"parent":     "TEXT",
+		"size":       "INTEGER",
+		"bodyHash":   "TEXT",
+		"updated":    "INTEGER",
+		"priority":   "INTEGER NOT NULL DEFAULT 0",
+		"redirects":  "TEXT",
+		"discovered": "INTEGER NOT NULL DEFAULT 0",
+		"source":     "TEXT",
+		"detected":   "TEXT",
+		"simhash":    "TEXT",
+	},
+	"history": {
+		"redirects": "TEXT",
+		"source":    "TEXT",
+		"detected":  "TEXT",
+		"simhash":   "TEXT",
+	},
+	"sessions": {
+		"technologies": "TEXT",
+	},
+	"config": {
+		"wordlistHash": "TEXT",
+		"pruned":       "INTEGER NOT NULL DEFAULT 0",
+	},
+}
+
 func (conn *DBConn) CreateSchema() error {
 	conn.mutex.Lock()
 	defer conn.mutex.Unlock()
-	_, err := conn.db.Exec("CREATE TABLE IF NOT EXISTS requests (id INTEGER PRIMARY KEY ASC, status INTEGER, uri TEXT, httpStatus INTEGER, UNIQUE(uri))")
-	return err
+	_, err := conn.db.Exec("CREATE TABLE IF NOT EXISTS requests (id INTEGER PRIMARY KEY ASC, status INTEGER, uri TEXT, httpStatus INTEGER, parent TEXT, UNIQUE(uri))")
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.db.Exec("CREATE TABLE IF NOT EXISTS config (id INTEGER PRIMARY KEY, options TEXT)")
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.db.Exec("CREATE TABLE IF NOT EXISTS sessions (id INTEGER PRIMARY KEY ASC, url TEXT, started INTEGER)")
+	if err != nil {
+		return err
+	}
+
+	// Findings of earlier sessions, the current session's are in requests
+	_, err = conn.db.Exec("CREATE TABLE IF NOT EXISTS history (session INTEGER, uri TEXT, httpStatus INTEGER, size INTEGER, bodyHash TEXT, PRIMARY KEY (session, uri))")
+	if err != nil {
+		return err
+	}
+
+	// Words found by the spider, added to the wordlist of the scan
+	_, err = conn.db.Exec("CREATE TABLE IF NOT EXISTS words (word TEXT PRIMARY KEY)")
+	if err != nil {
+		return err
+	}
+
+	// Hosts checked for case insensitivity, by scheme and host
+	_, err = conn.db.Exec("CREATE TABLE IF NOT EXISTS hosts (origin TEXT PRIMARY KEY, caseInsensitive INTEGER)")
+	if err != nil {
+		return err
+	}
+
+	// Databases created by older versions may be missing columns
+	for _, table := range []string{"requests", "history", "sessions"} {
+		err = conn.addMissingColumns(table, migratedColumns[table])
+		if err != nil {
+			return err
+		}
+	}
+
+	// Directories which have had the wordlist added beneath them, kept
+	// when requests are pruned. Older databases only have the parents of
+	// their requests to go on
+	created, err := conn.createTable("directories", "CREATE TABLE directories (uri TEXT PRIMARY KEY)")
+	if err != nil {
+		return err
+	}
+	if created {
+		_, err = conn.db.Exec("INSERT OR IGNORE INTO directories (uri) SELECT parent FROM requests WHERE parent IS NOT NULL AND discovered = 0 GROUP BY parent ORDER BY MIN(id)")
+		if err != nil {
+			return err
+		}
+	}
+
+	// The poller takes the highest priority unprocessed requests
+	_, err = conn.db.Exec("CREATE INDEX IF NOT EXISTS requests_queue ON requests (status, priority DESC, id)")
+	if err != nil {
+		return err
+	}
+
+	// Requests on case insensitive hosts are matched regardless of case
+	_, err = conn.db.Exec("CREATE INDEX IF NOT EXISTS requests_folded ON requests (lower(uri))")
+	if err != nil {
+		return err
+	}
+
+	// Progress is counted for each directory requests are added beneath
+	_, err = conn.db.Exec("CREATE INDEX IF NOT EXISTS requests_parent ON requests (parent, status)")
+	if err != nil {
+		return err
+	}
+
+	return conn.addMissingColumns("config", migratedColumns["config"])
+}
+
+// Create a table if it doesn't exist yet, returning whether it was created
+func (conn *DBConn) createTable(table string, query string) (bool, error) {
+	var count int
+	err := conn.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	if err != nil || count > 0 {
+		return false, err
+	}
+	_, err = conn.db.Exec(query)
+	return err == nil, err
+}
+
+func (conn *DBConn) addMissingColumns(table string, columns map[string]string) error {
+	existing, err := conn.tableColumns(table)
+	if err != nil {
+		return err
+	}
+
+	for name, columnType := range columns {
+		if existing[name] {
+			continue
+		}
+		_, err = conn.db.Exec("ALTER TABLE " + table + " ADD COLUMN " + name + " " + columnType)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckSchema returns an error naming a table or column CreateSchema
+// would add, for databases which are read without being changed
+func (conn *DBConn) CheckSchema() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	for _, table := range schemaTables {
+		existing, err := conn.tableColumns(table)
+		if err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			return fmt.Errorf("missing the %v table", table)
+		}
+
+		missing := make([]string, 0)
+		for name := range migratedColumns[table] {
+			if !existing[name] {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			return fmt.Errorf("missing the %v columns of the %v table", strings.Join(missing, ", "), table)
+		}
+	}
+
+	return nil
+}
+
+// Return the names of a table's columns, empty if there is no such table
+func (conn *DBConn) tableColumns(table string) (map[string]bool, error) {
+	rows, err := conn.db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue interface{}
+		err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk)
+		if err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+
+	return columns, rows.Err()
 }
 
+// Clear removes every request and word found by the spider, first
+// keeping the findings of the current session in the history so they
+// can still be diffed
 func (conn *DBConn) Clear() error {
 	conn.mutex.Lock()
 	defer conn.mutex.Unlock()
-	_, err := conn.db.Exec("DELETE FROM requests")
+
+	session, err := conn.currentSession()
+	if err != nil {
+		return err
+	}
+	if session != 0 {
+		_, err = conn.exec("INSERT OR REPLACE INTO history (session, uri, httpStatus, size, bodyHash, redirects, source, detected, simhash) SELECT ?, uri, httpStatus, size, bodyHash, redirects, source, detected, simhash FROM requests WHERE status = ? AND httpStatus != 404", session, Processed)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = conn.exec("DELETE FROM requests")
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.exec("DELETE FROM words")
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.exec("DELETE FROM hosts")
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.exec("DELETE FROM directories")
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.exec("UPDATE config SET pruned = 0")
 	return err
 }
 
-func (conn *DBConn) AddRequests(requests []string) error {
+// StartSession records the start of a new session, returning its id
+func (conn *DBConn) StartSession(url string) (int, error) {
 	conn.mutex.Lock()
 	defer conn.mutex.Unlock()
 
-	insertURI, err := conn.db.Prepare("INSERT OR IGNORE INTO requests (status, uri) VALUES (?, ?)")
+	res, err := conn.exec("INSERT INTO sessions (url, started) VALUES (?, ?)", url, time.Now().Unix())
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	tx, err := conn.db.Begin()
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// SetSessionTechnologies records what the target of the current session
+// was found to run
+func (conn *DBConn) SetSessionTechnologies(technologies []string) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	session, err := conn.currentSession()
 	if err != nil {
 		return err
 	}
+	_, err = conn.exec("UPDATE sessions SET technologies = ? WHERE id = ?", strings.Join(technologies, ","), session)
+	return err
+}
+
+// GetSessions returns every session, oldest first
+func (conn *DBConn) GetSessions() ([]*Session, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	rows, err := conn.db.Query("SELECT id, url, started, COALESCE(technologies, '') FROM sessions ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
 
-	for _, request := range requests {
-		_, err := tx.Stmt(insertURI).Exec(Unprocessed, request)
+	sessions := make([]*Session, 0)
+
+	defer rows.Close()
+	for rows.Next() {
+		session := &Session{}
+		var started int64
+		var technologies string
+		err = rows.Scan(&session.ID, &session.URL, &started, &technologies)
+		if err != nil {
+			return nil, err
+		}
+		session.Started = time.Unix(started, 0)
+		session.Technologies = make([]string, 0)
+		if technologies != "" {
+			session.Technologies = strings.Split(technologies, ",")
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// The id of the most recent session, or 0 if there are none
+func (conn *DBConn) currentSession() (int, error) {
+	var session int
+	err := conn.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM sessions").Scan(&session)
+	return session, err
+}
+
+// GetSessionFindings returns the findings of a session, anything other
+// than a 404, ordered by url
+func (conn *DBConn) GetSessionFindings(session int) ([]*Finding, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	current, err := conn.currentSession()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows *sql.Rows
+	if session == current {
+		rows, err = conn.db.Query("SELECT uri, httpStatus, COALESCE(size, 0), COALESCE(bodyHash, ''), COALESCE(redirects, ''), COALESCE(source, ''), COALESCE(detected, ''), COALESCE(simhash, '') FROM requests WHERE status = ? AND httpStatus != 404 ORDER BY uri", Processed)
+	} else {
+		rows, err = conn.db.Query("SELECT uri, httpStatus, COALESCE(size, 0), COALESCE(bodyHash, ''), COALESCE(redirects, ''), COALESCE(source, ''), COALESCE(detected, ''), COALESCE(simhash, '') FROM history WHERE session = ? ORDER BY uri", session)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	findings := make([]*Finding, 0)
+
+	defer rows.Close()
+	for rows.Next() {
+		finding := &Finding{}
+		var redirects string
+		err = rows.Scan(&finding.Url, &finding.Status, &finding.Size, &finding.BodyHash, &redirects, &finding.Source, &finding.Detected, &finding.Simhash)
+		if err != nil {
+			return nil, err
+		}
+		finding.Redirects, err = decodeRedirects(redirects)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, finding)
+	}
+
+	return findings, nil
+}
+
+// AddRequests adds requests beneath the parent, priorities holds the
+// priority of each request
+func (conn *DBConn) AddRequests(parent string, requests []string, priorities []int) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	args := make([][]interface{}, 0, len(requests))
+	for i, request := range requests {
+		args = append(args, []interface{}{Unprocessed, request, parent, priorities[i], urlOrigin(request), request})
+	}
+	return conn.execBatch("INSERT OR IGNORE INTO requests (status, uri, parent, priority) SELECT ?, ?, ?, ? WHERE NOT EXISTS ("+caseVariantQuery+")", args)
+}
+
+// Finds a request differing only by case from the one being added, when
+// its host is known to ignore case
+const caseVariantQuery = "SELECT 1 FROM hosts, requests WHERE hosts.origin = ? AND hosts.caseInsensitive = 1 AND lower(requests.uri) = lower(?)"
+
+// AddWords stores words found by the spider
+func (conn *DBConn) AddWords(words []string) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	args := make([][]interface{}, 0, len(words))
+	for _, word := range words {
+		args = append(args, []interface{}{word})
+	}
+	return conn.execBatch("INSERT OR IGNORE INTO words (word) VALUES (?)", args)
+}
+
+// AddDiscoveredRequests adds requests for paths found by the spider or
+// seeded beneath the parent, recording the url they were found in as
+// their source. This doesn't make the parent a directory that has been
+// expanded
+func (conn *DBConn) AddDiscoveredRequests(parent string, requests []string, priorities []int, source string) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	args := make([][]interface{}, 0, len(requests))
+	for i, request := range requests {
+		args = append(args, []interface{}{Unprocessed, request, parent, priorities[i], source, urlOrigin(request), request})
+	}
+	return conn.execBatch("INSERT OR IGNORE INTO requests (status, uri, parent, priority, discovered, source) SELECT ?, ?, ?, ?, 1, NULLIF(?, '') WHERE NOT EXISTS ("+caseVariantQuery+")", args)
+}
+
+// GetWords returns the words found by the spider in the order found
+func (conn *DBConn) GetWords() ([]string, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	rows, err := conn.db.Query("SELECT word FROM words ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+
+	words := make([]string, 0)
+
+	defer rows.Close()
+	for rows.Next() {
+		var word string
+		err = rows.Scan(&word)
 		if err != nil {
-			return tx.Rollback()
+			return nil, err
 		}
+		words = append(words, word)
 	}
 
-	return tx.Commit()
+	return words, nil
 }
 
 func (conn *DBConn) GetIncompleteRequests(batchSize int) ([]string, error) {
 	conn.mutex.Lock()
 	defer conn.mutex.Unlock()
 
-	rows, err := conn.db.Query("SELECT uri FROM requests WHERE status = ? LIMIT ?", Unprocessed, batchSize)
+	rows, err := conn.db.Query("SELECT uri FROM requests WHERE status = ? ORDER BY priority DESC, id LIMIT ?", Unprocessed, batchSize)
 	if err != nil {
 		return nil, err
 	}
@@ -135,62 +609,674 @@ func (conn *DBConn) GetFailedRequestCount() (int, error) {
 	return failed, nil
 }
 
-func (conn *DBConn) SetRequestsInflight(requests []string) error {
+func (conn *DBConn) GetSkippedRequestCount() (int, error) {
 	conn.mutex.Lock()
 	defer conn.mutex.Unlock()
 
-	updateURI, err := conn.db.Prepare("UPDATE requests SET status = ? WHERE uri = ?")
-	if err != nil {
-		return err
-	}
-
-	tx, err := conn.db.Begin()
+	var skipped int
+	err := conn.db.QueryRow("SELECT COUNT(*) FROM requests WHERE status == ?", Skipped).Scan(&skipped)
 	if err != nil {
-		return err
-	}
-
-	for _, request := range requests {
-		_, err := tx.Stmt(updateURI).Exec(Inflight, request)
-		if err != nil {
-			return tx.Rollback()
-		}
+		return 0, err
 	}
 
-	return tx.Commit()
+	return skipped, nil
 }
 
-func (conn *DBConn) SetRequestFailed(uri string) error {
+func (conn *DBConn) GetUnconfirmedRequestCount() (int, error) {
 	conn.mutex.Lock()
 	defer conn.mutex.Unlock()
 
-	_, err := conn.db.Exec("UPDATE requests SET status = ? WHERE uri = ?", Failed, uri)
-	return err
+	var unconfirmed int
+	err := conn.db.QueryRow("SELECT COUNT(*) FROM requests WHERE status == ?", Unconfirmed).Scan(&unconfirmed)
+	if err != nil {
+		return 0, err
+	}
+
+	return unconfirmed, nil
 }
 
-func (conn *DBConn) SetRequestCompleted(uri string, httpStatus int) error {
+func (conn *DBConn) GetOutOfScopeRequestCount() (int, error) {
 	conn.mutex.Lock()
 	defer conn.mutex.Unlock()
 
-	_, err := conn.db.Exec("UPDATE requests SET status = ?, httpStatus = ? WHERE uri = ?", Processed, httpStatus, uri)
-	return err
+	var outOfScope int
+	err := conn.db.QueryRow("SELECT COUNT(*) FROM requests WHERE status == ?", OutOfScope).Scan(&outOfScope)
+	if err != nil {
+		return 0, err
+	}
+
+	return outOfScope, nil
 }
 
-func (conn *DBConn) ResetInflightRequests() error {
+// GetStatusCounts returns the number of processed requests for each
+// http status
+func (conn *DBConn) GetStatusCounts() (map[int]int, error) {
 	conn.mutex.Lock()
 	defer conn.mutex.Unlock()
 
-	_, err := conn.db.Exec("UPDATE requests SET status = ? WHERE status = ?", Unprocessed, Inflight)
-	return err
-}
-
-func (conn *DBConn) ResetFailedRequests() error {
+	rows, err := conn.db.Query("SELECT httpStatus, COUNT(*) FROM requests WHERE status = ? GROUP BY httpStatus", Processed)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[int]int)
+
+	defer rows.Close()
+	for rows.Next() {
+		var status, count int
+		err = rows.Scan(&status, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+
+	return counts, nil
+}
+
+// AddDirectory records that a directory has had the wordlist added
+// beneath it
+func (conn *DBConn) AddDirectory(uri string) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	_, err := conn.exec("INSERT OR IGNORE INTO directories (uri) VALUES (?)", uri)
+	return err
+}
+
+// GetDirectories returns every directory which has had the wordlist
+// added beneath it in the order they were expanded, leaving out any
+// with skipped requests
+func (conn *DBConn) GetDirectories() ([]string, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	rows, err := conn.db.Query("SELECT uri FROM directories WHERE NOT EXISTS (SELECT 1 FROM requests WHERE parent = directories.uri AND status = ?) ORDER BY rowid", Skipped)
+	if err != nil {
+		return nil, err
+	}
+
+	directories := make([]string, 0)
+
+	defer rows.Close()
+	for rows.Next() {
+		var directory string
+		err = rows.Scan(&directory)
+		if err != nil {
+			return nil, err
+		}
+		directories = append(directories, directory)
+	}
+
+	return directories, nil
+}
+
+// GetTargetProgress returns the progress of the directories holding the
+// next requests to be made, at most limit of them in the order they'll
+// be requested. Only as much of the queue is read as it takes to find
+// them, so this stays cheap however many directories have been found
+func (conn *DBConn) GetTargetProgress(limit int) ([]*TargetProgress, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	rows, err := conn.db.Query("SELECT DISTINCT parent FROM requests WHERE status = ? AND parent IS NOT NULL ORDER BY priority DESC, id LIMIT ?", Unprocessed, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	parents := make([]string, 0, limit)
+	for rows.Next() {
+		var parent string
+		err = rows.Scan(&parent)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		parents = append(parents, parent)
+	}
+	rows.Close()
+
+	progress := make([]*TargetProgress, 0, len(parents))
+	for _, parent := range parents {
+		target := &TargetProgress{Target: parent}
+		err = conn.db.QueryRow("SELECT SUM(CASE WHEN status = ? THEN 1 ELSE 0 END), COUNT(*) FROM requests WHERE parent = ?", Processed, parent).Scan(&target.Completed, &target.Total)
+		if err != nil {
+			return nil, err
+		}
+		progress = append(progress, target)
+	}
+
+	return progress, nil
+}
+
+// GetTargetCount returns the number of directories requests have been
+// added beneath
+func (conn *DBConn) GetTargetCount() (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	var count int
+	err := conn.db.QueryRow("SELECT COUNT(DISTINCT parent) FROM requests").Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// GetFindings returns processed requests matching the filter, if no
+// statuses are given anything other than a 404 is returned
+func (conn *DBConn) GetFindings(filter FindingFilter) ([]*Finding, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	query := "SELECT uri, httpStatus, COALESCE(size, 0), COALESCE(bodyHash, ''), COALESCE(redirects, ''), COALESCE(source, ''), COALESCE(detected, ''), COALESCE(simhash, '') FROM requests WHERE status = ?"
+	args := []interface{}{Processed}
+	if len(filter.Statuses) == 0 {
+		query += " AND httpStatus != 404"
+	} else {
+		placeholders := make([]string, 0, len(filter.Statuses))
+		for _, status := range filter.Statuses {
+			placeholders = append(placeholders, "?")
+			args = append(args, status)
+		}
+		query += " AND httpStatus IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+	if filter.Prefix != "" {
+		query += " AND substr(uri, 1, ?) = ?"
+		args = append(args, len(filter.Prefix), filter.Prefix)
+	}
+	query += " ORDER BY id"
+	if filter.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, filter.Limit, filter.Offset)
+	}
+
+	rows, err := conn.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	findings := make([]*Finding, 0)
+
+	defer rows.Close()
+	for rows.Next() {
+		finding := &Finding{}
+		var redirects string
+		err = rows.Scan(&finding.Url, &finding.Status, &finding.Size, &finding.BodyHash, &redirects, &finding.Source, &finding.Detected, &finding.Simhash)
+		if err != nil {
+			return nil, err
+		}
+		finding.Redirects, err = decodeRedirects(redirects)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, finding)
+	}
+
+	return findings, nil
+}
+
+func (conn *DBConn) SetRequestsInflight(requests []string) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	args := make([][]interface{}, 0, len(requests))
+	for _, request := range requests {
+		args = append(args, []interface{}{Inflight, request})
+	}
+	return conn.execBatch("UPDATE requests SET status = ? WHERE uri = ?", args)
+}
+
+func (conn *DBConn) SetRequestFailed(uri string) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	_, err := conn.exec("UPDATE requests SET status = ?, updated = ? WHERE uri = ?", Failed, time.Now().Unix(), uri)
+	return err
+}
+
+// SetRequestCompleted records the response to a request along with
+// any redirects followed to reach it, the detector that recognised an
+// exposed file in it, if any, and the similarity hash of its body
+func (conn *DBConn) SetRequestCompleted(uri string, httpStatus int, size int64, bodyHash string, redirects []Redirect, detected string, simhash string) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	chain, err := encodeRedirects(redirects)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.exec("UPDATE requests SET status = ?, httpStatus = ?, size = ?, bodyHash = ?, redirects = ?, detected = NULLIF(?, ''), simhash = NULLIF(?, ''), updated = ? WHERE uri = ?", Processed, httpStatus, size, bodyHash, chain, detected, simhash, time.Now().Unix(), uri)
+	return err
+}
+
+// SetRequestUnconfirmed records the response to a request for a file a
+// detector checks whose body didn't match, it isn't a finding
+func (conn *DBConn) SetRequestUnconfirmed(uri string, httpStatus int, size int64, bodyHash string, redirects []Redirect) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	chain, err := encodeRedirects(redirects)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.exec("UPDATE requests SET status = ?, httpStatus = ?, size = ?, bodyHash = ?, redirects = ?, updated = ? WHERE uri = ?", Unconfirmed, httpStatus, size, bodyHash, chain, time.Now().Unix(), uri)
+	return err
+}
+
+// SetRequestOutOfScope records a request the http workers refused to make
+func (conn *DBConn) SetRequestOutOfScope(uri string) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	_, err := conn.exec("UPDATE requests SET status = ?, updated = ? WHERE uri = ?", OutOfScope, time.Now().Unix(), uri)
+	return err
+}
+
+// SkipRequests marks any unprocessed requests beneath the given
+// url as skipped so they will not be picked up by the poller
+func (conn *DBConn) SkipRequests(baseURL string) (int64, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	res, err := conn.exec("UPDATE requests SET status = ?, updated = ? WHERE status = ? AND substr(uri, 1, ?) = ?", Skipped, time.Now().Unix(), Unprocessed, len(baseURL), baseURL)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// BoostRequests raises the priority of the unprocessed requests in the
+// same directory as the given request
+func (conn *DBConn) BoostRequests(uri string, priority int) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	_, err := conn.exec("UPDATE requests SET priority = priority + ? WHERE status = ? AND parent = (SELECT parent FROM requests WHERE uri = ?)", priority, Unprocessed, uri)
+	return err
+}
+
+// GetUnprocessedWordlistRequests returns the parent of every unprocessed
+// request added from the wordlist keyed by its url, leaving out those
+// found by the spider, seeded or listed
+func (conn *DBConn) GetUnprocessedWordlistRequests() (map[string]string, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	rows, err := conn.db.Query("SELECT uri, COALESCE(parent, '') FROM requests WHERE status = ? AND discovered = 0", Unprocessed)
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make(map[string]string)
+
+	defer rows.Close()
+	for rows.Next() {
+		var uri, parent string
+		err = rows.Scan(&uri, &parent)
+		if err != nil {
+			return nil, err
+		}
+		requests[uri] = parent
+	}
+
+	return requests, nil
+}
+
+// SetRequestPriorities sets the priority of each request keyed by its url
+func (conn *DBConn) SetRequestPriorities(priorities map[string]int) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	args := make([][]interface{}, 0, len(priorities))
+	for uri, priority := range priorities {
+		args = append(args, []interface{}{priority, uri})
+	}
+	return conn.execBatch("UPDATE requests SET priority = ? WHERE uri = ?", args)
+}
+
+// ResetRequests returns the given requests to unprocessed so they are
+// picked up by the poller again
+func (conn *DBConn) ResetRequests(requests []string) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	args := make([][]interface{}, 0, len(requests))
+	for _, request := range requests {
+		args = append(args, []interface{}{Unprocessed, request, Inflight})
+	}
+	return conn.execBatch("UPDATE requests SET status = ? WHERE uri = ? AND status = ?", args)
+}
+
+func (conn *DBConn) ResetInflightRequests() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	_, err := conn.exec("UPDATE requests SET status = ? WHERE status = ?", Unprocessed, Inflight)
+	return err
+}
+
+func (conn *DBConn) ResetFailedRequests() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	_, err := conn.exec("UPDATE requests SET status = ? WHERE status = ?", Unprocessed, Failed)
+	return err
+}
+
+// ResetOutOfScopeRequests gives requests refused by an earlier run
+// another chance, in case the scope has since changed
+func (conn *DBConn) ResetOutOfScopeRequests() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	_, err := conn.exec("UPDATE requests SET status = ? WHERE status = ?", Unprocessed, OutOfScope)
+	return err
+}
+
+// PruneRequests deletes processed requests which returned a 404,
+// returning the number of requests deleted. The database is marked as
+// pruned, as expanding a directory again would add them back
+func (conn *DBConn) PruneRequests() (int64, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	res, err := conn.exec("DELETE FROM requests WHERE status = ? AND httpStatus = 404", Processed)
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := res.RowsAffected()
+	if err != nil || pruned == 0 {
+		return pruned, err
+	}
+
+	_, err = conn.exec("INSERT INTO config (id, pruned) VALUES (1, 1) ON CONFLICT (id) DO UPDATE SET pruned = 1")
+	return pruned, err
+}
+
+// IsPruned returns whether requests have been deleted by PruneRequests
+func (conn *DBConn) IsPruned() (bool, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	var pruned bool
+	err := conn.db.QueryRow("SELECT pruned FROM config WHERE id = 1").Scan(&pruned)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return pruned, err
+}
+
+// SetHostCase records whether a host ignores case
+func (conn *DBConn) SetHostCase(origin string, insensitive bool) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	_, err := conn.exec("INSERT OR REPLACE INTO hosts (origin, caseInsensitive) VALUES (?, ?)", origin, insensitive)
+	return err
+}
+
+// GetCheckedHosts returns the origins of every host checked for case
+// insensitivity and whether it ignores case
+func (conn *DBConn) GetCheckedHosts() (map[string]bool, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	rows, err := conn.db.Query("SELECT origin, caseInsensitive FROM hosts")
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make(map[string]bool)
+
+	defer rows.Close()
+	for rows.Next() {
+		var origin string
+		var insensitive bool
+		err = rows.Scan(&origin, &insensitive)
+		if err != nil {
+			return nil, err
+		}
+		hosts[origin] = insensitive
+	}
+
+	return hosts, nil
+}
+
+// Matches another request differing only by case which has completed, or
+// is still to be made and was added first. Failed, skipped and out of
+// scope requests were never made so don't count
+const caseVariantOf = "lower(other.uri) = lower(requests.uri) AND other.id != requests.id AND (other.status IN (?, ?) OR (other.status IN (?, ?) AND other.id < requests.id))"
+
+// PruneCaseVariants deletes unprocessed requests on a host which differ
+// only by case from another request, keeping whichever completed or
+// otherwise was added first. Returns the number of requests deleted
+func (conn *DBConn) PruneCaseVariants(origin string) (int64, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	prefix := strings.ToLower(origin + "/")
+	res, err := conn.exec("DELETE FROM requests WHERE status = ? AND lower(substr(uri, 1, ?)) = ? AND EXISTS (SELECT 1 FROM requests other WHERE "+caseVariantOf+")", Unprocessed, len(prefix), prefix, Processed, Unconfirmed, Unprocessed, Inflight)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// IsCaseVariant returns whether a queued request differs only by case
+// from another which has completed or was added before it, the same
+// requests PruneCaseVariants would have deleted had they not been queued
+func (conn *DBConn) IsCaseVariant(uri string) (bool, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	var variant bool
+	err := conn.db.QueryRow("SELECT EXISTS (SELECT 1 FROM requests, requests other WHERE requests.uri = ? AND "+caseVariantOf+")", uri, Processed, Unconfirmed, Unprocessed, Inflight).Scan(&variant)
+	if err != nil {
+		return false, err
+	}
+
+	return variant, nil
+}
+
+// DeleteRequest removes a request which is no longer to be made
+func (conn *DBConn) DeleteRequest(uri string) error {
 	conn.mutex.Lock()
 	defer conn.mutex.Unlock()
 
-	_, err := conn.db.Exec("UPDATE requests SET status = ? WHERE status = ?", Unprocessed, Failed)
+	_, err := conn.exec("DELETE FROM requests WHERE uri = ?", uri)
 	return err
 }
 
+// Vacuum rebuilds the database file, releasing the space left by
+// deleted requests
+func (conn *DBConn) Vacuum() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	_, err := conn.exec("VACUUM")
+	return err
+}
+
+// Merge adds the requests, words, checked hosts and earlier sessions
+// from another database, returning the number of requests merged.
+// Where both hold the same request a processed one is kept over any
+// other status, otherwise the most recently updated is kept. Requests
+// left inflight in the other database are added as unprocessed. The
+// other database's current session isn't added as its findings are the
+// requests, the session for the merged requests is started afterwards
+// so it's numbered after the sessions merged
+func (conn *DBConn) Merge(filename string) (int64, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	// Attached databases belong to a single connection, so hold on to
+	// one rather than letting the pool pick
+	ctx := context.Background()
+	c, err := conn.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	_, err = c.ExecContext(ctx, "ATTACH DATABASE ? AS other", filename)
+	if err != nil {
+		return 0, err
+	}
+	defer c.ExecContext(ctx, "DETACH DATABASE other")
+
+	res, err := c.ExecContext(ctx, `INSERT INTO requests (status, uri, httpStatus, parent, size, bodyHash, redirects, updated, priority, discovered, source, detected, simhash)
+		SELECT CASE WHEN status = ? THEN ? ELSE status END, uri, httpStatus, parent, size, bodyHash, redirects, updated, priority, discovered, source, detected, simhash FROM other.requests WHERE true
+		ON CONFLICT (uri) DO UPDATE SET status = excluded.status, httpStatus = excluded.httpStatus, size = excluded.size, bodyHash = excluded.bodyHash, redirects = excluded.redirects, detected = excluded.detected, simhash = excluded.simhash, updated = excluded.updated, parent = COALESCE(requests.parent, excluded.parent)
+		WHERE (excluded.status = ? AND requests.status != ?)
+		OR ((excluded.status = ?) = (requests.status = ?) AND COALESCE(excluded.updated, 0) > COALESCE(requests.updated, 0))`,
+		Inflight, Unprocessed, Processed, Processed, Processed, Processed)
+	if err != nil {
+		return 0, err
+	}
+	merged, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = c.ExecContext(ctx, "INSERT OR IGNORE INTO words (word) SELECT word FROM other.words ORDER BY rowid")
+	if err != nil {
+		return 0, err
+	}
+
+	// A host is only checked once, the first database to have checked
+	// it decides whether it ignores case
+	_, err = c.ExecContext(ctx, "INSERT OR IGNORE INTO hosts (origin, caseInsensitive) SELECT origin, caseInsensitive FROM other.hosts")
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = c.ExecContext(ctx, "INSERT OR IGNORE INTO directories (uri) SELECT uri FROM other.directories ORDER BY rowid")
+	if err != nil {
+		return 0, err
+	}
+
+	// Requests pruned from the other database are missing from the
+	// merged one too
+	_, err = c.ExecContext(ctx, "INSERT INTO config (id, pruned) SELECT 1, 1 FROM other.config WHERE pruned = 1 ON CONFLICT (id) DO UPDATE SET pruned = 1")
+	if err != nil {
+		return 0, err
+	}
+
+	err = mergeSessions(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	return merged, nil
+}
+
+// Add the earlier sessions of the attached database and their history,
+// renumbered after the sessions already held
+func mergeSessions(ctx context.Context, c *sql.Conn) error {
+	rows, err := c.QueryContext(ctx, "SELECT id, url, started, COALESCE(technologies, '') FROM other.sessions WHERE id < (SELECT MAX(id) FROM other.sessions) ORDER BY id")
+	if err != nil {
+		return err
+	}
+	sessions := make([]*Session, 0)
+	for rows.Next() {
+		session := &Session{}
+		var started int64
+		var technologies string
+		err = rows.Scan(&session.ID, &session.URL, &started, &technologies)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		session.Started = time.Unix(started, 0)
+		session.Technologies = strings.Split(technologies, ",")
+		sessions = append(sessions, session)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		res, err := c.ExecContext(ctx, "INSERT INTO sessions (url, started, technologies) VALUES (?, ?, ?)", session.URL, session.Started.Unix(), strings.Join(session.Technologies, ","))
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		_, err = c.ExecContext(ctx, "INSERT OR REPLACE INTO history (session, uri, httpStatus, size, bodyHash, redirects, source, detected, simhash) SELECT ?, uri, httpStatus, size, bodyHash, redirects, source, detected, simhash FROM other.history WHERE session = ?", id, session.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveOptions stores the options a scan was run with and a hash of its
+// wordlist, so it can be resumed with exactly the same settings
+func (conn *DBConn) SaveOptions(options *Options, wordlistHash string) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	data, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.exec("INSERT INTO config (id, options, wordlistHash) VALUES (1, ?, ?) ON CONFLICT (id) DO UPDATE SET options = excluded.options, wordlistHash = excluded.wordlistHash", string(data), wordlistHash)
+	return err
+}
+
+// LoadOptions returns the options last stored with SaveOptions, or nil
+// if none have been stored
+func (conn *DBConn) LoadOptions() (*Options, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	var data string
+	err := conn.db.QueryRow("SELECT options FROM config WHERE id = 1").Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	options := &Options{}
+	err = json.Unmarshal([]byte(data), options)
+	if err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// LoadWordlistHash returns the wordlist hash last stored with
+// SaveOptions, or an empty string if none has been stored
+func (conn *DBConn) LoadWordlistHash() (string, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	var hash sql.NullString
+	err := conn.db.QueryRow("SELECT wordlistHash FROM config WHERE id = 1").Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash.String, err
+}
+
+// OpenReadOnlyDatabase opens a database which can be read but never
+// written, so reading it leaves the file exactly as it was
+func OpenReadOnlyDatabase(filename string) (*DBConn, error) {
+	escaped := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(filename)
+	return OpenDatabaseConnection("file:" + escaped + "?mode=ro")
+}
+
 func OpenDatabaseConnection(filename string) (*DBConn, error) {
 	db, err := sql.Open("sqlite3", filename)
 	mutex := &sync.Mutex{}
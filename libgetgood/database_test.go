@@ -0,0 +1,249 @@
+package libgetgood
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testDatabase(t *testing.T) *DBConn {
+	db, err := OpenDatabaseConnection(filepath.Join(t.TempDir(), "bust.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Only the directories of the next requests to be made are reported,
+// in the order they'll be requested
+func TestGetTargetProgress(t *testing.T) {
+	db := testDatabase(t)
+	defer db.CloseDatabaseConnection()
+
+	root := "http://localhost/"
+	directories := map[string]int{root: 0, root + "a/": -1000, root + "b/": -2000, root + "done/": 10}
+	for directory, priority := range directories {
+		err := db.AddRequests(directory, []string{directory + "x", directory + "y"}, []int{priority, priority})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := db.SetRequestsInflight([]string{root + "x", root + "done/x", root + "done/y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uri := range []string{root + "x", root + "done/x", root + "done/y"} {
+		err = db.SetRequestCompleted(uri, 404, 0, "", nil, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	targets, err := db.GetTargetProgress(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*TargetProgress{{root, 1, 2}, {root + "a/", 0, 2}}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected %+v, got %+v", expected, targets)
+	}
+
+	count, err := db.GetTargetCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(directories) {
+		t.Errorf("expected %v directories, got %v", len(directories), count)
+	}
+}
+
+// Merging brings across the words, checked hosts and earlier sessions
+// with their findings as well as the requests
+func TestMerge(t *testing.T) {
+	root := "http://localhost/"
+	filename := filepath.Join(t.TempDir(), "other.db")
+	other, err := OpenDatabaseConnection(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.CloseDatabaseConnection()
+	err = other.CreateSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An earlier session which found admin, then the current one
+	_, err = other.StartSession(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.AddRequests(root, []string{root + "admin"}, []int{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.SetRequestCompleted(root+"admin", 200, 10, "hash", nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Clear()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.StartSession(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.AddRequests(root, []string{root + "login"}, []int{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.AddWords([]string{"spidered"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.SetHostCase("http://localhost", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := testDatabase(t)
+	defer db.CloseDatabaseConnection()
+	merged, err := db.Merge(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged != 1 {
+		t.Errorf("expected 1 request merged, got %v", merged)
+	}
+	_, err = db.StartSession(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	words, err := db.GetWords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(words, []string{"spidered"}) {
+		t.Errorf("expected the spidered words to be merged, got %q", words)
+	}
+	hosts, err := db.GetCheckedHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hosts, map[string]bool{"http://localhost": true}) {
+		t.Errorf("expected the checked host to be merged, got %v", hosts)
+	}
+
+	// Only the earlier session is added, its findings renumbered with it
+	sessions, err := db.GetSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected the earlier session to be merged, got %v sessions", len(sessions))
+	}
+	findings, err := db.GetSessionFindings(sessions[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 1 || findings[0].Url != root+"admin" {
+		t.Errorf("expected the earlier session's finding to be merged, got %+v", findings)
+	}
+}
+
+// A database opened read only is checked against the schema without
+// being changed, and can be read once it has been upgraded
+func TestReadOnlyDatabase(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "old.db")
+	old, err := OpenDatabaseConnection(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.db.Exec("CREATE TABLE requests (id INTEGER PRIMARY KEY ASC, status INTEGER, uri TEXT, httpStatus INTEGER, parent TEXT, UNIQUE(uri))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.CloseDatabaseConnection()
+
+	db, err := OpenReadOnlyDatabase(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CheckSchema()
+	if err == nil || err.Error() != "missing the bodyHash, detected, discovered, priority, redirects, simhash, size, source, updated columns of the requests table" {
+		t.Fatalf("expected the missing columns to be reported, got %v", err)
+	}
+	err = db.CreateSchema()
+	if err == nil {
+		t.Fatal("expected a read only database not to be migrated")
+	}
+	db.CloseDatabaseConnection()
+
+	upgraded, err := OpenDatabaseConnection(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = upgraded.CreateSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgraded.CloseDatabaseConnection()
+
+	db, err = OpenReadOnlyDatabase(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseDatabaseConnection()
+	err = db.CheckSchema()
+	if err != nil {
+		t.Fatalf("expected an upgraded database to be readable, got %v", err)
+	}
+}
+
+// Only a variant which completed, or is still to be made and was added
+// first, keeps a request differing only by case from being made
+func TestCaseVariantsOfFailedRequests(t *testing.T) {
+	db := testDatabase(t)
+	defer db.CloseDatabaseConnection()
+
+	root := "http://localhost/"
+	err := db.AddRequests(root, []string{root + "Admin", root + "admin", root + "Login", root + "login", root + "LOGIN"}, []int{0, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]RequestStatus{root + "Admin": Failed, root + "admin": Inflight, root + "Login": Processed}
+	for uri, status := range statuses {
+		_, err = db.db.Exec("UPDATE requests SET status = ? WHERE uri = ?", status, uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]bool{root + "admin": false, root + "login": true}
+	for uri, variant := range expected {
+		found, err := db.IsCaseVariant(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != variant {
+			t.Errorf("expected %v being a case variant to be %v", uri, variant)
+		}
+	}
+
+	pruned, err := db.PruneCaseVariants("http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total, err := db.GetTotalRequestCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 2 || total != 3 {
+		t.Fatalf("expected only the unprocessed variants of Login to be pruned, %v were leaving %v", pruned, total)
+	}
+}
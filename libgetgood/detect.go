@@ -0,0 +1,682 @@
+package libgetgood
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Detector recognises an exposed source control or metadata file by its
+// content rather than its status, so soft 200s aren't taken as hits, and
+// lists the paths the file gives away
+type detector struct {
+	name string
+	// Path requested beneath every directory expanded, blank for files
+	// only requested once another file lists them
+	probe string
+	// Matches the path of urls the detector checks, the directory the
+	// match starts in is where listed paths are resolved from
+	pattern *regexp.Regexp
+	matches func(body []byte) bool
+	list    func(body []byte) []string
+}
+
+var (
+	gitRefPattern      = regexp.MustCompile(`^ref: (refs/\S+)\s*$`)
+	gitHashPattern     = regexp.MustCompile(`^[0-9a-f]{40}\b`)
+	gitBranchPattern   = regexp.MustCompile(`^\[branch "([^"]+)"\]`)
+	gitRemotePattern   = regexp.MustCompile(`^\[remote "([^"]+)"\]`)
+	packedRefPattern   = regexp.MustCompile(`^\^?([0-9a-f]{40})(?: (refs/\S+))?$`)
+	gitLogPattern      = regexp.MustCompile(`^[0-9a-f]{40} ([0-9a-f]{40}) `)
+	hgRequirePattern   = regexp.MustCompile(`^[a-z0-9-]+$`)
+	envLinePattern     = regexp.MustCompile(`^(?:export\s+)?[A-Za-z_][A-Za-z0-9_.]*\s*=`)
+	svnEntryPattern    = regexp.MustCompile(`(?s)<entry\b[^>]*?\bname="([^"]*)"[^>]*?\bkind="(file|dir)"`)
+	webXMLClassPattern = regexp.MustCompile(`<(?:servlet|filter|listener)-class>\s*([\w.$]+)\s*<`)
+	webXMLPathPattern  = regexp.MustCompile(`<(?:url-pattern|jsp-file|welcome-file)>\s*([^<\s]+)\s*<`)
+	metadataPattern    = regexp.MustCompile(`/(?:\.git|\.svn|\.hg|\.bzr|CVS|WEB-INF)/`)
+)
+
+var detectors = []*detector{
+	{"git repository", ".git/HEAD", regexp.MustCompile(`/\.git/HEAD$`), isGitHead, listGitHead},
+	{"git config", "", regexp.MustCompile(`/\.git/config$`), isGitConfig, listGitConfig},
+	{"git ref", "", regexp.MustCompile(`/\.git/(?:refs/.*[^/]|ORIG_HEAD|FETCH_HEAD)$`), isGitRef, listGitRef},
+	{"git packed refs", "", regexp.MustCompile(`/\.git/packed-refs$`), isPackedRefs, listPackedRefs},
+	{"git log", "", regexp.MustCompile(`/\.git/logs/HEAD$`), isGitLog, listGitLog},
+	{"git index", "", regexp.MustCompile(`/\.git/index$`), isGitIndex, listGitIndex},
+	{"git object", "", regexp.MustCompile(`/\.git/objects/[0-9a-f]{2}/[0-9a-f]{38}$`), isZlib, nil},
+	{"subversion entries", ".svn/entries", regexp.MustCompile(`/\.svn/entries$`), isSvnEntries, listSvnEntries},
+	{"subversion database", ".svn/wc.db", regexp.MustCompile(`/\.svn/wc\.db$`), isSqlite, listSvnDatabase},
+	{"mercurial repository", ".hg/requires", regexp.MustCompile(`/\.hg/requires$`), isHgRequires, listHgRequires},
+	{"mercurial file list", "", regexp.MustCompile(`/\.hg/store/fncache$`), isFncache, listFncache},
+	{"bazaar repository", ".bzr/branch-format", regexp.MustCompile(`/\.bzr/branch-format$`), isBzrFormat, nil},
+	{"cvs entries", "CVS/Entries", regexp.MustCompile(`/CVS/Entries$`), isCvsEntries, listCvsEntries},
+	{"ds_store", ".DS_Store", regexp.MustCompile(`/\.DS_Store$`), isDSStore, listDSStore},
+	{"env file", ".env", regexp.MustCompile(`/\.env$`), isEnv, nil},
+	{"java web.xml", "WEB-INF/web.xml", regexp.MustCompile(`/WEB-INF/web\.xml$`), isWebXML, listWebXML},
+}
+
+// The detector checking a url, or nil if none do
+func findDetector(rawURL string) *detector {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	for _, d := range detectors {
+		if d.pattern.MatchString(u.Path) {
+			return d
+		}
+	}
+	return nil
+}
+
+// The files requested beneath a directory to check for exposed
+// metadata, none beneath metadata directories themselves
+func probeURLs(directory string) []string {
+	if !strings.HasSuffix(directory, "/") {
+		directory += "/"
+	}
+	u, err := url.Parse(directory)
+	if err != nil || metadataPattern.MatchString(u.Path) {
+		return nil
+	}
+	urls := make([]string, 0, len(detectors))
+	for _, d := range detectors {
+		if d.probe != "" {
+			urls = append(urls, directory+d.probe)
+		}
+	}
+	return urls
+}
+
+// Whether a name beneath a directory is one of the files the detectors
+// check for
+func isProbe(name string) bool {
+	for _, d := range detectors {
+		if d.probe != "" && d.probe == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the body against the detector's signature, returning whether it
+// matched and the urls listed by the file
+func (d *detector) detect(rawURL string, body []byte) (bool, []string) {
+	if !d.matches(body) {
+		return false, nil
+	}
+	if d.list == nil {
+		return true, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return true, nil
+	}
+	loc := d.pattern.FindStringIndex(u.Path)
+	base := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path[:loc[0]+1]}
+
+	seen := make(map[string]bool)
+	urls := make([]string, 0)
+	for _, ref := range d.list(body) {
+		ref = strings.TrimPrefix(ref, "/")
+		if ref == "" || strings.HasPrefix(ref, "../") {
+			continue
+		}
+		link, ok := resolveLink(base, "./"+(&url.URL{Path: ref}).EscapedPath())
+		if !ok || seen[link] {
+			continue
+		}
+		seen[link] = true
+		urls = append(urls, link)
+		if len(urls) == maxLinks {
+			break
+		}
+	}
+	return true, urls
+}
+
+// Non-empty lines of a body, without surrounding whitespace
+func lines(body []byte) []string {
+	result := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// Loose objects are stored beneath a directory named by the first two
+// characters of their hash
+func gitObject(hash string) string {
+	return ".git/objects/" + hash[:2] + "/" + hash[2:]
+}
+
+func isGitHead(body []byte) bool {
+	text := strings.TrimSpace(string(body))
+	return gitRefPattern.MatchString(text) || (len(text) == 40 && gitHashPattern.MatchString(text))
+}
+
+func listGitHead(body []byte) []string {
+	paths := []string{".git/config", ".git/packed-refs", ".git/index", ".git/logs/HEAD", ".git/ORIG_HEAD", ".git/FETCH_HEAD", ".git/description"}
+	text := strings.TrimSpace(string(body))
+	if match := gitRefPattern.FindStringSubmatch(text); match != nil {
+		paths = append(paths, ".git/"+match[1])
+	} else {
+		paths = append(paths, gitObject(text))
+	}
+	return paths
+}
+
+func isGitConfig(body []byte) bool {
+	text := string(body)
+	return strings.Contains(text, "[core]") && strings.Contains(text, "repositoryformatversion")
+}
+
+// Branches and remotes in the config have refs of their own
+func listGitConfig(body []byte) []string {
+	paths := make([]string, 0)
+	for _, line := range lines(body) {
+		if match := gitBranchPattern.FindStringSubmatch(line); match != nil {
+			paths = append(paths, ".git/refs/heads/"+match[1])
+		} else if match := gitRemotePattern.FindStringSubmatch(line); match != nil {
+			paths = append(paths, ".git/refs/remotes/"+match[1]+"/HEAD")
+		}
+	}
+	return paths
+}
+
+// Refs hold the hash of a commit, or name another ref
+func isGitRef(body []byte) bool {
+	return gitHashPattern.Match(body) || gitRefPattern.MatchString(strings.TrimSpace(string(body)))
+}
+
+func listGitRef(body []byte) []string {
+	if match := gitRefPattern.FindStringSubmatch(strings.TrimSpace(string(body))); match != nil {
+		return []string{".git/" + match[1]}
+	}
+	return []string{gitObject(string(body[:40]))}
+}
+
+func isPackedRefs(body []byte) bool {
+	found := false
+	for _, line := range lines(body) {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !packedRefPattern.MatchString(line) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+func listPackedRefs(body []byte) []string {
+	paths := make([]string, 0)
+	for _, line := range lines(body) {
+		match := packedRefPattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		paths = append(paths, gitObject(match[1]))
+		if match[2] != "" {
+			paths = append(paths, ".git/"+match[2])
+		}
+	}
+	return paths
+}
+
+func isGitLog(body []byte) bool {
+	all := lines(body)
+	return len(all) > 0 && gitLogPattern.MatchString(all[0])
+}
+
+// Each entry of the log records the commit HEAD moved to
+func listGitLog(body []byte) []string {
+	paths := make([]string, 0)
+	for _, line := range lines(body) {
+		match := gitLogPattern.FindStringSubmatch(line)
+		if match != nil {
+			paths = append(paths, gitObject(match[1]))
+		}
+	}
+	return paths
+}
+
+func isGitIndex(body []byte) bool {
+	return bytes.HasPrefix(body, []byte("DIRC"))
+}
+
+// The index lists every file in the working tree. Only versions 2 and 3
+// are read, version 4 compresses the paths
+func listGitIndex(body []byte) []string {
+	paths := make([]string, 0)
+	if len(body) < 12 {
+		return paths
+	}
+	version := binary.BigEndian.Uint32(body[4:8])
+	count := binary.BigEndian.Uint32(body[8:12])
+	if version != 2 && version != 3 {
+		return paths
+	}
+
+	offset := 12
+	for i := uint32(0); i < count && offset+62 <= len(body); i++ {
+		flags := binary.BigEndian.Uint16(body[offset+60 : offset+62])
+		start := offset + 62
+		if version == 3 && flags&0x4000 != 0 {
+			start += 2
+		}
+		if start > len(body) {
+			break
+		}
+		end := bytes.IndexByte(body[start:], 0)
+		if end < 0 {
+			break
+		}
+		paths = append(paths, string(body[start:start+end]))
+
+		// Entries are padded with nulls to a multiple of eight bytes
+		length := start + end - offset
+		offset += (length + 8) &^ 7
+	}
+	return paths
+}
+
+// Loose git objects are zlib streams
+func isZlib(body []byte) bool {
+	return len(body) > 2 && body[0] == 0x78 && (uint16(body[0])<<8|uint16(body[1]))%31 == 0
+}
+
+// Entries files start with their format number, or are xml before
+// format 7. Since subversion 1.7 the entries are kept in wc.db instead
+func isSvnEntries(body []byte) bool {
+	all := lines(body)
+	if len(all) == 0 {
+		return false
+	}
+	format, err := strconv.Atoi(all[0])
+	if err == nil {
+		return format >= 7 && format <= 12
+	}
+	return strings.Contains(string(body), "<wc-entries")
+}
+
+func listSvnEntries(body []byte) []string {
+	paths := []string{".svn/wc.db"}
+	entries := make([][2]string, 0)
+	if bytes.Contains(body, []byte("<wc-entries")) {
+		for _, match := range svnEntryPattern.FindAllSubmatch(body, -1) {
+			entries = append(entries, [2]string{string(match[1]), string(match[2])})
+		}
+	} else {
+		// Entries are separated by form feeds, each starting with its
+		// name and kind. The first is the directory itself
+		for _, record := range strings.Split(string(body), "\f\n") {
+			fields := strings.Split(record, "\n")
+			if len(fields) >= 2 {
+				entries = append(entries, [2]string{fields[0], fields[1]})
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		name, kind := entry[0], entry[1]
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		if kind == "dir" {
+			paths = append(paths, name+"/", name+"/.svn/entries")
+		} else if kind == "file" {
+			paths = append(paths, name, ".svn/text-base/"+name+".svn-base")
+		}
+	}
+	return paths
+}
+
+func isSqlite(body []byte) bool {
+	return bytes.HasPrefix(body, []byte("SQLite format 3\x00"))
+}
+
+// The working copy database lists every file along with the hash of
+// its pristine copy, which holds the file's source
+func listSvnDatabase(body []byte) []string {
+	paths := make([]string, 0)
+	file, err := ioutil.TempFile("", "wc-*.db")
+	if err != nil {
+		return paths
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(body)
+	file.Close()
+	if err != nil {
+		return paths
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+file.Name()+"?mode=ro")
+	if err != nil {
+		return paths
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT local_relpath, kind, COALESCE(checksum, '') FROM NODES WHERE local_relpath != ''")
+	if err != nil {
+		return paths
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var relpath, kind, checksum string
+		if rows.Scan(&relpath, &kind, &checksum) != nil {
+			continue
+		}
+		if kind == "dir" {
+			paths = append(paths, relpath+"/")
+			continue
+		}
+		paths = append(paths, relpath)
+		if hash := strings.TrimPrefix(checksum, "$sha1$"); len(hash) == 40 {
+			paths = append(paths, ".svn/pristine/"+hash[:2]+"/"+hash+".svn-base")
+		}
+	}
+	return paths
+}
+
+func isHgRequires(body []byte) bool {
+	all := lines(body)
+	known := false
+	for _, line := range all {
+		if !hgRequirePattern.MatchString(line) {
+			return false
+		}
+		if line == "revlogv1" || line == "store" {
+			known = true
+		}
+	}
+	return known
+}
+
+func listHgRequires(body []byte) []string {
+	return []string{".hg/hgrc", ".hg/branch", ".hg/dirstate", ".hg/store/fncache", ".hg/store/00manifest.i", ".hg/store/00changelog.i"}
+}
+
+func isFncache(body []byte) bool {
+	all := lines(body)
+	for _, line := range all {
+		if !strings.HasPrefix(line, "data/") && !strings.HasPrefix(line, "meta/") {
+			return false
+		}
+	}
+	return len(all) > 0
+}
+
+// The file cache lists the revlog of every file ever committed
+func listFncache(body []byte) []string {
+	paths := make([]string, 0)
+	for _, line := range lines(body) {
+		if strings.HasPrefix(line, "data/") && strings.HasSuffix(line, ".i") {
+			paths = append(paths, strings.TrimSuffix(strings.TrimPrefix(line, "data/"), ".i"))
+		}
+	}
+	return paths
+}
+
+func isBzrFormat(body []byte) bool {
+	return bytes.HasPrefix(body, []byte("Bazaar-NG meta directory"))
+}
+
+func isCvsEntries(body []byte) bool {
+	all := lines(body)
+	for _, line := range all {
+		if line != "D" && !strings.HasPrefix(line, "/") && !strings.HasPrefix(line, "D/") {
+			return false
+		}
+	}
+	return len(all) > 0
+}
+
+// Files are listed as /name/revision/..., directories as D/name////
+func listCvsEntries(body []byte) []string {
+	paths := make([]string, 0)
+	for _, line := range lines(body) {
+		if strings.HasPrefix(line, "D/") {
+			name := strings.Split(line[2:], "/")[0]
+			paths = append(paths, name+"/", name+"/CVS/Entries")
+		} else if strings.HasPrefix(line, "/") {
+			paths = append(paths, strings.Split(line[1:], "/")[0])
+		}
+	}
+	return paths
+}
+
+func isDSStore(body []byte) bool {
+	return bytes.HasPrefix(body, []byte("\x00\x00\x00\x01Bud1"))
+}
+
+// Names of the files and directories a .DS_Store holds records for.
+// Names without an extension may be directories, so their own
+// .DS_Store is listed too
+func listDSStore(body []byte) []string {
+	paths := make([]string, 0)
+	for _, name := range readDSStore(body) {
+		if name == "." || name == ".." || strings.Contains(name, "/") {
+			continue
+		}
+		paths = append(paths, name)
+		if path.Ext(name) == "" {
+			paths = append(paths, name+"/.DS_Store")
+		}
+	}
+	return paths
+}
+
+// A .DS_Store is a buddy allocator holding a b-tree of records, each
+// keyed by a filename. Malformed files give whatever names were read
+// before the problem
+func readDSStore(body []byte) []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+
+	// Offsets in the file are from after its four byte alignment header
+	u32 := func(offset int) (int, bool) {
+		if offset < 0 || offset+4 > len(body)-4 {
+			return 0, false
+		}
+		return int(binary.BigEndian.Uint32(body[offset+4 : offset+8])), true
+	}
+
+	rootOffset, ok := u32(4)
+	if !ok {
+		return names
+	}
+	count, ok := u32(rootOffset)
+	if !ok || count > 4096 {
+		return names
+	}
+	addresses := make([]int, 0, count)
+	for i := 0; i < count; i++ {
+		address, ok := u32(rootOffset + 8 + i*4)
+		if !ok {
+			return names
+		}
+		addresses = append(addresses, address)
+	}
+	blockOffset := func(id int) (int, bool) {
+		if id < 0 || id >= len(addresses) {
+			return 0, false
+		}
+		return addresses[id] &^ 0x1f, true
+	}
+
+	// The table of contents follows the addresses, padded to 256
+	offset := rootOffset + 8 + ((count+255)/256)*256*4
+	tocCount, ok := u32(offset)
+	if !ok {
+		return names
+	}
+	offset += 4
+	dsdb := -1
+	for i := 0; i < tocCount && offset+4 < len(body); i++ {
+		length := int(body[offset+4])
+		if offset+5+length+4 > len(body) {
+			return names
+		}
+		name := string(body[offset+5 : offset+5+length])
+		id, _ := u32(offset + 1 + length)
+		if name == "DSDB" {
+			dsdb = id
+		}
+		offset += 1 + length + 4
+	}
+
+	start, ok := blockOffset(dsdb)
+	if !ok {
+		return names
+	}
+	root, ok := u32(start)
+	if !ok {
+		return names
+	}
+
+	// Walk the tree, nodes list their records after the id of their
+	// rightmost child, internal nodes give a child before each record
+	visited := make(map[int]bool)
+	stack := []int{root}
+	for len(stack) > 0 && len(visited) < 4096 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if visited[node] {
+			continue
+		}
+		visited[node] = true
+		offset, ok := blockOffset(node)
+		if !ok {
+			continue
+		}
+		next, ok1 := u32(offset)
+		count, ok2 := u32(offset + 4)
+		if !ok1 || !ok2 {
+			continue
+		}
+		offset += 8
+		if next != 0 {
+			stack = append(stack, next)
+		}
+		for i := 0; i < count; i++ {
+			if next != 0 {
+				child, ok := u32(offset)
+				if !ok {
+					break
+				}
+				stack = append(stack, child)
+				offset += 4
+			}
+			name, end, ok := readDSStoreRecord(body, offset, u32)
+			if !ok {
+				break
+			}
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+			offset = end
+		}
+	}
+	return names
+}
+
+// Read the record at offset, returning its filename and where the next
+// record starts
+func readDSStoreRecord(body []byte, offset int, u32 func(int) (int, bool)) (string, int, bool) {
+	length, ok := u32(offset)
+	if !ok || length > 1024 || offset+4+length*2+8 > len(body)-4 {
+		return "", 0, false
+	}
+	start := offset + 8
+	units := make([]uint16, length)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(body[start+i*2 : start+i*2+2])
+	}
+	name := string(utf16.Decode(units))
+	offset += 4 + length*2 + 4
+
+	// The value's size depends on its type
+	kind := string(body[offset+4 : offset+8])
+	offset += 4
+	switch kind {
+	case "bool":
+		offset += 1
+	case "long", "shor", "type":
+		offset += 4
+	case "comp", "dutc":
+		offset += 8
+	case "blob":
+		size, ok := u32(offset)
+		if !ok {
+			return "", 0, false
+		}
+		offset += 4 + size
+	case "ustr":
+		size, ok := u32(offset)
+		if !ok {
+			return "", 0, false
+		}
+		offset += 4 + size*2
+	default:
+		return "", 0, false
+	}
+	return name, offset, true
+}
+
+// Most lines of an env file assign a variable, and there must be some
+func isEnv(body []byte) bool {
+	assignments := 0
+	others := 0
+	for _, line := range lines(body) {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if envLinePattern.MatchString(line) {
+			assignments++
+		} else {
+			others++
+		}
+	}
+	return assignments > 0 && others <= assignments/4
+}
+
+func isWebXML(body []byte) bool {
+	return bytes.Contains(body, []byte("<web-app"))
+}
+
+// Servlet, filter and listener classes are compiled beneath
+// WEB-INF/classes. Url patterns are cut at any wildcard
+func listWebXML(body []byte) []string {
+	paths := make([]string, 0)
+	for _, match := range webXMLClassPattern.FindAllSubmatch(body, -1) {
+		class := strings.Split(string(match[1]), "$")[0]
+		paths = append(paths, "WEB-INF/classes/"+strings.Replace(class, ".", "/", -1)+".class")
+	}
+	for _, match := range webXMLPathPattern.FindAllSubmatch(body, -1) {
+		pattern := string(match[1])
+		if i := strings.Index(pattern, "*"); i >= 0 {
+			pattern = pattern[:i]
+		}
+		pattern = strings.TrimPrefix(pattern, "/")
+		if pattern != "" {
+			paths = append(paths, pattern)
+		}
+	}
+	return paths
+}
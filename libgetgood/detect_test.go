@@ -0,0 +1,195 @@
+package libgetgood
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+)
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// A git index listing the paths, with extended flags set on every entry
+// when asked for, which only version 3 allows
+func gitIndex(version uint32, extended bool, paths ...string) []byte {
+	body := []byte("DIRC")
+	body = appendUint32(body, version)
+	body = appendUint32(body, uint32(len(paths)))
+	for _, p := range paths {
+		entry := make([]byte, 60)
+		flags := uint16(len(p))
+		if extended {
+			flags |= 0x4000
+		}
+		entry = appendUint16(entry, flags)
+		if extended {
+			entry = append(entry, 0, 0)
+		}
+		entry = append(entry, p...)
+		entry = append(entry, make([]byte, 8-len(entry)%8)...)
+		body = append(body, entry...)
+	}
+	return body
+}
+
+// A .DS_Store with a single leaf node holding a record for each name
+func dsStore(names ...string) []byte {
+	const rootOffset, dsdbOffset, nodeOffset = 64, 2048, 2304
+	file := make([]byte, nodeOffset)
+	copy(file, "Bud1")
+	binary.BigEndian.PutUint32(file[4:], rootOffset)
+
+	// Two blocks, the DSDB header and the node, then the table of contents
+	binary.BigEndian.PutUint32(file[rootOffset:], 2)
+	binary.BigEndian.PutUint32(file[rootOffset+8:], dsdbOffset|5)
+	binary.BigEndian.PutUint32(file[rootOffset+12:], nodeOffset|12)
+	toc := rootOffset + 8 + 256*4
+	binary.BigEndian.PutUint32(file[toc:], 1)
+	file[toc+4] = 4
+	copy(file[toc+5:], "DSDB")
+	binary.BigEndian.PutUint32(file[toc+9:], 0)
+	binary.BigEndian.PutUint32(file[dsdbOffset:], 1)
+
+	file = appendUint32(file, 0)
+	file = appendUint32(file, uint32(len(names)))
+	for _, name := range names {
+		units := utf16.Encode([]rune(name))
+		file = appendUint32(file, uint32(len(units)))
+		for _, unit := range units {
+			file = appendUint16(file, unit)
+		}
+		file = append(file, "Iloc"...)
+		file = append(file, "long"...)
+		file = appendUint32(file, 0)
+	}
+	return append([]byte{0, 0, 0, 1}, file...)
+}
+
+// A subversion working copy database holding a directory and a file
+func svnDatabase(t *testing.T) []byte {
+	filename := filepath.Join(t.TempDir(), "wc.db")
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("CREATE TABLE NODES (local_relpath TEXT, kind TEXT, checksum TEXT)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO NODES VALUES ('', 'dir', NULL), ('src', 'dir', NULL), ('src/main.c', 'file', '$sha1$0123456789abcdef0123456789abcdef01234567')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestListGitIndex(t *testing.T) {
+	paths := []string{"index.php", "config/database.php"}
+	tests := []struct {
+		name     string
+		body     []byte
+		expected []string
+	}{
+		{"version 2", gitIndex(2, false, paths...), paths},
+		{"version 3", gitIndex(3, false, paths...), paths},
+		{"version 3 extended flags", gitIndex(3, true, paths...), paths},
+		{"version 4", gitIndex(4, false, paths...), []string{}},
+		{"header only", []byte("DIRC"), []string{}},
+		{"count past the end", gitIndex(2, false, paths...)[:90], []string{"index.php"}},
+		{"unterminated path", gitIndex(2, false, paths...)[:12+62+4], []string{}},
+		{"extended flags past the end", gitIndex(3, true, paths...)[:12+62], []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listed := listGitIndex(test.body)
+			if !reflect.DeepEqual(listed, test.expected) {
+				t.Errorf("expected %q, got %q", test.expected, listed)
+			}
+		})
+	}
+}
+
+func TestReadDSStore(t *testing.T) {
+	names := []string{"admin", "backup.zip", "café"}
+	body := dsStore(names...)
+	if !isDSStore(body) {
+		t.Fatal("built .DS_Store isn't recognised")
+	}
+	if read := readDSStore(body); !reflect.DeepEqual(read, names) {
+		t.Fatalf("expected %q, got %q", names, read)
+	}
+
+	// A record claiming a name longer than the file, and one with an
+	// unknown value type, end the node without reading past either
+	long := dsStore(names...)
+	third := 4 + 2304 + 8 + (16 + 2*len("admin")) + (16 + 2*len("backup.zip"))
+	binary.BigEndian.PutUint32(long[third:], 1<<10)
+	if read := readDSStore(long); !reflect.DeepEqual(read, names[:2]) {
+		t.Errorf("expected %q from an overlong name, got %q", names[:2], read)
+	}
+	unknown := dsStore("admin")
+	copy(unknown[len(unknown)-8:], "junk")
+	if read := readDSStore(unknown); len(read) != 0 {
+		t.Errorf("expected nothing from an unknown value type, got %q", read)
+	}
+}
+
+func TestListSvnDatabase(t *testing.T) {
+	body := svnDatabase(t)
+	if !isSqlite(body) {
+		t.Fatal("built database isn't recognised")
+	}
+	expected := []string{"src/", "src/main.c", ".svn/pristine/01/0123456789abcdef0123456789abcdef01234567.svn-base"}
+	if listed := listSvnDatabase(body); !reflect.DeepEqual(listed, expected) {
+		t.Fatalf("expected %q, got %q", expected, listed)
+	}
+	if listed := listSvnDatabase(body[:100]); len(listed) != 0 {
+		t.Errorf("expected nothing from a truncated database, got %q", listed)
+	}
+}
+
+// Every prefix of a file, as left by a dropped connection, and garbage
+// with each file's signature must be read without panicking
+func TestDetectorsTruncated(t *testing.T) {
+	bodies := map[string][]byte{
+		"/.git/HEAD":              []byte("ref: refs/heads/master\n"),
+		"/.git/refs/heads/master": []byte("0123456789abcdef0123456789abcdef01234567\n"),
+		"/.git/logs/HEAD":         []byte("0000000000000000000000000000000000000000 0123456789abcdef0123456789abcdef01234567 a <a@b> 0 +0000\tcommit\n"),
+		"/.git/index":             gitIndex(3, true, "index.php", "config/database.php"),
+		"/.svn/entries":           []byte("10\n\ndir\n\f\nsrc\ndir\n\f\nindex.php\nfile\n\f\n"),
+		"/.svn/wc.db":             svnDatabase(t),
+		"/.hg/store/fncache":      []byte("data/index.php.i\ndata/lib/db.php.i\n"),
+		"/CVS/Entries":            []byte("/index.php/1.1/Mon Jan 1 00:00:00 2020//\nD/lib////\n"),
+		"/.DS_Store":              dsStore("admin", "backup.zip"),
+		"/WEB-INF/web.xml":        []byte("<web-app><servlet-class>com.example.Main</servlet-class></web-app>"),
+		"/.git/objects/01/23456789abcdef0123456789abcdef01234567": {0x78, 0x9c, 0x03, 0x00},
+	}
+	for path, body := range bodies {
+		d := findDetector("http://localhost" + path)
+		if d == nil {
+			t.Fatalf("no detector for %v", path)
+		}
+		// The database is written out for each read so it's cut coarsely
+		step := 1 + len(body)/256
+		for i := 0; i <= len(body); i += step {
+			d.detect("http://localhost"+path, body[:i])
+		}
+		garbage := append(append([]byte{}, body[:len(body)/2]...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+		d.detect("http://localhost"+path, garbage)
+	}
+}
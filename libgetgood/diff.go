@@ -0,0 +1,78 @@
+package libgetgood
+
+import (
+	"sort"
+)
+
+// Change is a url found by both scans but with a different status,
+// size or body
+type Change struct {
+	Url string   `json:"url"`
+	Old *Finding `json:"old"`
+	New *Finding `json:"new"`
+}
+
+// StatusChanged reports whether the response status differs
+func (change *Change) StatusChanged() bool {
+	return change.Old.Status != change.New.Status
+}
+
+// SizeChanged reports whether the response size differs, responses
+// recorded before sizes were stored are never seen as changed
+func (change *Change) SizeChanged() bool {
+	return change.bodiesRecorded() && change.Old.Size != change.New.Size
+}
+
+// BodyChanged reports whether the response body differs, responses
+// recorded before bodies were hashed are never seen as changed
+func (change *Change) BodyChanged() bool {
+	return change.bodiesRecorded() && change.Old.BodyHash != change.New.BodyHash
+}
+
+func (change *Change) bodiesRecorded() bool {
+	return change.Old.BodyHash != "" && change.New.BodyHash != ""
+}
+
+// Diff holds the differences between the findings of two scans
+type Diff struct {
+	New     []*Finding `json:"new"`
+	Gone    []*Finding `json:"gone"`
+	Changed []*Change  `json:"changed"`
+}
+
+// DiffFindings compares the findings of an older scan with a newer
+// one, each list in the result is sorted by url
+func DiffFindings(older []*Finding, newer []*Finding) *Diff {
+	diff := &Diff{make([]*Finding, 0), make([]*Finding, 0), make([]*Change, 0)}
+
+	oldFindings := make(map[string]*Finding)
+	for _, finding := range older {
+		oldFindings[finding.Url] = finding
+	}
+
+	newFindings := make(map[string]*Finding)
+	for _, finding := range newer {
+		newFindings[finding.Url] = finding
+		old, ok := oldFindings[finding.Url]
+		if !ok {
+			diff.New = append(diff.New, finding)
+			continue
+		}
+
+		change := &Change{finding.Url, old, finding}
+		if change.StatusChanged() || change.SizeChanged() || change.BodyChanged() {
+			diff.Changed = append(diff.Changed, change)
+		}
+	}
+
+	for _, finding := range older {
+		if _, ok := newFindings[finding.Url]; !ok {
+			diff.Gone = append(diff.Gone, finding)
+		}
+	}
+
+	sort.Slice(diff.New, func(i, j int) bool { return diff.New[i].Url < diff.New[j].Url })
+	sort.Slice(diff.Gone, func(i, j int) bool { return diff.Gone[i].Url < diff.Gone[j].Url })
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Url < diff.Changed[j].Url })
+	return diff
+}
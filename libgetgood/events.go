@@ -0,0 +1,105 @@
+package libgetgood
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EventFinding  = "finding"
+	EventProgress = "progress"
+	EventState    = "state"
+)
+
+// Number of events a subscriber can fall behind by before events are dropped
+const eventBufferSize = 100
+
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+type Finding struct {
+	Url      string `json:"url"`
+	Status   int    `json:"status"`
+	Size     int64  `json:"size"`
+	BodyHash string `json:"bodyHash"`
+
+	// Redirects followed to reach the response, ending with where the
+	// response points if it's a redirect that wasn't followed
+	Redirects []Redirect `json:"redirects,omitempty"`
+
+	// Where the url was found when it wasn't from the wordlist
+	Source string `json:"source,omitempty"`
+
+	// Name of the detector that recognised an exposed file at the url
+	Detected string `json:"detected,omitempty"`
+
+	// Similarity hash of the response, near identical responses have
+	// hashes differing in only a few bits
+	Simhash string `json:"simhash,omitempty"`
+}
+
+// Report is a snapshot of a scanner's progress, produced periodically
+// by the monitor
+type Report struct {
+	Progress
+	RequestsPerSecond float64           `json:"requestsPerSecond"`
+	ETA               time.Duration     `json:"eta"`
+	StatusCounts      map[int]int       `json:"statusCounts"`
+	ErrorCounts       map[string]int    `json:"errorCounts"`
+	LatencyP50        time.Duration     `json:"latencyP50"`
+	LatencyP95        time.Duration     `json:"latencyP95"`
+	LatencyP99        time.Duration     `json:"latencyP99"`
+	Depth             int               `json:"depth"`
+	MaxDepth          int               `json:"maxDepth"`
+	Targets           []*TargetProgress `json:"targets"`
+	Paused            bool              `json:"paused"`
+	Workers           int               `json:"workers"`
+	Rate              int               `json:"rate"`
+	Clusters          []*Cluster        `json:"clusters"`
+}
+
+// Events fans out scan events to any number of subscribers. Slow
+// subscribers miss events rather than blocking the scan
+type Events struct {
+	mutex       *sync.Mutex
+	subscribers map[chan *Event]bool
+}
+
+func NewEvents() *Events {
+	return &Events{&sync.Mutex{}, make(map[chan *Event]bool)}
+}
+
+func (events *Events) Subscribe() chan *Event {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	eventChan := make(chan *Event, eventBufferSize)
+	events.subscribers[eventChan] = true
+	return eventChan
+}
+
+func (events *Events) Unsubscribe(eventChan chan *Event) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	delete(events.subscribers, eventChan)
+}
+
+func (events *Events) Publish(eventType string, data interface{}) {
+	if events == nil {
+		return
+	}
+
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	event := &Event{eventType, time.Now(), data}
+	for eventChan := range events.subscribers {
+		select {
+		case eventChan <- event:
+			break
+		default:
+			break
+		}
+	}
+}
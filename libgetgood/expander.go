@@ -0,0 +1,490 @@
+package libgetgood
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// Number of requests added to the database in each transaction, keeping
+// transactions short so the updater and poller aren't held up for long
+const expansionBatchSize = 1000
+
+// Expander adds the wordlist requests beneath each directory found, and
+// the paths found by the spider. It runs separately from the updater so
+// recording responses never waits on a large expansion
+type Expander struct {
+	running     bool
+	wg          *sync.WaitGroup
+	ctx         context.Context
+	cancel      context.CancelFunc
+	db          *DBConn
+	supervisor  *Supervisor
+	stats       *Stats
+	mutex       *sync.Mutex
+	pending     []*expansion
+	queued      int
+	signalChan  chan int
+	skipChan    chan int
+	words       []string
+	dynamic     []string
+	known       map[string]bool
+	discovered  map[string]bool
+	extensions  []string
+	prioritiser *Prioritiser
+	scope       *Scope
+	detect      bool
+	root        string
+	expanded    []string
+	branches    []string
+	skipped     []string
+	logger      logrus.FieldLogger
+}
+
+// A directory to expand, or the links found in a response or file and
+// where they came from
+type expansion struct {
+	url    string
+	links  []string
+	origin string
+}
+
+const (
+	originSpider   = "spider"
+	originSeed     = "seed"
+	originDetector = "detector"
+	originRestored = "restored"
+)
+
+// StartExpander starts an expander adding the words, and the dynamic
+// words found by the spider so far, beneath each directory. When
+// detecting, the files the detectors check for are added too
+func StartExpander(ctx context.Context, wg *sync.WaitGroup, db *DBConn, supervisor *Supervisor, stats *Stats, root string, words []string, dynamic []string, extensions []string, prioritiser *Prioritiser, scope *Scope, detect bool, logger logrus.FieldLogger) *Expander {
+	ctx, cancel := context.WithCancel(ctx)
+	signalChan := make(chan int, 1)
+	skipChan := make(chan int, 1)
+	known := make(map[string]bool)
+	for _, word := range words {
+		known[word] = true
+	}
+	for _, word := range dynamic {
+		known[word] = true
+	}
+	expander := &Expander{true, wg, ctx, cancel, db, supervisor, stats, &sync.Mutex{}, make([]*expansion, 0), 0, signalChan, skipChan, words, dynamic, known, make(map[string]bool), extensions, prioritiser, scope, detect, root, make([]string, 0), make([]string, 0), make([]string, 0), logger}
+	wg.Add(1)
+	go expander.work()
+	return expander
+}
+
+// Expand queues a directory to have requests added beneath it. Never blocks
+func (expander *Expander) Expand(url string) {
+	expander.queue(&expansion{url, nil, ""})
+}
+
+// Discover queues the links the spider found in a response to be added
+// as requests. Never blocks
+func (expander *Expander) Discover(url string, links []string) {
+	expander.queue(&expansion{url, links, originSpider})
+}
+
+// Seed queues the urls listed by a file the scan is seeded from to be
+// added as requests ahead of any others. Never blocks
+func (expander *Expander) Seed(source string, urls []string) {
+	expander.queue(&expansion{source, urls, originSeed})
+}
+
+// List queues the urls listed by an exposed file or directory listing
+// to be added as requests ahead of the wordlist. Never blocks
+func (expander *Expander) List(url string, urls []string) {
+	expander.queue(&expansion{url, urls, originDetector})
+}
+
+// Restore queues a directory expanded by an earlier run, so words found
+// by the spider are added beneath it without adding the wordlist again.
+// Never blocks
+func (expander *Expander) Restore(url string) {
+	expander.queue(&expansion{url, nil, originRestored})
+}
+
+func (expander *Expander) queue(item *expansion) {
+	expander.mutex.Lock()
+	expander.pending = append(expander.pending, item)
+	expander.queued++
+	expander.mutex.Unlock()
+	expander.signal()
+}
+
+func (expander *Expander) signal() {
+	select {
+	case expander.signalChan <- 0:
+		break
+	default:
+		break
+	}
+}
+
+// Pending returns the number of directories and responses waiting to
+// be expanded
+func (expander *Expander) Pending() int {
+	expander.mutex.Lock()
+	defer expander.mutex.Unlock()
+	return len(expander.pending)
+}
+
+// Queued returns the number of directories and responses ever queued
+func (expander *Expander) Queued() int {
+	expander.mutex.Lock()
+	defer expander.mutex.Unlock()
+	return expander.queued
+}
+
+// SkipBranch abandons the most recently entered recursion branch
+func (expander *Expander) SkipBranch() {
+	select {
+	case expander.skipChan <- 0:
+		break
+	default:
+		expander.logger.Debugf("Skip already pending")
+	}
+}
+
+func (expander *Expander) Stop() {
+	expander.logger.Debugf("Sending expander stop signal")
+	expander.cancel()
+}
+
+func (expander *Expander) work() {
+	defer expander.wg.Done()
+	expander.supervisor.Supervise(expander.ctx, "expander", expander.run)
+}
+
+func (expander *Expander) run() error {
+	expander.logger.Debugf("Starting expander")
+
+	// Pick up anything left queued if the expander was restarted
+	if expander.Pending() > 0 {
+		expander.signal()
+	}
+
+	running := true
+	var err error
+	for running {
+		select {
+		case <-expander.signalChan:
+			err = expander.expandPending()
+			if err != nil {
+				running = false
+			}
+			break
+		case <-expander.skipChan:
+			err = expander.skipBranch()
+			if err != nil {
+				running = false
+			}
+			break
+		case <-expander.ctx.Done():
+			// Finish anything queued so it isn't lost when the scan is resumed
+			running = false
+			err = expander.expandPending()
+			break
+		}
+	}
+	expander.logger.Debugf("Expander stopped")
+	return err
+}
+
+func (expander *Expander) expandPending() error {
+	for {
+		expander.mutex.Lock()
+		if len(expander.pending) == 0 {
+			expander.mutex.Unlock()
+			return nil
+		}
+		item := expander.pending[0]
+		expander.mutex.Unlock()
+
+		// The item is only removed once expanded so it's still counted
+		// as pending while its requests are being added
+		var err error
+		if item.links != nil {
+			err = expander.discover(item.url, item.links, item.origin)
+		} else if item.origin == originRestored {
+			expander.expanded = append(expander.expanded, item.url)
+		} else {
+			err = expander.expand(item.url)
+		}
+		if err != nil {
+			return err
+		}
+
+		expander.mutex.Lock()
+		expander.pending = expander.pending[1:]
+		expander.mutex.Unlock()
+	}
+}
+
+func (expander *Expander) expand(url string) error {
+	// The spider requests the root, which shouldn't be expanded twice
+	if url == expander.root && len(expander.expanded) > 0 && expander.expanded[0] == url {
+		return nil
+	}
+	if url != expander.root {
+		if expander.isSkipped(url) {
+			expander.logger.Debugf("Not recursing into %v, branch was skipped", url)
+			return nil
+		}
+		err := expander.scope.Check(strings.TrimSuffix(url, "/") + "/")
+		if err != nil {
+			expander.logger.Infof("Not recursing into %v, %v", url, err)
+			return nil
+		}
+		expander.branches = append(expander.branches, url)
+		expander.stats.SetDepth(expander.depth(url))
+	}
+
+	expander.expanded = append(expander.expanded, url)
+	err := expander.addURLs(url, expander.words)
+	if err != nil {
+		return err
+	}
+	err = expander.addURLs(url, expander.dynamic)
+	if err != nil {
+		return err
+	}
+	if expander.detect {
+		err = expander.addProbes(url)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only recorded once every request has been added, so a directory
+	// whose expansion was cut short is expanded again on resume
+	start := time.Now()
+	err = expander.db.AddDirectory(strings.TrimSuffix(url, "/") + "/")
+	expander.stats.RecordDBWrite(time.Since(start))
+	return err
+}
+
+// Add requests for the files the detectors check for beneath a directory
+func (expander *Expander) addProbes(baseURL string) error {
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+
+	requests := make([]string, 0)
+	priorities := make([]int, 0)
+	for _, probe := range probeURLs(baseURL) {
+		err := expander.scope.Check(probe)
+		if err != nil {
+			expander.logger.Debugf("Leaving out %v, %v", probe, err)
+			continue
+		}
+		requests = append(requests, probe)
+		priorities = append(priorities, expander.prioritiser.DetectorPriority())
+	}
+	return expander.addRequests(baseURL, requests, priorities)
+}
+
+func (expander *Expander) addURLs(baseURL string, words []string) error {
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+
+	depth := expander.depth(baseURL)
+	outOfScope := 0
+	requests := make([]string, 0, expansionBatchSize)
+	priorities := make([]int, 0, expansionBatchSize)
+	for _, word := range words {
+		for _, ext := range expander.extensions {
+			err := expander.scope.Check(baseURL + word + ext)
+			if err != nil {
+				expander.logger.Debugf("Leaving out %v, %v", baseURL+word+ext, err)
+				outOfScope++
+				continue
+			}
+
+			requests = append(requests, baseURL+word+ext)
+			priorities = append(priorities, expander.prioritiser.Priority(depth, word, ext))
+			if len(requests) == expansionBatchSize {
+				err := expander.addRequests(baseURL, requests, priorities)
+				if err != nil {
+					return err
+				}
+				requests = requests[:0]
+				priorities = priorities[:0]
+			}
+		}
+	}
+
+	if outOfScope > 0 {
+		expander.logger.Infof("Left out %v out of scope requests beneath %v", outOfScope, baseURL)
+	}
+	return expander.addRequests(baseURL, requests, priorities)
+}
+
+// Add the links found by the spider, seeded or listed by an exposed
+// file or directory listing, along with the directories leading to
+// them, as requests recording where they were found. New words in the
+// paths found by the spider are added to the wordlist beneath every
+// directory expanded so far and those to come
+func (expander *Expander) discover(source string, links []string, origin string) error {
+	requests := make(map[string][]string)
+	priorities := make(map[string][]int)
+	found := 0
+	words := make([]string, 0)
+
+	// A listing reached through a redirect is the directory's index, so
+	// the directory isn't requested again
+	if origin == originDetector {
+		expander.discovered[strings.TrimSuffix(source, "/")+"/"] = true
+	}
+	for _, link := range links {
+		for _, path := range linkPaths(link) {
+			if expander.discovered[path] || strings.HasPrefix(expander.root, path) {
+				continue
+			}
+			expander.discovered[path] = true
+			if expander.isSkipped(path) {
+				continue
+			}
+			err := expander.scope.Check(path)
+			if err != nil {
+				expander.logger.Debugf("Not spidering %v, %v", path, err)
+				continue
+			}
+
+			parent := path[:strings.LastIndex(strings.TrimSuffix(path, "/"), "/")+1]
+			depth := 0
+			if strings.HasPrefix(parent, expander.root) {
+				depth = expander.depth(parent)
+			}
+			priority := expander.prioritiser.DiscoveredPriority(depth)
+			if origin == originSeed {
+				priority = expander.prioritiser.SeedPriority()
+			} else if origin == originDetector {
+				priority = expander.prioritiser.DetectorPriority()
+			}
+			requests[parent] = append(requests[parent], path)
+			priorities[parent] = append(priorities[parent], priority)
+			found++
+		}
+
+		if origin != originSpider || expander.scope.Check(link) != nil {
+			continue
+		}
+		for _, word := range linkWords(link) {
+			if expander.known[word] || len(expander.dynamic)+len(words) >= maxDynamicWords {
+				continue
+			}
+			expander.known[word] = true
+			words = append(words, word)
+		}
+	}
+
+	for parent, urls := range requests {
+		start := time.Now()
+		err := expander.db.AddDiscoveredRequests(parent, urls, priorities[parent], source)
+		expander.stats.RecordDBWrite(time.Since(start))
+		if err != nil {
+			return err
+		}
+	}
+	if found > 0 && origin == originSeed {
+		expander.logger.Infof("Seeded %v new paths from %v", found, source)
+	} else if found > 0 && origin == originDetector {
+		expander.logger.Infof("%v lists %v new paths", source, found)
+	} else if found > 0 {
+		expander.logger.Infof("Spider found %v new paths in %v", found, source)
+	}
+
+	if len(words) == 0 {
+		return nil
+	}
+	start := time.Now()
+	err := expander.db.AddWords(words)
+	expander.stats.RecordDBWrite(time.Since(start))
+	if err != nil {
+		return err
+	}
+	expander.dynamic = append(expander.dynamic, words...)
+	expander.logger.Infof("Spider added %v words to the wordlist from %v", len(words), source)
+	expander.logger.Debugf("Words added: %v", strings.Join(words, ", "))
+	if len(expander.dynamic) >= maxDynamicWords {
+		expander.logger.Warnf("Spider has added %v words to the wordlist, no more will be added", maxDynamicWords)
+	}
+
+	for _, directory := range expander.expanded {
+		if expander.isSkipped(directory) {
+			continue
+		}
+		err = expander.addURLs(directory, words)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (expander *Expander) addRequests(parent string, requests []string, priorities []int) error {
+	if len(requests) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	err := expander.db.AddRequests(parent, requests, priorities)
+	expander.stats.RecordDBWrite(time.Since(start))
+	return err
+}
+
+func (expander *Expander) skipBranch() error {
+	if len(expander.branches) == 0 {
+		expander.logger.Infof("No recursion branch to skip")
+		return nil
+	}
+
+	branch := expander.branches[len(expander.branches)-1]
+	expander.branches = expander.branches[:len(expander.branches)-1]
+	if !strings.HasSuffix(branch, "/") {
+		branch += "/"
+	}
+	expander.skipped = append(expander.skipped, branch)
+	if len(expander.branches) > 0 {
+		expander.stats.SetDepth(expander.depth(expander.branches[len(expander.branches)-1]))
+	} else {
+		expander.stats.SetDepth(0)
+	}
+
+	skipped, err := expander.db.SkipRequests(branch)
+	if err != nil {
+		return err
+	}
+
+	expander.logger.Infof("Skipped branch %v (%v requests)", branch, skipped)
+	return nil
+}
+
+func (expander *Expander) depth(url string) int {
+	return depthBelow(expander.root, url)
+}
+
+// Number of directories between the root url and the given url
+func depthBelow(root string, url string) int {
+	path := strings.Trim(strings.TrimPrefix(url, root), "/")
+	if path == "" {
+		return 0
+	}
+	return strings.Count(path, "/") + 1
+}
+
+func (expander *Expander) isSkipped(url string) bool {
+	for _, branch := range expander.skipped {
+		if strings.HasPrefix(url, branch) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,266 @@
+package libgetgood
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// AutoExtensions is the extension replaced by those of the technologies
+// the target is found to run
+const AutoExtensions = "auto"
+
+// Most of a fingerprinted response's body that is read
+const maxFingerprintBody = 256 * 1024
+
+// Where a signature is looked for, a header name or one of these
+const (
+	inCookie = "cookie"
+	inBody   = "body"
+)
+
+type signature struct {
+	technology string
+	in         string
+	pattern    *regexp.Regexp
+}
+
+// Signatures in headers, cookie names and default error pages. Servers
+// are recorded too although only languages and frameworks have
+// extensions, except for servlet containers which imply java
+var signatures = []signature{
+	{"iis", "server", regexp.MustCompile(`(?i)microsoft-iis`)},
+	{"apache", "server", regexp.MustCompile(`(?i)^apache(?:/|$)`)},
+	{"nginx", "server", regexp.MustCompile(`(?i)nginx`)},
+	{"litespeed", "server", regexp.MustCompile(`(?i)litespeed`)},
+	{"java", "server", regexp.MustCompile(`(?i)apache-coyote|tomcat|jetty|jboss|wildfly|weblogic|websphere|glassfish`)},
+	{"aspnet", "server", regexp.MustCompile(`(?i)kestrel`)},
+	{"python", "server", regexp.MustCompile(`(?i)gunicorn|werkzeug|uvicorn|tornadoserver|wsgiserver|cherrypy`)},
+	{"ruby", "server", regexp.MustCompile(`(?i)puma|webrick|mongrel`)},
+	{"php", "x-powered-by", regexp.MustCompile(`(?i)php`)},
+	{"aspnet", "x-powered-by", regexp.MustCompile(`(?i)asp\.net`)},
+	{"java", "x-powered-by", regexp.MustCompile(`(?i)servlet|jsp|jboss|tomcat|undertow`)},
+	{"node", "x-powered-by", regexp.MustCompile(`(?i)express|next\.js|nuxt`)},
+	{"aspnet", "x-aspnet-version", regexp.MustCompile(`.`)},
+	{"aspnet", "x-aspnetmvc-version", regexp.MustCompile(`.`)},
+	{"php", inCookie, regexp.MustCompile(`^(?:PHPSESSID|laravel_session|ci_session)$`)},
+	{"java", inCookie, regexp.MustCompile(`^JSESSIONID$`)},
+	{"aspnet", inCookie, regexp.MustCompile(`^(?:ASP\.NET_SessionId|\.ASPXAUTH|\.AspNetCore\..+)$`)},
+	{"asp", inCookie, regexp.MustCompile(`^ASPSESSIONID\w+$`)},
+	{"coldfusion", inCookie, regexp.MustCompile(`^(?:CFID|CFTOKEN)$`)},
+	{"python", inCookie, regexp.MustCompile(`^csrftoken$`)},
+	{"node", inCookie, regexp.MustCompile(`^connect\.sid$`)},
+	{"ruby", inCookie, regexp.MustCompile(`^(?:_session_id|_\w+_session)$`)},
+	{"aspnet", inBody, regexp.MustCompile(`Server Error in '/[^']*' Application`)},
+	{"iis", inBody, regexp.MustCompile(`IIS \d+\.\d+ Detailed Error|<h2>404 - File or directory not found\.</h2>`)},
+	{"java", inBody, regexp.MustCompile(`Apache Tomcat/\d|Whitelabel Error Page|Powered by Jetty|JBWEB\d+`)},
+	{"php", inBody, regexp.MustCompile(`No input file specified\.|<b>(?:Warning|Fatal error)</b>:.* on line <b>\d+</b>`)},
+	{"python", inBody, regexp.MustCompile(`Using the URLconf defined in|<title>404 Not Found</title>\s*<h1>Not Found</h1>\s*<p>The requested URL was not found on the server\.`)},
+	{"ruby", inBody, regexp.MustCompile(`The page you were looking for doesn't exist`)},
+	{"node", inBody, regexp.MustCompile(`<pre>Cannot GET /`)},
+	{"coldfusion", inBody, regexp.MustCompile(`coldfusion\.runtime\.`)},
+	{"nginx", inBody, regexp.MustCompile(`<center>nginx[^<]*</center>`)},
+	{"apache", inBody, regexp.MustCompile(`<address>Apache/[^<]*</address>`)},
+}
+
+// Extensions worth requesting on a target running each technology
+var technologyExtensions = map[string][]string{
+	"php":        {"php"},
+	"aspnet":     {"aspx", "ashx", "asmx"},
+	"asp":        {"asp"},
+	"iis":        {"aspx", "asp"},
+	"java":       {"jsp", "do", "action"},
+	"coldfusion": {"cfm"},
+}
+
+// Fingerprinter works out what a target runs from its root and the
+// error pages of a few missing paths before a scan starts
+type Fingerprinter struct {
+	client       *http.Client
+	throttle     *Throttle
+	scope        *Scope
+	root         *url.URL
+	technologies map[string]bool
+	logger       logrus.FieldLogger
+}
+
+func NewFingerprinter(client *http.Client, throttle *Throttle, scope *Scope, target string, logger logrus.FieldLogger) (*Fingerprinter, error) {
+	root, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	return &Fingerprinter{client, throttle, scope, root, make(map[string]bool), logger}, nil
+}
+
+// Fetch requests the target and its probes, returning the technologies
+// found in sorted order. Missing paths are requested with and without
+// the extensions whose handlers have their own error pages
+func (fingerprinter *Fingerprinter) Fetch(ctx context.Context) []string {
+	missing := randomName()
+	probes := []string{"", missing, missing + ".php", missing + ".aspx", missing + ".jsp"}
+	for _, probe := range probes {
+		if ctx.Err() != nil {
+			break
+		}
+		u, _ := fingerprinter.root.Parse(probe)
+		fingerprinter.fetch(ctx, u.String())
+	}
+
+	technologies := make([]string, 0, len(fingerprinter.technologies))
+	for technology := range fingerprinter.technologies {
+		technologies = append(technologies, technology)
+	}
+	sort.Strings(technologies)
+	return technologies
+}
+
+func (fingerprinter *Fingerprinter) fetch(ctx context.Context, rawURL string) {
+	if fingerprinter.scope.Check(rawURL) != nil || !fingerprinter.throttle.Wait(ctx) {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return
+	}
+	res, err := fingerprinter.client.Do(req)
+	if err != nil {
+		fingerprinter.logger.Warnf("Error requesting %v", rawURL)
+		fingerprinter.logger.Warnf("%v", err)
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxFingerprintBody))
+	if err != nil {
+		fingerprinter.logger.Warnf("Error reading %v", rawURL)
+		fingerprinter.logger.Warnf("%v", err)
+	}
+
+	for _, signature := range signatures {
+		if fingerprinter.technologies[signature.technology] || !signature.matches(res, body) {
+			continue
+		}
+		fingerprinter.logger.Debugf("Found %v signature in the %v of %v", signature.technology, signature.in, rawURL)
+		fingerprinter.technologies[signature.technology] = true
+	}
+}
+
+func (signature *signature) matches(res *http.Response, body []byte) bool {
+	switch signature.in {
+	case inBody:
+		return signature.pattern.Match(body)
+	case inCookie:
+		for _, cookie := range res.Cookies() {
+			if signature.pattern.MatchString(cookie.Name) {
+				return true
+			}
+		}
+		return false
+	default:
+		for _, value := range res.Header.Values(signature.in) {
+			if signature.pattern.MatchString(value) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// A name no target should have, so its error page is the default one
+func randomName() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "gg-" + hex.EncodeToString(b)
+}
+
+// TechnologyExtensions returns the extensions for the technologies in
+// order, falling back to the default extensions when none have any
+func TechnologyExtensions(technologies []string) []string {
+	seen := make(map[string]bool)
+	extensions := make([]string, 0)
+	for _, technology := range technologies {
+		for _, ext := range technologyExtensions[technology] {
+			if !seen[ext] {
+				seen[ext] = true
+				extensions = append(extensions, ext)
+			}
+		}
+	}
+	if len(extensions) == 0 {
+		return DefaultOptions().Extensions
+	}
+	return extensions
+}
+
+// Replace the auto extension with the extensions of the technologies,
+// keeping any others given alongside it
+func resolveExtensions(extensions []string, technologies []string) []string {
+	resolved := make([]string, 0, len(extensions))
+	seen := make(map[string]bool)
+	for _, ext := range extensions {
+		replacements := []string{ext}
+		if ext == AutoExtensions {
+			replacements = TechnologyExtensions(technologies)
+		}
+		for _, replacement := range replacements {
+			if !seen[replacement] {
+				seen[replacement] = true
+				resolved = append(resolved, replacement)
+			}
+		}
+	}
+	return resolved
+}
+
+// Words from the wordlists in the directory named after each technology,
+// such as php.txt, those without a wordlist are skipped
+func technologyWords(directory string, technologies []string, logger logrus.FieldLogger) ([]string, error) {
+	words := make([]string, 0)
+	for _, technology := range technologies {
+		filename := filepath.Join(directory, technology+".txt")
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			continue
+		}
+		list, err := ReadWordlist(filename)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("Adding %v words from %v", len(list), filename)
+		words = append(words, list...)
+	}
+	return words, nil
+}
+
+func hasAutoExtensions(extensions []string) bool {
+	for _, ext := range extensions {
+		if ext == AutoExtensions {
+			return true
+		}
+	}
+	return false
+}
+
+// Add the words which aren't already in the wordlist, keeping its order
+func mergeWords(words []string, extra []string) []string {
+	seen := make(map[string]bool, len(words))
+	for _, word := range words {
+		seen[word] = true
+	}
+	merged := append([]string(nil), words...)
+	for _, word := range extra {
+		if word != "" && !seen[word] {
+			seen[word] = true
+			merged = append(merged, word)
+		}
+	}
+	return merged
+}
@@ -1,102 +1,315 @@
 package libgetgood
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"sync"
 	"time"
 
-	. "github.com/dpindur/get-good/logger"
+	logrus "github.com/sirupsen/logrus"
 )
 
-var TotalRequestCount int
-
+// Response is the result of a request, failed requests record the
+// class of error instead of a status. Responses are sent to the
+// coordinator by remote agents so are kept serialisable
 type Response struct {
-	Success  bool
-	Url      string
-	Response *http.Response
+	Success  bool          `json:"success"`
+	Url      string        `json:"url"`
+	Status   int           `json:"status"`
+	Size     int64         `json:"size"`
+	BodyHash string        `json:"bodyHash"`
+	Latency  time.Duration `json:"latency"`
+	Error    string        `json:"error,omitempty"`
+
+	// Redirects followed to reach the response, ending with where the
+	// response points if it's a redirect that wasn't followed
+	Redirects []Redirect `json:"redirects,omitempty"`
+
+	// Urls found in the response by the spider
+	Links []string `json:"links,omitempty"`
+
+	// Name of the detector whose signature the body matched, or the
+	// server whose directory listing it is, and the urls listed by the
+	// exposed file or listing
+	Detected string   `json:"detected,omitempty"`
+	Listed   []string `json:"listed,omitempty"`
+
+	// Similarity hash of the body of any response other than a 404 or
+	// a redirect
+	Simhash string `json:"simhash,omitempty"`
+
+	// Set when a detector checked the response and the body didn't
+	// match its signature, so it isn't a hit whatever its status
+	Unconfirmed bool `json:"unconfirmed,omitempty"`
+
+	// Set when the worker checked the response's host for case
+	// insensitivity by requesting it with its case swapped
+	CaseChecked     bool `json:"caseChecked,omitempty"`
+	CaseInsensitive bool `json:"caseInsensitive,omitempty"`
+
+	// Set when the request wasn't made as it differs only by case from
+	// one already made on a host which ignores case
+	CaseVariant bool `json:"caseVariant,omitempty"`
+
+	// Set when the worker refused to make the request
+	OutOfScope bool `json:"outOfScope,omitempty"`
 }
 
 type HttpWorker struct {
 	running      bool
 	wg           *sync.WaitGroup
-	haltChan     chan int
+	ctx          context.Context
+	cancel       context.CancelFunc
+	requestCtx   context.Context
 	db           *DBConn
+	client       *http.Client
+	scope        *Scope
+	spider       bool
+	detect       bool
+	caseChecker  *CaseChecker
+	supervisor   *Supervisor
 	requestChan  chan *Request
 	responseChan chan *Response
+	throttle     *Throttle
+	stats        *Stats
+	logger       logrus.FieldLogger
 }
 
-var client *http.Client
-
-func StartHttpWorker(wg *sync.WaitGroup, db *DBConn, requestChan chan *Request, responseChan chan *Response, timeout int) *HttpWorker {
-	ConfigureClient(timeout)
-	haltChan := make(chan int, 1)
-	httpWorker := &HttpWorker{true, wg, haltChan, db, requestChan, responseChan}
+// StartHttpWorker starts a worker which takes requests from the queue
+// until ctx is cancelled. In-flight requests are only aborted once
+// requestCtx is cancelled, allowing them to finish during shutdown.
+// Requests outside the scope are never made. When spidering, the links
+// in any response other than a 404 are returned with it. When detecting,
+// responses for the files the detectors check are matched against their
+// signatures. Directory indexes are always checked for listings. With a
+// case checker, the first hit on each host is requested again with its
+// case swapped to tell whether the host ignores case, after which queued
+// requests differing only by case from another are skipped
+func StartHttpWorker(ctx context.Context, requestCtx context.Context, wg *sync.WaitGroup, db *DBConn, client *http.Client, scope *Scope, spider bool, detect bool, caseChecker *CaseChecker, supervisor *Supervisor, requestChan chan *Request, responseChan chan *Response, throttle *Throttle, stats *Stats, logger logrus.FieldLogger) *HttpWorker {
+	ctx, cancel := context.WithCancel(ctx)
+	httpWorker := &HttpWorker{true, wg, ctx, cancel, requestCtx, db, client, scope, spider, detect, caseChecker, supervisor, requestChan, responseChan, throttle, stats, logger}
 	wg.Add(1)
 	go httpWorker.work()
 	return httpWorker
 }
 
 func (worker *HttpWorker) Stop() {
-	Logger.Debugf("Sending http worker stop signal")
-	worker.haltChan <- 0
+	worker.logger.Debugf("Sending http worker stop signal")
+	worker.cancel()
 }
 
 func (worker *HttpWorker) work() {
 	defer worker.wg.Done()
+	worker.supervisor.Supervise(worker.ctx, "http worker", worker.run)
+}
 
-	Logger.Debugf("Starting http worker")
+func (worker *HttpWorker) run() error {
+	worker.logger.Debugf("Starting http worker")
 	running := true
 	for running {
+		// Hold off taking anything from the queue while paused
+		// so queued requests are left for the remaining workers
+		if !worker.throttle.Wait(worker.ctx) {
+			running = false
+			break
+		}
+
 		select {
-		case <-worker.haltChan:
+		case <-worker.ctx.Done():
 			running = false
 			break
 		case request := <-worker.requestChan:
 			worker.processRequest(request)
 			break
-		default:
-			break
 		}
 	}
-	Logger.Debugf("Http worker stopped")
+	worker.logger.Debugf("Http worker stopped")
+	return nil
 }
 
 func (worker *HttpWorker) processRequest(request *Request) {
-	Logger.Debugf("Http worker requesting %v", request.Url)
-
-	res, err := client.Get(request.Url)
-	success := false
+	response := &Response{Url: request.Url}
+	err := worker.scope.Check(request.Url)
 	if err != nil {
-		Logger.Warnf("Error requesting %v", request.Url)
-		Logger.Warnf("%v", err)
+		worker.logger.Warnf("Refusing to request %v, %v", request.Url, err)
+		response.OutOfScope = true
+		worker.respond(response)
+		return
+	}
+	if worker.caseVariant(request.Url) {
+		worker.logger.Debugf("Skipping %v, a case variant of a request already made", request.Url)
+		response.CaseVariant = true
+		worker.respond(response)
+		return
+	}
+
+	worker.logger.Debugf("Http worker requesting %v", request.Url)
+	start := time.Now()
+	res, err := worker.get(request.Url)
+	if err != nil && worker.requestCtx.Err() != nil {
+		// Requests aborted during shutdown are left inflight to be
+		// reset once the scan has stopped, rather than marked failed
+		worker.logger.Debugf("Abandoned request %v", request.Url)
+		return
+	} else if err != nil {
+		worker.logger.Warnf("Error requesting %v", request.Url)
+		worker.logger.Warnf("%v", err)
+		response.Latency = time.Since(start)
+		response.Error = ClassifyError(err)
+		worker.stats.RecordError(err, response.Latency)
 	} else {
-		success = true
-		ioutil.ReadAll(res.Body)
-		res.Body.Close()
+		response.Success = true
+		response.Status = res.StatusCode
+		kind := ""
+		var detector *detector
+		if worker.spider && res.StatusCode != 404 {
+			kind = spiderKind(res)
+		}
+		if worker.detect && res.StatusCode != 404 {
+			detector = findDetector(request.Url)
+		}
+		listing := isListingCandidate(res)
+		similar := res.StatusCode != 404 && (res.StatusCode < 300 || res.StatusCode >= 400)
+		var body []byte
+		response.Size, response.BodyHash, body = readBody(res, kind != "" || detector != nil || listing || similar, worker.logger)
+		response.Redirects = redirectChain(res)
+		if similar {
+			response.Simhash = Simhash(body)
+		}
+		if kind != "" {
+			response.Links = extractLinks(res.Request.URL, kind, body)
+		}
+		if detector != nil {
+			matched, listed := detector.detect(request.Url, body)
+			if matched {
+				response.Detected = detector.name
+				response.Listed = listed
+			} else {
+				response.Unconfirmed = true
+			}
+		}
+		if listing {
+			server, entries := parseListing(res.Request.URL, body)
+			if server != "" {
+				response.Detected = server + " directory listing"
+				response.Listed = entries
+			}
+		}
+		response.Latency = time.Since(start)
+		worker.stats.RecordResponse(res.StatusCode, response.Latency)
+		if worker.caseChecker != nil && res.StatusCode == 200 && len(response.Redirects) == 0 && !response.Unconfirmed {
+			worker.checkCase(request.Url, response)
+		}
 	}
-	TotalRequestCount++
-	worker.responseChan <- &Response{success, request.Url, res}
+	worker.respond(response)
 }
 
-func ConfigureClient(timeout int) {
-	if client == nil {
-		client = &http.Client{
-			CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
-			Transport: &http.Transport{
-				MaxIdleConns:        200,
-				MaxIdleConnsPerHost: 200,
-				TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
-			},
-			Timeout: time.Duration(timeout) * time.Second,
-		}
+// Request a hit again with its case swapped, the host ignores case if
+// the same or a near identical response comes back
+func (worker *HttpWorker) checkCase(rawURL string, response *Response) {
+	flipped, ok := flipCase(rawURL)
+	origin := urlOrigin(rawURL)
+	if !ok || worker.scope.Check(flipped) != nil || !worker.caseChecker.claim(origin) {
+		return
+	}
+	if !worker.throttle.Wait(worker.ctx) {
+		worker.caseChecker.release(origin, false, false)
+		return
+	}
+
+	worker.logger.Debugf("Checking %v for case insensitivity with %v", origin, flipped)
+	res, err := worker.get(flipped)
+	if err != nil {
+		worker.logger.Debugf("Error requesting %v", flipped)
+		worker.logger.Debugf("%v", err)
+		worker.caseChecker.release(origin, false, false)
+		return
+	}
+	_, bodyHash, body := readBody(res, true, worker.logger)
+	response.CaseChecked = true
+	response.CaseInsensitive = res.StatusCode == response.Status && len(redirectChain(res)) == 0 &&
+		(bodyHash == response.BodyHash || similarSimhash(Simhash(body), response.Simhash))
+	worker.caseChecker.release(origin, true, response.CaseInsensitive)
+}
+
+// Whether a queued request differs only by case from one already made on
+// a host which ignores case. Agents have no database and leave these to
+// be pruned by the coordinator
+func (worker *HttpWorker) caseVariant(rawURL string) bool {
+	if worker.db == nil || worker.caseChecker == nil || !worker.caseChecker.ignoresCase(rawURL) {
+		return false
+	}
+	variant, err := worker.db.IsCaseVariant(rawURL)
+	if err != nil {
+		worker.logger.Errorf("Error checking %v for case variants", rawURL)
+		worker.logger.Errorf("%v", err)
+		return false
+	}
+	return variant
+}
+
+func (worker *HttpWorker) respond(response *Response) {
+	select {
+	case worker.responseChan <- response:
+		break
+	case <-worker.requestCtx.Done():
+		break
 	}
 }
 
-func CleanupClient() {
-	if client != nil {
-		tr := client.Transport.(*http.Transport)
-		tr.CloseIdleConnections()
+// Read and hash the response body, keeping the start of it when it's
+// to be parsed by the spider, checked by a detector or for a listing or
+// given a similarity hash
+func readBody(res *http.Response, keep bool, logger logrus.FieldLogger) (int64, string, []byte) {
+	hash := sha256.New()
+	var body []byte
+	var err error
+	if keep {
+		body, err = ioutil.ReadAll(io.LimitReader(res.Body, maxSpiderBody))
+		hash.Write(body)
+	}
+	size := int64(len(body))
+	if err == nil {
+		var rest int64
+		rest, err = io.Copy(hash, res.Body)
+		size += rest
+	}
+	res.Body.Close()
+	if err != nil {
+		logger.Debugf("Error reading response body")
+		logger.Debugf("%v", err)
 	}
+	return size, hex.EncodeToString(hash.Sum(nil)), body
+}
+
+func (worker *HttpWorker) get(url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(worker.requestCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return worker.client.Do(req)
+}
+
+// NewClient creates the http client shared by a scanner's workers,
+// following redirects according to the policy
+func NewClient(timeout int, redirects RedirectPolicy, maxRedirects int, scope *Scope, logger logrus.FieldLogger) *http.Client {
+	return &http.Client{
+		CheckRedirect: checkRedirect(redirects, maxRedirects, scope, logger),
+		Transport: &http.Transport{
+			MaxIdleConns:        200,
+			MaxIdleConnsPerHost: 200,
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		},
+		Timeout: time.Duration(timeout) * time.Second,
+	}
+}
+
+func CleanupClient(client *http.Client) {
+	tr := client.Transport.(*http.Transport)
+	tr.CloseIdleConnections()
 }
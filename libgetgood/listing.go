@@ -0,0 +1,66 @@
+package libgetgood
+
+import (
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Autoindex pages recognised by their markup, checked in order as the
+// generic pattern matches several servers' pages
+var listingPatterns = []struct {
+	server  string
+	pattern *regexp.Regexp
+}{
+	{"python", regexp.MustCompile(`(?is)<title>Directory listing for /`)},
+	{"iis", regexp.MustCompile(`(?is)<h1>[^<]* - /[^<]*</h1>\s*<hr>\s*<pre>`)},
+	{"nginx", regexp.MustCompile(`(?is)<h1>Index of /.*?<pre>\s*<a href="\.\./">\.\./</a>`)},
+	{"lighttpd", regexp.MustCompile(`(?is)<title>Index of /.*?<div class="list">`)},
+	{"apache", regexp.MustCompile(`(?is)<h1>Index of /.*?(?:Parent Directory|\?C=N;O=D|<address>Apache)`)},
+	{"autoindex", regexp.MustCompile(`(?is)<title>Index of /.*?<h1>Index of /`)},
+}
+
+var hrefPattern = regexp.MustCompile(`(?i)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+
+// Only the index of a directory, an html page at a path ending in a
+// slash, can be a listing
+func isListingCandidate(res *http.Response) bool {
+	return res.StatusCode == 200 && strings.HasSuffix(res.Request.URL.Path, "/") &&
+		strings.Contains(strings.ToLower(res.Header.Get("Content-Type")), "html")
+}
+
+// Returns the server whose autoindex page the body is, or blank if it
+// isn't a listing, along with the urls of the entries it lists. Sort
+// links, the parent directory and anything else outside the directory
+// are left out
+func parseListing(base *url.URL, body []byte) (string, []string) {
+	server := ""
+	for _, listing := range listingPatterns {
+		if listing.pattern.Match(body) {
+			server = listing.server
+			break
+		}
+	}
+	if server == "" {
+		return "", nil
+	}
+
+	directory := base.Scheme + "://" + base.Host + base.EscapedPath()
+	seen := make(map[string]bool)
+	entries := make([]string, 0)
+	for _, match := range hrefPattern.FindAllStringSubmatch(string(body), -1) {
+		link, ok := resolveLink(base, html.UnescapeString(match[1]+match[2]+match[3]))
+		if !ok || seen[link] || !strings.HasPrefix(link, directory) {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(link, directory), "/")
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		seen[link] = true
+		entries = append(entries, link)
+	}
+	return server, entries
+}
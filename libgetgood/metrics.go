@@ -0,0 +1,122 @@
+package libgetgood
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// MetricsServer exposes the statistics of the current scan in the
+// Prometheus text exposition format
+type MetricsServer struct {
+	server     *http.Server
+	listener   net.Listener
+	controller *Controller
+	logger     logrus.FieldLogger
+}
+
+func StartMetricsServer(addr string, controller *Controller, logger logrus.FieldLogger) (*MetricsServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	server := &http.Server{Addr: addr, Handler: mux}
+	metrics := &MetricsServer{server, listener, controller, logger}
+	mux.HandleFunc("/metrics", metrics.handleMetrics)
+	go metrics.work()
+	return metrics, nil
+}
+
+func (metrics *MetricsServer) Stop() {
+	metrics.logger.Debugf("Sending metrics server stop signal")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	metrics.server.Shutdown(ctx)
+}
+
+func (metrics *MetricsServer) work() {
+	metrics.logger.Debugf("Starting metrics server on %v", metrics.server.Addr)
+	err := metrics.server.Serve(metrics.listener)
+	if err != nil && err != http.ErrServerClosed {
+		metrics.logger.Errorf("Error in metrics server")
+		metrics.logger.Errorf("%v", err)
+	}
+	metrics.logger.Debugf("Metrics server stopped")
+}
+
+func (metrics *MetricsServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	b := bufio.NewWriter(w)
+	defer b.Flush()
+
+	scan := metrics.controller.Scanner()
+	if scan == nil {
+		return
+	}
+	stats := scan.Stats()
+
+	statusCounts := stats.StatusCounts()
+	statuses := make([]int, 0, len(statusCounts))
+	for status := range statusCounts {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	writeHeader(b, "getgood_requests_total", "counter", "Completed http requests by response status")
+	for _, status := range statuses {
+		fmt.Fprintf(b, "getgood_requests_total{status=\"%v\"} %v\n", status, statusCounts[status])
+	}
+
+	errorCounts := stats.ErrorCounts()
+	classes := make([]string, 0, len(errorCounts))
+	for class := range errorCounts {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	writeHeader(b, "getgood_request_errors_total", "counter", "Failed http requests by error class")
+	for _, class := range classes {
+		fmt.Fprintf(b, "getgood_request_errors_total{class=%q} %v\n", class, errorCounts[class])
+	}
+
+	writeHistogram(b, "getgood_request_duration_seconds", "Time taken to complete http requests", stats.LatencyHistogram())
+	writeHistogram(b, "getgood_db_write_duration_seconds", "Time taken to write to the database", stats.DBWriteHistogram())
+
+	progress := stats.Progress()
+	requestQueue, responseQueue := scan.QueueDepths()
+	writeGauge(b, "getgood_request_queue_depth", "Requests waiting for an http worker", requestQueue)
+	writeGauge(b, "getgood_response_queue_depth", "Responses waiting to be written to the database", responseQueue)
+	writeGauge(b, "getgood_remaining_requests", "Requests not yet completed", progress.Remaining)
+	writeGauge(b, "getgood_completed_requests", "Requests completed", progress.Completed)
+	writeGauge(b, "getgood_failed_requests", "Requests which failed", progress.Failed)
+	writeGauge(b, "getgood_total_requests", "Requests known about", progress.Total)
+}
+
+func writeHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, metricType)
+}
+
+func writeGauge(w io.Writer, name string, help string, value int) {
+	writeHeader(w, name, "gauge", help)
+	fmt.Fprintf(w, "%v %v\n", name, value)
+}
+
+func writeHistogram(w io.Writer, name string, help string, histogram *Histogram) {
+	writeHeader(w, name, "histogram", help)
+	for i, bound := range histogram.Bounds {
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		fmt.Fprintf(w, "%v_bucket{le=\"%v\"} %v\n", name, le, histogram.Counts[i])
+	}
+	fmt.Fprintf(w, "%v_bucket{le=\"+Inf\"} %v\n", name, histogram.Count)
+	fmt.Fprintf(w, "%v_sum %v\n", name, strconv.FormatFloat(histogram.Sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%v_count %v\n", name, histogram.Count)
+}
@@ -1,92 +1,149 @@
 package libgetgood
 
 import (
+	"context"
 	"sync"
 	"time"
 
-	. "github.com/dpindur/get-good/logger"
-	ui "github.com/dpindur/get-good/ui"
+	logrus "github.com/sirupsen/logrus"
 )
 
 type Monitor struct {
 	running          bool
 	wg               *sync.WaitGroup
-	haltChan         chan int
+	ctx              context.Context
+	cancel           context.CancelFunc
 	db               *DBConn
-	terminal         *ui.Terminal
-	errChan          chan *WorkerError
+	supervisor       *Supervisor
 	bustCompleteChan chan int
+	expander         *Expander
+	stats            *Stats
+	reportFunc       func(*Report)
 	requestsCounted  int
 	timeChecked      time.Time
+	smoothedRate     float64
+	report           *Report
+	logger           logrus.FieldLogger
 }
 
-func StartMonitor(wg *sync.WaitGroup, db *DBConn, terminal *ui.Terminal, errChan chan *WorkerError, bustCompleteChan chan int) *Monitor {
-	haltChan := make(chan int)
-	monitor := &Monitor{true, wg, haltChan, db, terminal, errChan, bustCompleteChan, 0, time.Now()}
+// Weight given to the latest sample when smoothing the request rate
+const rateSmoothing = 0.3
+
+// Number of the directories with requests queued included in each report
+const reportedTargets = 10
+
+func StartMonitor(ctx context.Context, wg *sync.WaitGroup, db *DBConn, stats *Stats, reportFunc func(*Report), supervisor *Supervisor, bustCompleteChan chan int, expander *Expander, logger logrus.FieldLogger) *Monitor {
+	ctx, cancel := context.WithCancel(ctx)
+	monitor := &Monitor{true, wg, ctx, cancel, db, supervisor, bustCompleteChan, expander, stats, reportFunc, 0, time.Now(), 0, nil, logger}
 	wg.Add(1)
 	go monitor.work()
 	return monitor
 }
 
 func (monitor *Monitor) Stop() {
-	Logger.Debugf("Sending monitor stop signal")
-	monitor.haltChan <- 0
+	monitor.logger.Debugf("Sending monitor stop signal")
+	monitor.cancel()
 }
 
 func (monitor *Monitor) work() {
 	defer monitor.wg.Done()
+	monitor.supervisor.Supervise(monitor.ctx, "monitor", monitor.run)
+}
 
-	Logger.Debugf("Starting monitor")
+func (monitor *Monitor) run() error {
+	monitor.logger.Debugf("Starting monitor")
 	running := true
+	var err error
 	for running {
 		select {
-		case <-monitor.haltChan:
+		case <-monitor.ctx.Done():
 			running = false
 			break
-		default:
-			time.Sleep(3 * time.Second)
-			monitor.logRequestsPerSecond()
-
-			err := monitor.checkRemainingRequests()
-			if err != nil {
-				running = false
-				monitor.errChan <- &WorkerError{"monitor", err}
-			}
-
-			err = monitor.checkCompletedRequests()
-			if err != nil {
-				running = false
-				monitor.errChan <- &WorkerError{"monitor", err}
-			}
-
-			err = monitor.checkFailedRequests()
+		case <-time.After(3 * time.Second):
+			err = monitor.check()
 			if err != nil {
 				running = false
-				monitor.errChan <- &WorkerError{"monitor", err}
 			}
 			break
 		}
 	}
-	Logger.Debugf("Monitor stopped")
+	monitor.logger.Debugf("Monitor stopped")
+	return err
+}
+
+func (monitor *Monitor) check() error {
+	monitor.report = &Report{}
+	monitor.logRequestsPerSecond()
+
+	err := monitor.checkRemainingRequests()
+	if err != nil {
+		return err
+	}
+
+	err = monitor.checkCompletedRequests()
+	if err != nil {
+		return err
+	}
+
+	err = monitor.checkFailedRequests()
+	if err != nil {
+		return err
+	}
+
+	err = monitor.checkTargetProgress()
+	if err != nil {
+		return err
+	}
+
+	monitor.updateStatistics()
+	monitor.stats.SetProgress(monitor.report.Progress)
+	monitor.reportFunc(monitor.report)
+	return nil
 }
 
 func (monitor *Monitor) logRequestsPerSecond() {
-	requestDiff := TotalRequestCount - monitor.requestsCounted
+	requestDiff := monitor.stats.Requests() - monitor.requestsCounted
 	duration := time.Since(monitor.timeChecked).Seconds()
 
 	monitor.timeChecked = time.Now()
 	monitor.requestsCounted += requestDiff
-	monitor.terminal.SetRequestsPerSecond(requestDiff / int(duration))
+
+	rate := float64(requestDiff) / duration
+	if monitor.smoothedRate == 0 {
+		monitor.smoothedRate = rate
+	} else {
+		monitor.smoothedRate = rateSmoothing*rate + (1-rateSmoothing)*monitor.smoothedRate
+	}
+	monitor.report.RequestsPerSecond = rate
 }
 
 func (monitor *Monitor) checkRemainingRequests() error {
+	// Directories waiting to be expanded will add more requests. The
+	// updater queues a response's expansions before recording it, so if
+	// nothing was queued while the requests were counted, none completed
+	// in between can have more to add
+	queued := monitor.expander.Queued()
+	pending := monitor.expander.Pending()
 	remainingReqs, err := monitor.db.GetRemainingRequestCount()
 	if err != nil {
 		return err
 	}
+	settled := pending == 0 && monitor.expander.Queued() == queued
 
-	if remainingReqs == 0 {
-		monitor.bustCompleteChan <- 0
+	monitor.report.Remaining = remainingReqs
+	if remainingReqs == 0 && settled {
+		select {
+		case monitor.bustCompleteChan <- 0:
+			break
+		default:
+			break
+		}
+	}
+
+	// Estimate time remaining from the smoothed rate, a zero
+	// duration means the estimate is unknown
+	if monitor.smoothedRate > 0 {
+		monitor.report.ETA = time.Duration(float64(remainingReqs)/monitor.smoothedRate) * time.Second
 	}
 
 	return nil
@@ -103,7 +160,8 @@ func (monitor *Monitor) checkCompletedRequests() error {
 		return err
 	}
 
-	monitor.terminal.SetCompletedRequests(completedReqs, totalReqs)
+	monitor.report.Completed = completedReqs
+	monitor.report.Total = totalReqs
 	return nil
 }
 
@@ -113,6 +171,23 @@ func (monitor *Monitor) checkFailedRequests() error {
 		return err
 	}
 
-	monitor.terminal.SetFailedRequests(failedReqs)
+	monitor.report.Failed = failedReqs
+	return nil
+}
+
+func (monitor *Monitor) checkTargetProgress() error {
+	targets, err := monitor.db.GetTargetProgress(reportedTargets)
+	if err != nil {
+		return err
+	}
+
+	monitor.report.Targets = targets
 	return nil
 }
+
+func (monitor *Monitor) updateStatistics() {
+	monitor.report.LatencyP50, monitor.report.LatencyP95, monitor.report.LatencyP99 = monitor.stats.LatencyPercentiles()
+	monitor.report.Depth, monitor.report.MaxDepth = monitor.stats.Depth()
+	monitor.report.StatusCounts = monitor.stats.StatusCounts()
+	monitor.report.ErrorCounts = monitor.stats.ErrorCounts()
+}
@@ -0,0 +1,74 @@
+package libgetgood
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/dpindur/get-good/logger"
+)
+
+// An expander which queues expansions but never gets to adding them
+func slowExpander() *Expander {
+	return &Expander{mutex: &sync.Mutex{}, pending: make([]*expansion, 0), signalChan: make(chan int, 1), logger: Logger}
+}
+
+// The last recursive hit queuing its expansion and being recorded while
+// the monitor is counting the remaining requests mustn't finish the scan
+// with the expansion lost
+func TestMonitorWaitsForExpansionQueuedDuringCheck(t *testing.T) {
+	db := testDatabase(t)
+	defer db.CloseDatabaseConnection()
+
+	root := "http://localhost/"
+	err := db.AddRequests(root, []string{root + "a/"}, []int{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetRequestsInflight([]string{root + "a/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expander := slowExpander()
+	monitor := &Monitor{db: db, expander: expander, bustCompleteChan: make(chan int, 1), report: &Report{}, logger: Logger}
+
+	// Holding the database stops the monitor between checking for pending
+	// expansions and counting the remaining requests
+	db.mutex.Lock()
+	done := make(chan error, 1)
+	go func() {
+		done <- monitor.checkRemainingRequests()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// The updater queues the expansion then records the response
+	expander.Expand(root + "a/")
+	_, err = db.exec("UPDATE requests SET status = ?, httpStatus = 200 WHERE uri = ?", Processed, root+"a/")
+	db.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-monitor.bustCompleteChan:
+		t.Fatal("scan finished with an expansion outstanding")
+	default:
+	}
+
+	// Once the expansion is done and nothing is left the scan finishes
+	expander.pending = expander.pending[:0]
+	err = monitor.checkRemainingRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-monitor.bustCompleteChan:
+	default:
+		t.Fatal("scan never finished with nothing left to do")
+	}
+}
@@ -1,87 +1,115 @@
 package libgetgood
 
 import (
+	"context"
 	"sync"
 	"time"
 
-	. "github.com/dpindur/get-good/logger"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// Time between polls, shortened while the queue is being drained faster
+// than a single poll can fill it
+const (
+	pollInterval     = 1 * time.Second
+	busyPollInterval = 100 * time.Millisecond
 )
 
 type Poller struct {
 	running     bool
 	wg          *sync.WaitGroup
-	haltChan    chan int
+	ctx         context.Context
+	cancel      context.CancelFunc
 	db          *DBConn
 	batchSize   int
-	errChan     chan *WorkerError
+	supervisor  *Supervisor
 	requestChan chan *Request
+	stats       *Stats
+	logger      logrus.FieldLogger
 }
 
-func StartPoller(wg *sync.WaitGroup, db *DBConn, batchSize int, errChan chan *WorkerError, requestChan chan *Request) *Poller {
-	haltChan := make(chan int)
-	poller := &Poller{true, wg, haltChan, db, batchSize, errChan, requestChan}
+func StartPoller(ctx context.Context, wg *sync.WaitGroup, db *DBConn, batchSize int, supervisor *Supervisor, requestChan chan *Request, stats *Stats, logger logrus.FieldLogger) *Poller {
+	ctx, cancel := context.WithCancel(ctx)
+	poller := &Poller{true, wg, ctx, cancel, db, batchSize, supervisor, requestChan, stats, logger}
 	wg.Add(1)
 	go poller.work()
 	return poller
 }
 
 func (poller *Poller) Stop() {
-	Logger.Debugf("Sending database poller stop signal")
-	poller.haltChan <- 0
+	poller.logger.Debugf("Sending database poller stop signal")
+	poller.cancel()
 }
 
 func (poller *Poller) work() {
 	defer poller.wg.Done()
+	poller.supervisor.Supervise(poller.ctx, "poller", poller.run)
+}
 
-	Logger.Debugf("Starting database poller")
+func (poller *Poller) run() error {
+	poller.logger.Debugf("Starting database poller")
 	running := true
+	delay := pollInterval
+	var err error
 	for running {
 		select {
-		case <-poller.haltChan:
+		case <-poller.ctx.Done():
 			running = false
 			break
-		default:
-			time.Sleep(1 * time.Second)
-			err := poller.pollDatabase()
+		case <-time.After(delay):
+			var full bool
+			full, err = poller.pollDatabase()
 			if err != nil {
 				running = false
-				poller.errChan <- &WorkerError{"poller", err}
+			}
+
+			// A full batch means there is likely more work waiting
+			delay = pollInterval
+			if full {
+				delay = busyPollInterval
 			}
 			break
 		}
 	}
-	Logger.Debugf("Database poller stopped")
+	poller.logger.Debugf("Database poller stopped")
+	return err
 }
 
-func (poller *Poller) pollDatabase() error {
-	Logger.Debugf("Polling")
-	requests, err := poller.db.GetIncompleteRequests(poller.batchSize)
+// Poll the database for requests, returns true if as many requests were
+// found as could be queued
+func (poller *Poller) pollDatabase() (bool, error) {
+	// Only take as many requests as there is room for on the queue,
+	// anything set inflight is then guaranteed to reach a worker
+	free := cap(poller.requestChan) - len(poller.requestChan)
+	if free > poller.batchSize {
+		free = poller.batchSize
+	}
+	if free == 0 {
+		poller.logger.Debugf("Request queue full, skipping poll")
+		return true, nil
+	}
+
+	poller.logger.Debugf("Polling")
+	requests, err := poller.db.GetIncompleteRequests(free)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	Logger.Debugf("Setting requests inflight")
+	poller.logger.Debugf("Setting requests inflight")
+	start := time.Now()
 	err = poller.db.SetRequestsInflight(requests)
+	poller.stats.RecordDBWrite(time.Since(start))
 	if err != nil {
-		return err
+		return false, err
 	}
-	Logger.Debugf("Requests set inflight")
+	poller.logger.Debugf("Requests set inflight")
 
-	// Adding a request to the queue will block if the queue is full
-	// in this case we pause the poller for a bit and then return.
-	// Any incomplete requests we were looking at will just be
-	// picked up during the next poll
-	Logger.Debugf("Placing requests on queue")
+	// The poller is the only sender so these never block
+	poller.logger.Debugf("Placing requests on queue")
 	for _, url := range requests {
-		select {
-		case poller.requestChan <- &Request{url}:
-			break
-		default:
-			Logger.Debugf("Request queue full, pausing poller for five seconds...")
-			time.Sleep(5 * time.Second)
-		}
+		poller.requestChan <- &Request{url}
 	}
-	Logger.Debugf("Requests placed on queue")
+	poller.logger.Debugf("Requests placed on queue")
 
-	return nil
+	return len(requests) == free, nil
 }
@@ -0,0 +1,150 @@
+package libgetgood
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Strategy decides the order requests are made in
+type Strategy string
+
+const (
+	// Finish each level of directories before going deeper
+	StrategyBreadth Strategy = "breadth"
+	// Finish each directory found before moving on to the rest
+	StrategyDepth Strategy = "depth"
+	// Short words and directories which are producing hits first
+	StrategyPromising Strategy = "promising"
+)
+
+var strategies = []Strategy{StrategyBreadth, StrategyDepth, StrategyPromising}
+
+// Priority added to words on the boost list, above anything a strategy gives
+const boostPriority = 1000000
+
+// Priority of paths read from robots.txt, sitemaps and the other files
+// a scan is seeded from, above anything else
+const seedPriority = 2 * boostPriority
+
+// Priority of the files the detectors check for and the paths exposed
+// files list, ahead of everything but seeds
+const detectorPriority = boostPriority + boostPriority/2
+
+// Priority of the index of a directory found through a redirect, it's
+// requested to check for a listing before the directory is expanded
+const indexPriority = boostPriority
+
+// Priority lost for each directory a request is beneath
+const levelPriority = 1000
+
+// Priority added by the promising strategy to requests beneath a
+// directory that was found, so new directories are explored early
+const directoryPriority = 30
+
+// Priority lost by the promising strategy for each directory a
+// request is beneath
+const promisingLevelPriority = 5
+
+// Priority added by the promising strategy to the remaining requests
+// in a directory each time one of them is a hit
+const hitPriority = 10
+
+// Words at least this long get no priority for being short
+const shortWordLength = 20
+
+// Priority added by the promising strategy to words without an extension,
+// as they may be directories to recurse into
+const blankSuffixPriority = 5
+
+// Priority added to paths found by the spider, ahead of the wordlist
+// requests at the same depth
+const discoveredPriority = 100
+
+func ParseStrategy(str string) (Strategy, error) {
+	for _, strategy := range strategies {
+		if string(strategy) == str {
+			return strategy, nil
+		}
+	}
+	names := make([]string, 0, len(strategies))
+	for _, strategy := range strategies {
+		names = append(names, string(strategy))
+	}
+	return "", fmt.Errorf("unknown strategy %q, expected %v", str, strings.Join(names, ", "))
+}
+
+// Prioritiser works out the priority of requests, higher priorities
+// are requested first
+type Prioritiser struct {
+	strategy Strategy
+	boost    map[string]bool
+}
+
+func NewPrioritiser(strategy Strategy, boost []string) *Prioritiser {
+	boosted := make(map[string]bool)
+	for _, word := range boost {
+		word = strings.TrimSpace(word)
+		if word != "" {
+			boosted[word] = true
+		}
+	}
+	return &Prioritiser{strategy, boosted}
+}
+
+// Priority of requesting word with suffix appended in a directory the
+// given number of levels beneath the root
+func (prioritiser *Prioritiser) Priority(depth int, word string, suffix string) int {
+	priority := 0
+	switch prioritiser.strategy {
+	case StrategyDepth:
+		priority = depth * levelPriority
+	case StrategyPromising:
+		if depth > 0 {
+			priority = directoryPriority - depth*promisingLevelPriority
+		}
+		if len(word) < shortWordLength {
+			priority += shortWordLength - len(word)
+		}
+		if suffix == "" {
+			priority += blankSuffixPriority
+		}
+	default:
+		priority = -depth * levelPriority
+	}
+
+	if prioritiser.boost[word] {
+		priority += boostPriority
+	}
+	return priority
+}
+
+// DiscoveredPriority of a path found by the spider in a directory the
+// given number of levels beneath the root
+func (prioritiser *Prioritiser) DiscoveredPriority(depth int) int {
+	return prioritiser.Priority(depth, "", "") + discoveredPriority
+}
+
+// SeedPriority of a path read from one of the files a scan is seeded from
+func (prioritiser *Prioritiser) SeedPriority() int {
+	return seedPriority
+}
+
+// DetectorPriority of a file the detectors check for, or a path listed
+// by an exposed file
+func (prioritiser *Prioritiser) DetectorPriority() int {
+	return detectorPriority
+}
+
+// IndexPriority of the index of a directory found through a redirect
+func (prioritiser *Prioritiser) IndexPriority() int {
+	return indexPriority
+}
+
+// HitPriority is added to the remaining requests of a directory each
+// time a hit is found in it
+func (prioritiser *Prioritiser) HitPriority() int {
+	if prioritiser.strategy == StrategyPromising {
+		return hitPriority
+	}
+	return 0
+}
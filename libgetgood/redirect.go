@@ -0,0 +1,119 @@
+package libgetgood
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// RedirectPolicy decides which redirects the http workers follow
+type RedirectPolicy string
+
+const (
+	// Record where redirects point without following them
+	RedirectNone RedirectPolicy = "none"
+	// Follow redirects which stay on the same host
+	RedirectSameHost RedirectPolicy = "same-host"
+	// Follow any redirect which stays in scope
+	RedirectAll RedirectPolicy = "all"
+)
+
+var redirectPolicies = []RedirectPolicy{RedirectNone, RedirectSameHost, RedirectAll}
+
+func ParseRedirectPolicy(str string) (RedirectPolicy, error) {
+	for _, policy := range redirectPolicies {
+		if string(policy) == str {
+			return policy, nil
+		}
+	}
+	names := make([]string, 0, len(redirectPolicies))
+	for _, policy := range redirectPolicies {
+		names = append(names, string(policy))
+	}
+	return "", fmt.Errorf("unknown redirect policy %q, expected %v", str, strings.Join(names, ", "))
+}
+
+// Redirect is one hop of a redirect chain, the status of the redirect
+// response and the url it pointed to
+type Redirect struct {
+	Status int    `json:"status"`
+	Url    string `json:"url"`
+}
+
+// Build the client's redirect check. A redirect which isn't followed
+// leaves its response as the final response rather than failing the
+// request, so where it pointed is still recorded. Every hop followed
+// must be in scope
+func checkRedirect(policy RedirectPolicy, maxRedirects int, scope *Scope, logger logrus.FieldLogger) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if policy != RedirectSameHost && policy != RedirectAll {
+			return http.ErrUseLastResponse
+		}
+		from := via[len(via)-1].URL
+		if len(via) > maxRedirects {
+			logger.Debugf("Not following redirect from %v to %v, more than %v redirects", from, req.URL, maxRedirects)
+			return http.ErrUseLastResponse
+		}
+		if policy == RedirectSameHost && !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+			logger.Debugf("Not following redirect from %v to %v, different host", from, req.URL)
+			return http.ErrUseLastResponse
+		}
+		err := scope.Check(req.URL.String())
+		if err != nil {
+			logger.Infof("Not following redirect from %v to %v, %v", from, req.URL, err)
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+}
+
+// Returns the redirects followed to reach the response, ending with
+// where the response itself points if it's a redirect
+func redirectChain(res *http.Response) []Redirect {
+	chain := make([]Redirect, 0)
+	for r := res; r.Request != nil && r.Request.Response != nil; r = r.Request.Response {
+		chain = append(chain, Redirect{r.Request.Response.StatusCode, r.Request.URL.String()})
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+
+	location, err := res.Location()
+	if err == nil && res.StatusCode >= 300 && res.StatusCode < 400 {
+		chain = append(chain, Redirect{res.StatusCode, location.String()})
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+	return chain
+}
+
+// A redirect from a path to the same path with a trailing slash is how
+// most servers answer a request for a directory
+func isDirectoryRedirect(res *Response) bool {
+	return len(res.Redirects) > 0 && !strings.HasSuffix(res.Url, "/") && res.Redirects[0].Url == res.Url+"/"
+}
+
+// Redirect chains are stored as json, nil when there were no redirects
+func encodeRedirects(redirects []Redirect) (interface{}, error) {
+	if len(redirects) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(redirects)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func decodeRedirects(data string) ([]Redirect, error) {
+	if data == "" {
+		return nil, nil
+	}
+	redirects := make([]Redirect, 0)
+	err := json.Unmarshal([]byte(data), &redirects)
+	return redirects, err
+}
@@ -0,0 +1,137 @@
+package libgetgood
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// WordlistHash returns a hash of the words, used to tell whether a
+// resumed scan's wordlist has changed even if the file hasn't moved
+func WordlistHash(words []string) string {
+	hash := sha256.New()
+	for _, word := range words {
+		hash.Write([]byte(word))
+		hash.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Compare the options with those stored by the scan already in the
+// database. Anything which would mix two different scans is refused,
+// unless extending the scan with new words or extensions
+func checkResume(db *DBConn, options *Options, wordlistHash string, logger logrus.FieldLogger) error {
+	stored, err := db.LoadOptions()
+	if err != nil {
+		return fmt.Errorf("error loading stored options: %v", err)
+	}
+	if stored == nil {
+		total, err := db.GetTotalRequestCount()
+		if err != nil {
+			return fmt.Errorf("error counting requests: %v", err)
+		}
+		if total > 0 {
+			logger.Warnf("Database has no stored settings, unable to check the wordlist and extensions are unchanged")
+		}
+		return nil
+	}
+
+	storedHash, err := db.LoadWordlistHash()
+	if err != nil {
+		return fmt.Errorf("error loading stored wordlist hash: %v", err)
+	}
+
+	if stored.URL != options.URL {
+		return fmt.Errorf("database holds a directory bust of %v not %v, clear the database to start a new one", stored.URL, options.URL)
+	}
+	if stored.Recurse != options.Recurse {
+		logger.Warnf("Recursion changed from %v to %v, directories already found are unaffected", stored.Recurse, options.Recurse)
+	}
+
+	extensionsChanged := !sameSuffixes(stored.suffixes(), options.suffixes())
+	wordlistChanged := storedHash != "" && storedHash != wordlistHash
+	if options.Extend {
+		pruned, err := db.IsPruned()
+		if err != nil {
+			return fmt.Errorf("error checking whether the database was pruned: %v", err)
+		}
+		if pruned {
+			return errors.New("database has been pruned, extending it would request the pruned urls again, clear the database to start a new directory bust")
+		}
+		if !extensionsChanged && !wordlistChanged {
+			logger.Warnf("Wordlist and extensions are unchanged, there is nothing new to extend the directory bust with")
+		}
+		return nil
+	}
+
+	if extensionsChanged {
+		return fmt.Errorf("extensions changed from %v to %v, extend the directory bust to add the new extensions", strings.Join(stored.Extensions, ","), strings.Join(options.Extensions, ","))
+	}
+	if wordlistChanged {
+		return errors.New("wordlist has changed since the directory bust was started, extend the directory bust to add the new words")
+	}
+	if storedHash == "" {
+		logger.Warnf("Database has no stored wordlist hash, unable to check the wordlist is unchanged")
+	} else if stored.Wordlist != options.Wordlist {
+		logger.Warnf("Wordlist moved from %v to %v, its contents are unchanged", stored.Wordlist, options.Wordlist)
+	}
+	return nil
+}
+
+// Reorder the remaining wordlist requests of a resumed scan when the
+// strategy or boost list has changed, any priority gained from hits is
+// lost
+func reprioritise(db *DBConn, options *Options, logger logrus.FieldLogger) error {
+	stored, err := db.LoadOptions()
+	if err != nil {
+		return err
+	}
+	if stored == nil || (stored.Strategy == options.Strategy && strings.Join(stored.Boost, ",") == strings.Join(options.Boost, ",")) {
+		return nil
+	}
+
+	// Seeded, listed and spidered paths and the files the detectors check
+	// for keep their priorities, which don't depend on the strategy
+	requests, err := db.GetUnprocessedWordlistRequests()
+	if err != nil {
+		return err
+	}
+
+	prioritiser := NewPrioritiser(options.Strategy, options.Boost)
+	suffixes := options.suffixes()
+	priorities := make(map[string]int, len(requests))
+	for uri, parent := range requests {
+		name := strings.TrimPrefix(uri, parent)
+		if isProbe(name) {
+			continue
+		}
+		word, suffix := splitSuffix(name, suffixes)
+		priorities[uri] = prioritiser.Priority(depthBelow(options.URL, parent), word, suffix)
+	}
+	logger.Infof("Strategy or boosted words changed, reordering %v remaining requests", len(priorities))
+	return db.SetRequestPriorities(priorities)
+}
+
+// Split the longest of the suffixes from the end of a request's name
+func splitSuffix(name string, suffixes []string) (string, string) {
+	longest := ""
+	for _, suffix := range suffixes {
+		if len(suffix) > len(longest) && len(suffix) < len(name) && strings.HasSuffix(name, suffix) {
+			longest = suffix
+		}
+	}
+	return strings.TrimSuffix(name, longest), longest
+}
+
+func sameSuffixes(a []string, b []string) bool {
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return strings.Join(a, "\n") == strings.Join(b, "\n")
+}
@@ -0,0 +1,59 @@
+package libgetgood
+
+import (
+	"testing"
+
+	. "github.com/dpindur/get-good/logger"
+)
+
+// Changing the strategy reorders the wordlist requests but leaves the
+// paths seeded, listed or checked by detectors ahead of them
+func TestReprioritiseKeepsDiscoveredPriorities(t *testing.T) {
+	db := testDatabase(t)
+	defer db.CloseDatabaseConnection()
+
+	root := "http://localhost/"
+	options := DefaultOptions()
+	options.URL = root
+	options.Extensions = []string{}
+	options.Strategy = StrategyBreadth
+	err := db.SaveOptions(options, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddRequests(root+"a/", []string{root + "a/admin", root + "a/.git/HEAD"}, []int{-1000, detectorPriority})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddDiscoveredRequests(root, []string{root + "robots-path"}, []int{seedPriority}, root+"robots.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddDiscoveredRequests(root+"a/", []string{root + "a/listed"}, []int{detectorPriority}, root+"a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options.Strategy = StrategyDepth
+	err = reprioritise(db, options, Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{
+		root + "a/admin":     levelPriority,
+		root + "a/.git/HEAD": detectorPriority,
+		root + "robots-path": seedPriority,
+		root + "a/listed":    detectorPriority,
+	}
+	for uri, priority := range expected {
+		var stored int
+		err = db.db.QueryRow("SELECT priority FROM requests WHERE uri = ?", uri).Scan(&stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored != priority {
+			t.Errorf("expected %v to have priority %v, got %v", uri, priority, stored)
+		}
+	}
+}
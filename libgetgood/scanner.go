@@ -0,0 +1,993 @@
+package libgetgood
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/dpindur/get-good/logger"
+	logrus "github.com/sirupsen/logrus"
+)
+
+const (
+	ScanCreated   = "created"
+	ScanRunning   = "running"
+	ScanPaused    = "paused"
+	ScanStopping  = "stopping"
+	ScanCompleted = "completed"
+	ScanStopped   = "stopped"
+	ScanFailed    = "failed"
+)
+
+// Options holds everything needed to run a directory bust. Words can
+// be provided directly, otherwise they are read from the Wordlist file
+type Options struct {
+	URL             string   `json:"url" yaml:"url"`
+	Wordlist        string   `json:"wordlist" yaml:"wordlist"`
+	Words           []string `json:"words,omitempty" yaml:"words,omitempty"`
+	Extensions      []string `json:"extensions" yaml:"extensions"`
+	DBFile          string   `json:"db" yaml:"db"`
+	ClearDB         bool     `json:"clearDB" yaml:"clear-db"`
+	Workers         int      `json:"workers" yaml:"workers"`
+	Rate            int      `json:"rate" yaml:"rate"`
+	Timeout         int      `json:"timeout" yaml:"timeout"`
+	Recurse         bool     `json:"recurse" yaml:"recurse"`
+	Extend          bool     `json:"extend" yaml:"extend"`
+	Strategy        Strategy `json:"strategy" yaml:"strategy"`
+	Boost           []string `json:"boost" yaml:"boost"`
+	QueueSize       int      `json:"queueSize" yaml:"queue-size"`
+	PollerBatchSize int      `json:"pollerBatchSize" yaml:"poller-batch-size"`
+	ShutdownTimeout int      `json:"shutdownTimeout" yaml:"shutdown-timeout"`
+
+	// Hosts, paths and extensions which may be requested, checked before
+	// requests are added and again before they are made
+	Scope ScopeRules `json:"scope" yaml:"scope"`
+
+	// Which redirects are followed and how many in a row, the chain of
+	// redirects is recorded with each response whether followed or not
+	Redirects    RedirectPolicy `json:"redirects" yaml:"redirects"`
+	MaxRedirects int            `json:"maxRedirects" yaml:"max-redirects"`
+
+	// Parse html and scripts for links to request, the words in their
+	// paths are added to the wordlist for the rest of the scan
+	Spider bool `json:"spider" yaml:"spider"`
+
+	// Read robots.txt, sitemaps, security.txt and crossdomain.xml for
+	// paths to request before any others
+	Seed bool `json:"seed" yaml:"seed"`
+
+	// Check every directory for exposed source control and metadata
+	// files, confirming them by their content and requesting the paths
+	// they list
+	Detect bool `json:"detect" yaml:"detect"`
+
+	// Check each host for case insensitivity by requesting a hit with its
+	// case swapped, requests differing only by case are then made once
+	DetectCase bool `json:"detectCase" yaml:"detect-case"`
+
+	// The auto extension is replaced with extensions chosen from what the
+	// target is found to run, and a directory of wordlists named after
+	// technologies, such as php.txt, adds the words for those found
+	TechWordlists string `json:"techWordlists" yaml:"tech-wordlists"`
+
+	// Hits are grouped into clusters of near identical responses, once a
+	// cluster holds more than the limit any more hits like them are
+	// recorded but not reported or recursed into. Zero sets no limit
+	ClusterLimit int `json:"clusterLimit" yaml:"cluster-limit"`
+
+	// Address to listen for remote agents on, requests are leased to
+	// agents as well as the local http workers. Leases that aren't
+	// reported within the lease timeout are handed out again
+	CoordinatorAddr  string `json:"coordinatorAddr" yaml:"coordinator-addr"`
+	CoordinatorToken string `json:"-" yaml:"coordinator-token"`
+	LeaseTimeout     int    `json:"leaseTimeout" yaml:"lease-timeout"`
+
+	// How failures of the updater, expander, poller, monitor, http workers
+	// and coordinator are handled, and how often a component may be restarted
+	Policies    map[string]Policy `json:"policies" yaml:"policies"`
+	MaxRestarts int               `json:"maxRestarts" yaml:"max-restarts"`
+
+	// Optional callbacks, these are called from the scanner's own
+	// goroutines so must not block for long
+	OnFinding func(*Finding) `json:"-" yaml:"-"`
+	OnReport  func(*Report)  `json:"-" yaml:"-"`
+	OnState   func(string)   `json:"-" yaml:"-"`
+
+	// Where the scan logs to, the logger package's Logger if not set.
+	// Hits are logged with its HitField set
+	Logger logrus.FieldLogger `json:"-" yaml:"-"`
+}
+
+// DefaultOptions returns options with the same defaults as the
+// command line flags
+func DefaultOptions() *Options {
+	return &Options{
+		Extensions:      []string{"html", "php"},
+		DBFile:          "bust.db",
+		Workers:         5,
+		Timeout:         10,
+		QueueSize:       5000,
+		PollerBatchSize: 5000,
+		ShutdownTimeout: 10,
+		Strategy:        StrategyBreadth,
+		Redirects:       RedirectNone,
+		MaxRedirects:    5,
+		LeaseTimeout:    30,
+		Policies:        DefaultPolicies(),
+		MaxRestarts:     3,
+	}
+}
+
+func (options *Options) Validate() error {
+	if options.URL == "" {
+		return errors.New("url is required")
+	}
+	if !strings.HasSuffix(options.URL, "/") {
+		options.URL += "/"
+	}
+	_, err := url.ParseRequestURI(options.URL)
+	if err != nil {
+		return fmt.Errorf("error parsing url, please ensure it includes the protocol: %v", err)
+	}
+	if options.Wordlist == "" && len(options.Words) == 0 {
+		return errors.New("wordlist is required")
+	}
+	if options.TechWordlists != "" {
+		info, err := os.Stat(options.TechWordlists)
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("technology wordlists %v is not a directory", options.TechWordlists)
+		}
+	}
+	if options.Logger == nil {
+		options.Logger = Logger
+	}
+	if !strings.HasSuffix(options.DBFile, ".db") {
+		options.DBFile += ".db"
+	}
+	if options.Workers < 1 && options.CoordinatorAddr == "" {
+		return errors.New("workers must be 1 or more")
+	}
+	if options.Workers < 0 {
+		return errors.New("workers must be 0 or more")
+	}
+	if options.Rate < 0 {
+		return errors.New("rate must be 0 or more")
+	}
+	// Scans stored before strategies were supported are breadth first
+	if options.Strategy == "" {
+		options.Strategy = StrategyBreadth
+	}
+	_, err = ParseStrategy(string(options.Strategy))
+	if err != nil {
+		return err
+	}
+	// Scans stored before redirects could be followed never followed them
+	if options.Redirects == "" {
+		options.Redirects = RedirectNone
+	}
+	_, err = ParseRedirectPolicy(string(options.Redirects))
+	if err != nil {
+		return err
+	}
+	if options.MaxRedirects < 0 {
+		return errors.New("max redirects must be 0 or more")
+	}
+	if options.MaxRedirects == 0 {
+		options.MaxRedirects = DefaultOptions().MaxRedirects
+	}
+	if options.Timeout < 0 {
+		return errors.New("timeout must be 0 or more")
+	}
+	if options.QueueSize < 1 {
+		return errors.New("queue size must be 1 or more")
+	}
+	if options.PollerBatchSize < 1 {
+		return errors.New("poller batch size must be 1 or more")
+	}
+	if options.ShutdownTimeout < 0 {
+		return errors.New("shutdown timeout must be 0 or more")
+	}
+	if options.LeaseTimeout < 0 {
+		return errors.New("lease timeout must be 0 or more")
+	}
+	// Scans stored before agents were supported have no lease timeout
+	if options.LeaseTimeout == 0 {
+		options.LeaseTimeout = DefaultOptions().LeaseTimeout
+	}
+	if options.MaxRestarts < 0 {
+		return errors.New("max restarts must be 0 or more")
+	}
+	if options.ClusterLimit < 0 {
+		return errors.New("cluster limit must be 0 or more")
+	}
+	_, err = NewScope(options.URL, options.Scope)
+	if err != nil {
+		return err
+	}
+	if options.Policies == nil {
+		options.Policies = DefaultPolicies()
+	}
+	return ValidatePolicies(options.Policies)
+}
+
+// Expand the configured extensions into suffixes, including the blank suffix
+func (options *Options) suffixes() []string {
+	suffixes := make([]string, 0)
+	suffixes = append(suffixes, "")
+	for _, ext := range options.Extensions {
+		if !strings.HasPrefix(ext, ".") {
+			suffixes = append(suffixes, "."+ext)
+		} else {
+			suffixes = append(suffixes, ext)
+		}
+	}
+	return suffixes
+}
+
+func ReadWordlist(filename string) ([]string, error) {
+	wordlist, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer wordlist.Close()
+
+	words := make([]string, 0)
+	scanner := bufio.NewScanner(wordlist)
+	for scanner.Scan() {
+		words = append(words, scanner.Text())
+	}
+	return words, scanner.Err()
+}
+
+// Scanner owns the database connection, http client and workers for a
+// single directory bust. Scanners share no state so several can be run
+// in the same process, as long as they use different database files
+type Scanner struct {
+	options          *Options
+	words            []string
+	mutex            *sync.Mutex
+	state            string
+	db               *DBConn
+	ctx              context.Context
+	requestCtx       context.Context
+	client           *http.Client
+	scope            *Scope
+	caseChecker      *CaseChecker
+	clusters         *Clusters
+	stats            *Stats
+	throttle         *Throttle
+	wg               *sync.WaitGroup
+	expandWg         *sync.WaitGroup
+	httpWg           *sync.WaitGroup
+	supervisor       *Supervisor
+	workerErr        *WorkerError
+	err              error
+	requestChan      chan *Request
+	responseChan     chan *Response
+	bustCompleteChan chan int
+	stopChan         chan int
+	doneChan         chan int
+	updater          *Updater
+	expander         *Expander
+	poller           *Poller
+	monitor          *Monitor
+	coordinator      *Coordinator
+	workers          []*HttpWorker
+	logger           logrus.FieldLogger
+}
+
+func NewScanner(options *Options) (*Scanner, error) {
+	err := options.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	words := options.Words
+	if len(words) == 0 {
+		words, err = ReadWordlist(options.Wordlist)
+		if err != nil {
+			return nil, fmt.Errorf("error reading wordlist file: %v", err)
+		}
+	}
+
+	scope, err := NewScope(options.URL, options.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := &Scanner{
+		options:          options,
+		scope:            scope,
+		words:            words,
+		mutex:            &sync.Mutex{},
+		state:            ScanCreated,
+		client:           NewClient(options.Timeout, options.Redirects, options.MaxRedirects, scope, options.Logger),
+		stats:            NewStats(),
+		throttle:         NewThrottle(options.Rate),
+		wg:               &sync.WaitGroup{},
+		expandWg:         &sync.WaitGroup{},
+		httpWg:           &sync.WaitGroup{},
+		requestChan:      make(chan *Request, options.QueueSize),
+		responseChan:     make(chan *Response, options.QueueSize),
+		bustCompleteChan: make(chan int, 1),
+		stopChan:         make(chan int, 1),
+		doneChan:         make(chan int),
+		workers:          make([]*HttpWorker, 0),
+		logger:           options.Logger,
+	}
+	scanner.supervisor = NewSupervisor(options.Policies, options.MaxRestarts, scanner.abort, options.Logger)
+	return scanner, nil
+}
+
+// Run performs the directory bust, blocking until it completes, the
+// scanner is stopped or the context is cancelled. A scanner can only
+// be run once
+func (scanner *Scanner) Run(ctx context.Context) error {
+	if scanner.State() != ScanCreated {
+		return errors.New("scanner has already been run")
+	}
+	defer close(scanner.doneChan)
+
+	options := scanner.options
+	scanner.logger.Infof("Starting get-good directory bust of %v", options.URL)
+
+	// The target is fingerprinted before anything else so the extensions
+	// and words it decides are stored and checked like any others
+	var technologies []string
+	if hasAutoExtensions(options.Extensions) || options.TechWordlists != "" {
+		var err error
+		technologies, err = scanner.fingerprint(ctx)
+		if err != nil {
+			scanner.setState(ScanFailed)
+			scanner.setErr(err)
+			return err
+		}
+	}
+
+	scanner.logger.Infof("Worker threads: %v", options.Workers)
+	scanner.logger.Infof("Database file: %v", options.DBFile)
+	scanner.logger.Infof("Wordlist file: %v", options.Wordlist)
+	scanner.logger.Infof("Extensions: (blank)%v", strings.Join(options.suffixes(), ", "))
+	scanner.logger.Infof("Resuming existing directory bust: %v", !options.ClearDB)
+	scanner.logger.Infof("Extending with new words and extensions: %v", options.Extend)
+	scanner.logger.Infof("Queue size: %v", options.QueueSize)
+	scanner.logger.Infof("Poller batch size: %v", options.PollerBatchSize)
+	scanner.logger.Infof("Rate limit: %v", options.Rate)
+	scanner.logger.Infof("Strategy: %v", options.Strategy)
+	scanner.logger.Infof("Scope: %v", describeScope(options))
+	scanner.logger.Infof("Redirects: %v, max redirects: %v", options.Redirects, options.MaxRedirects)
+	scanner.logger.Infof("Spider: %v", options.Spider)
+	scanner.logger.Infof("Seed from robots.txt and sitemaps: %v", options.Seed)
+	scanner.logger.Infof("Detect exposed metadata files: %v", options.Detect)
+	scanner.logger.Infof("Detect case insensitive hosts: %v", options.DetectCase)
+	scanner.logger.Infof("Cluster limit: %v", options.ClusterLimit)
+	if options.TechWordlists != "" {
+		scanner.logger.Infof("Technology wordlists: %v", options.TechWordlists)
+	}
+	if len(options.Boost) > 0 {
+		scanner.logger.Infof("Boosted words: %v", strings.Join(options.Boost, ", "))
+	}
+	scanner.logger.Infof("Shutdown timeout: %v", options.ShutdownTimeout)
+	scanner.logger.Infof("Failure policies: %v, max restarts: %v", options.Policies, options.MaxRestarts)
+	if options.CoordinatorAddr != "" {
+		scanner.logger.Infof("Coordinating agents on: %v, lease timeout: %v", options.CoordinatorAddr, options.LeaseTimeout)
+	}
+
+	db, err := openScanDatabase(options, WordlistHash(scanner.words))
+	if err != nil {
+		scanner.setState(ScanFailed)
+		scanner.setErr(err)
+		return err
+	}
+	if technologies != nil {
+		techErr := db.SetSessionTechnologies(technologies)
+		if techErr != nil {
+			scanner.logger.Errorf("Error recording the target's technologies")
+			scanner.logger.Errorf("%v", techErr)
+		}
+	}
+
+	// Cancelling ctx stops new work being taken, while requestCtx is
+	// only cancelled once the shutdown grace period has passed
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	// Hosts checked in earlier runs of the scan aren't checked again
+	var caseChecker *CaseChecker
+	if options.DetectCase {
+		checked, err := db.GetCheckedHosts()
+		if err != nil {
+			scanner.logger.Errorf("Error reading hosts checked for case insensitivity")
+			scanner.logger.Errorf("%v", err)
+		}
+		caseChecker = NewCaseChecker(checked)
+	}
+
+	// Hits from earlier runs of the scan count towards their clusters
+	clusters := NewClusters(options.ClusterLimit, scanner.logger)
+	findings, findErr := db.GetFindings(FindingFilter{})
+	if findErr != nil {
+		scanner.logger.Errorf("Error reading findings to cluster")
+		scanner.logger.Errorf("%v", findErr)
+	}
+	for _, finding := range findings {
+		clusters.add(finding)
+	}
+
+	scanner.mutex.Lock()
+	scanner.db = db
+	scanner.caseChecker = caseChecker
+	scanner.clusters = clusters
+	scanner.ctx = ctx
+	scanner.requestCtx = requestCtx
+	scanner.mutex.Unlock()
+	scanner.setState(ScanRunning)
+
+	// The seed files are read before the monitor starts, so the scan
+	// isn't seen as finished while they are being read
+	var seeds []*Seeds
+	if options.Seed {
+		seeds = scanner.fetchSeeds(ctx)
+	}
+
+	// Start database workers, the expander, updater and monitor are
+	// stopped separately so they can keep running while requests finish
+	prioritiser := NewPrioritiser(options.Strategy, options.Boost)
+	scanner.expander = StartExpander(context.Background(), scanner.expandWg, db, scanner.supervisor, scanner.stats, options.URL, scanner.words, dynamicWords(db, scanner.logger), options.suffixes(), prioritiser, scanner.scope, options.Detect, scanner.logger)
+	scanner.updater = StartUpdater(context.Background(), scanner.wg, db, scanner.supervisor, scanner.responseChan, scanner.expander, scanner.stats, scanner.finding, options.Recurse, prioritiser.HitPriority(), prioritiser.IndexPriority(), clusters, scanner.logger)
+	scanner.poller = StartPoller(ctx, scanner.wg, db, options.PollerBatchSize, scanner.supervisor, scanner.requestChan, scanner.stats, scanner.logger)
+	scanner.monitor = StartMonitor(context.Background(), scanner.wg, db, scanner.stats, scanner.report, scanner.supervisor, scanner.bustCompleteChan, scanner.expander, scanner.logger)
+
+	// Start http workers
+	for i := 0; i < options.Workers; i++ {
+		scanner.addWorker()
+	}
+
+	// Remote agents take requests from the same queue as the http workers
+	// and share their shutdown grace period
+	if options.CoordinatorAddr != "" {
+		err = scanner.startCoordinator()
+		if err != nil {
+			scanner.Stop()
+		}
+	}
+
+	// Seeds are queued ahead of the root so they are requested first
+	for _, seed := range seeds {
+		scanner.expander.Seed(seed.Source, seed.Urls)
+	}
+
+	// The spider starts from the target itself
+	if options.Spider {
+		err := db.AddDiscoveredRequests(options.URL, []string{options.URL}, []int{prioritiser.DiscoveredPriority(0)}, "")
+		if err != nil {
+			scanner.logger.Errorf("Error adding the target for the spider")
+			scanner.logger.Errorf("%v", err)
+		}
+	}
+
+	// Directories expanded by an earlier run are only expanded again when
+	// extending, so only the new combinations are added. Otherwise they
+	// are restored, so requests which were pruned aren't added back
+	directories, err := db.GetDirectories()
+	if err != nil {
+		scanner.logger.Errorf("Error reading directories expanded so far")
+		scanner.logger.Errorf("%v", err)
+	}
+	rootExpanded := false
+	for _, directory := range directories {
+		rootExpanded = rootExpanded || directory == options.URL
+	}
+	if rootExpanded && !options.Extend {
+		scanner.expander.Restore(options.URL)
+	} else {
+		scanner.expander.Expand(options.URL)
+	}
+	for _, directory := range directories {
+		if directory == options.URL {
+			continue
+		}
+		if options.Extend {
+			scanner.expander.Expand(directory)
+		} else {
+			scanner.expander.Restore(directory)
+		}
+	}
+
+	state := ScanStopped
+	select {
+	case <-scanner.bustCompleteChan:
+		scanner.logger.Infof("Directory bust complete, stopping...")
+		state = ScanCompleted
+		break
+	case <-scanner.stopChan:
+		scanner.logger.Infof("Stopping...")
+		break
+	case <-ctx.Done():
+		scanner.logger.Infof("Stopping...")
+		break
+	}
+	scanner.setState(ScanStopping)
+	scanner.shutdown(cancel, cancelRequests)
+
+	scanner.mutex.Lock()
+	workerErr := scanner.workerErr
+	scanner.mutex.Unlock()
+	if err != nil {
+		state = ScanFailed
+	} else if workerErr != nil {
+		state = ScanFailed
+		err = fmt.Errorf("error in %v: %v", workerErr.Worker, workerErr.Error)
+	}
+
+	// Anything still inflight was never completed, so hand it back
+	// to the next run of this scan
+	resetErr := db.ResetInflightRequests()
+	if resetErr != nil {
+		scanner.logger.Errorf("Error resetting inflight requests")
+		scanner.logger.Errorf("%v", resetErr)
+	}
+
+	closeErr := db.CloseDatabaseConnection()
+	if closeErr != nil {
+		scanner.logger.Errorf("Error closing database connection")
+		scanner.logger.Errorf("%v", closeErr)
+	}
+
+	scanner.setErr(err)
+	scanner.setState(state)
+	return err
+}
+
+// Work out what the target runs, resolving the auto extension and
+// adding the words of any technology wordlists
+func (scanner *Scanner) fingerprint(ctx context.Context) ([]string, error) {
+	scanner.logger.Infof("Fingerprinting %v", scanner.options.URL)
+	fingerprinter, err := NewFingerprinter(scanner.client, scanner.throttle, scanner.scope, scanner.options.URL, scanner.logger)
+	if err != nil {
+		return nil, fmt.Errorf("error fingerprinting target: %v", err)
+	}
+	technologies := fingerprinter.Fetch(ctx)
+	if len(technologies) > 0 {
+		scanner.logger.WithField(HitField, true).Infof("Target runs %v", strings.Join(technologies, ", "))
+	} else {
+		scanner.logger.Infof("No technologies recognised")
+	}
+
+	// The api reads the options while the scan runs
+	extensions := resolveExtensions(scanner.options.Extensions, technologies)
+	scanner.mutex.Lock()
+	scanner.options.Extensions = extensions
+	scanner.mutex.Unlock()
+	if scanner.options.TechWordlists != "" {
+		words, err := technologyWords(scanner.options.TechWordlists, technologies, scanner.logger)
+		if err != nil {
+			return nil, fmt.Errorf("error reading technology wordlist: %v", err)
+		}
+		scanner.words = mergeWords(scanner.words, words)
+	}
+	return technologies, nil
+}
+
+// Read the seed files before brute forcing begins
+func (scanner *Scanner) fetchSeeds(ctx context.Context) []*Seeds {
+	scanner.logger.Infof("Reading robots.txt, sitemaps, security.txt and crossdomain.xml")
+	seeder, err := NewSeeder(scanner.client, scanner.throttle, scanner.scope, scanner.options.URL, scanner.logger)
+	if err != nil {
+		scanner.logger.Errorf("Error seeding directory bust")
+		scanner.logger.Errorf("%v", err)
+		return nil
+	}
+	return seeder.Fetch(ctx)
+}
+
+// Words the spider found in earlier runs of the scan
+func dynamicWords(db *DBConn, logger logrus.FieldLogger) []string {
+	words, err := db.GetWords()
+	if err != nil {
+		logger.Errorf("Error reading words found by the spider")
+		logger.Errorf("%v", err)
+		return nil
+	}
+	return words
+}
+
+func (scanner *Scanner) startCoordinator() error {
+	options := scanner.options
+	if options.CoordinatorToken == "" {
+		token := make([]byte, 16)
+		_, err := rand.Read(token)
+		if err != nil {
+			return fmt.Errorf("error generating coordinator token: %v", err)
+		}
+		options.CoordinatorToken = hex.EncodeToString(token)
+		scanner.logger.Infof("Coordinator token: %v", options.CoordinatorToken)
+	}
+
+	leaseTimeout := time.Duration(options.LeaseTimeout) * time.Second
+	coordinator, err := StartCoordinator(scanner.ctx, scanner.requestCtx, scanner.httpWg, scanner.db, scanner.supervisor, scanner.requestChan, scanner.responseChan, scanner.throttle, scanner.stats, options.CoordinatorAddr, options.CoordinatorToken, leaseTimeout, options.URL, options.Scope, options.Redirects, options.MaxRedirects, options.Spider, options.Detect, options.DetectCase, scanner.logger)
+	if err != nil {
+		return fmt.Errorf("error starting coordinator: %v", err)
+	}
+	scanner.mutex.Lock()
+	scanner.coordinator = coordinator
+	scanner.mutex.Unlock()
+	return nil
+}
+
+// Stop taking new requests, give in-flight requests the shutdown grace
+// period to complete and abort any that are left, then stop the updater,
+// monitor and expander once every response has been recorded
+func (scanner *Scanner) shutdown(cancel context.CancelFunc, cancelRequests context.CancelFunc) {
+	cancel()
+	scanner.mutex.Lock()
+	scanner.workers = scanner.workers[:0]
+	scanner.mutex.Unlock()
+
+	grace := time.Duration(scanner.options.ShutdownTimeout) * time.Second
+	scanner.logger.Infof("Waiting up to %v for in-flight requests to complete...", grace)
+	if !waitTimeout(scanner.httpWg, grace) {
+		scanner.logger.Warnf("In-flight requests did not complete in time, aborting them")
+	}
+	cancelRequests()
+	scanner.httpWg.Wait()
+
+	scanner.logger.Infof("Waiting for updater, poller and monitor to stop...")
+	scanner.monitor.Stop()
+	scanner.updater.Stop()
+	scanner.wg.Wait()
+
+	// The updater can queue expansions until it has stopped
+	scanner.logger.Infof("Waiting for expander to stop...")
+	scanner.expander.Stop()
+	scanner.expandWg.Wait()
+	CleanupClient(scanner.client)
+}
+
+// Wait for the group to finish, returns false if the timeout passed first
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan int)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func openScanDatabase(options *Options, wordlistHash string) (*DBConn, error) {
+	db, err := OpenDatabaseConnection(options.DBFile)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database connection: %v", err)
+	}
+
+	err = db.CreateSchema()
+	if err != nil {
+		db.CloseDatabaseConnection()
+		return nil, fmt.Errorf("error creating database schema: %v", err)
+	}
+
+	if options.ClearDB {
+		err = db.Clear()
+		if err != nil {
+			db.CloseDatabaseConnection()
+			return nil, fmt.Errorf("error clearing database: %v", err)
+		}
+	} else {
+		err = checkResume(db, options, wordlistHash, options.Logger)
+		if err != nil {
+			db.CloseDatabaseConnection()
+			return nil, err
+		}
+		err = reprioritise(db, options, options.Logger)
+		if err != nil {
+			db.CloseDatabaseConnection()
+			return nil, fmt.Errorf("error reordering requests: %v", err)
+		}
+	}
+
+	// Clearing the database starts a new session, as does resuming a
+	// scan from before sessions were recorded
+	sessions, err := db.GetSessions()
+	if err != nil {
+		db.CloseDatabaseConnection()
+		return nil, fmt.Errorf("error reading sessions: %v", err)
+	}
+	if options.ClearDB || len(sessions) == 0 {
+		_, err = db.StartSession(options.URL)
+		if err != nil {
+			db.CloseDatabaseConnection()
+			return nil, fmt.Errorf("error starting session: %v", err)
+		}
+	}
+
+	err = db.ResetInflightRequests()
+	if err != nil {
+		db.CloseDatabaseConnection()
+		return nil, fmt.Errorf("error resetting inflight requests: %v", err)
+	}
+
+	err = db.ResetFailedRequests()
+	if err != nil {
+		db.CloseDatabaseConnection()
+		return nil, fmt.Errorf("error resetting failed requests: %v", err)
+	}
+
+	err = db.ResetOutOfScopeRequests()
+	if err != nil {
+		db.CloseDatabaseConnection()
+		return nil, fmt.Errorf("error resetting out of scope requests: %v", err)
+	}
+
+	err = db.SaveOptions(options, wordlistHash)
+	if err != nil {
+		db.CloseDatabaseConnection()
+		return nil, fmt.Errorf("error saving options: %v", err)
+	}
+
+	return db, nil
+}
+
+// Stop signals the scanner to stop, use Done to wait for it to finish
+func (scanner *Scanner) Stop() {
+	select {
+	case scanner.stopChan <- 0:
+		break
+	default:
+		break
+	}
+}
+
+// Done returns a channel which is closed once Run has returned
+func (scanner *Scanner) Done() chan int {
+	return scanner.doneChan
+}
+
+// Options returns a copy of the options the scan is running with, the
+// auto extension is replaced once the target has been fingerprinted
+func (scanner *Scanner) Options() *Options {
+	scanner.mutex.Lock()
+	defer scanner.mutex.Unlock()
+	options := *scanner.options
+	return &options
+}
+
+func (scanner *Scanner) Stats() *Stats {
+	return scanner.stats
+}
+
+func (scanner *Scanner) State() string {
+	scanner.mutex.Lock()
+	defer scanner.mutex.Unlock()
+	return scanner.state
+}
+
+func (scanner *Scanner) setState(state string) {
+	scanner.mutex.Lock()
+	scanner.state = state
+	scanner.mutex.Unlock()
+	if scanner.options.OnState != nil {
+		scanner.options.OnState(state)
+	}
+}
+
+// Called by the supervisor when a component fails and the scan can't continue
+func (scanner *Scanner) abort(workerErr *WorkerError) {
+	scanner.mutex.Lock()
+	if scanner.workerErr == nil {
+		scanner.workerErr = workerErr
+	}
+	scanner.mutex.Unlock()
+	scanner.Stop()
+}
+
+// Err returns the error the scan finished with, or nil if it hasn't
+// finished or finished without error
+func (scanner *Scanner) Err() error {
+	scanner.mutex.Lock()
+	defer scanner.mutex.Unlock()
+	return scanner.err
+}
+
+func (scanner *Scanner) setErr(err error) {
+	scanner.mutex.Lock()
+	scanner.err = err
+	scanner.mutex.Unlock()
+}
+
+// Errors returns every error reported by the scanner's components,
+// including those it recovered from
+func (scanner *Scanner) Errors() []*WorkerError {
+	return scanner.supervisor.Errors()
+}
+
+func (scanner *Scanner) finding(finding *Finding) {
+	if scanner.options.OnFinding != nil {
+		scanner.options.OnFinding(finding)
+	}
+}
+
+func (scanner *Scanner) report(report *Report) {
+	report.Paused = scanner.Paused()
+	report.Workers = scanner.Workers()
+	report.Rate = scanner.Rate()
+	report.Clusters = scanner.clusters.Largest(reportedClusters)
+	if scanner.options.OnReport != nil {
+		scanner.options.OnReport(report)
+	}
+}
+
+// QueueDepths returns the number of requests waiting for an http
+// worker and the number of responses waiting for the updater
+func (scanner *Scanner) QueueDepths() (int, int) {
+	return len(scanner.requestChan), len(scanner.responseChan)
+}
+
+func (scanner *Scanner) Pause() {
+	if scanner.State() != ScanRunning {
+		return
+	}
+	scanner.logger.Infof("Pausing http workers, in-flight requests will still complete")
+	scanner.throttle.Pause()
+	scanner.setState(ScanPaused)
+}
+
+func (scanner *Scanner) Resume() {
+	if scanner.State() != ScanPaused {
+		return
+	}
+	scanner.logger.Infof("Resuming http workers")
+	scanner.throttle.Resume()
+	scanner.setState(ScanRunning)
+}
+
+func (scanner *Scanner) Paused() bool {
+	return scanner.throttle.Paused()
+}
+
+func (scanner *Scanner) Workers() int {
+	scanner.mutex.Lock()
+	defer scanner.mutex.Unlock()
+	return len(scanner.workers)
+}
+
+// SetWorkers starts or stops http workers until the given number are running
+func (scanner *Scanner) SetWorkers(count int) error {
+	if count < 1 && scanner.options.CoordinatorAddr == "" {
+		return errors.New("workers must be 1 or more")
+	}
+	if count < 0 {
+		return errors.New("workers must be 0 or more")
+	}
+	if scanner.State() != ScanRunning && scanner.State() != ScanPaused {
+		return errors.New("scan is not running")
+	}
+
+	for scanner.Workers() < count {
+		scanner.addWorker()
+	}
+	for scanner.Workers() > count {
+		scanner.removeWorker()
+	}
+	scanner.logger.Infof("Worker threads: %v", scanner.Workers())
+	return nil
+}
+
+func (scanner *Scanner) addWorker() {
+	scanner.mutex.Lock()
+	defer scanner.mutex.Unlock()
+	worker := StartHttpWorker(scanner.ctx, scanner.requestCtx, scanner.httpWg, scanner.db, scanner.client, scanner.scope, scanner.options.Spider, scanner.options.Detect, scanner.caseChecker, scanner.supervisor, scanner.requestChan, scanner.responseChan, scanner.throttle, scanner.stats, scanner.logger)
+	scanner.workers = append(scanner.workers, worker)
+}
+
+func (scanner *Scanner) removeWorker() {
+	scanner.mutex.Lock()
+	defer scanner.mutex.Unlock()
+	scanner.workers[len(scanner.workers)-1].Stop()
+	scanner.workers = scanner.workers[:len(scanner.workers)-1]
+}
+
+func (scanner *Scanner) Rate() int {
+	return scanner.throttle.Rate()
+}
+
+// SetRate sets the maximum requests per second, zero removes the limit
+func (scanner *Scanner) SetRate(rate int) error {
+	if rate < 0 {
+		return errors.New("rate must be 0 or more")
+	}
+	scanner.throttle.SetRate(rate)
+	scanner.logger.Infof("Rate limit: %v", rate)
+	return nil
+}
+
+func (scanner *Scanner) SkipBranch() {
+	if scanner.State() != ScanRunning && scanner.State() != ScanPaused {
+		return
+	}
+	scanner.expander.SkipBranch()
+}
+
+// Controller manages the scanner used by the command line tool, wiring
+// its callbacks through to the event bus
+type Controller struct {
+	mutex    *sync.Mutex
+	scanner  *Scanner
+	events   *Events
+	onReport func(*Report)
+}
+
+func NewController(events *Events, onReport func(*Report)) *Controller {
+	return &Controller{&sync.Mutex{}, nil, events, onReport}
+}
+
+// Start a new scanner, fails if a scanner is already running
+func (controller *Controller) Start(options *Options) (*Scanner, error) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	if controller.scanner != nil {
+		select {
+		case <-controller.scanner.Done():
+			break
+		default:
+			return nil, errors.New("a scan is already running")
+		}
+	}
+
+	options.OnFinding = func(finding *Finding) {
+		controller.events.Publish(EventFinding, finding)
+	}
+	options.OnReport = func(report *Report) {
+		controller.events.Publish(EventProgress, report)
+		if controller.onReport != nil {
+			controller.onReport(report)
+		}
+	}
+	options.OnState = func(state string) {
+		controller.events.Publish(EventState, state)
+	}
+
+	scanner, err := NewScanner(options)
+	if err != nil {
+		return nil, err
+	}
+	controller.scanner = scanner
+
+	go func() {
+		err := scanner.Run(context.Background())
+		if err != nil {
+			scanner.logger.Errorf("Error running directory bust")
+			scanner.logger.Errorf("%v", err)
+		}
+	}()
+	return scanner, nil
+}
+
+// Scanner returns the current or most recently run scanner, or nil if
+// no scanner has been started
+func (controller *Controller) Scanner() *Scanner {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	return controller.scanner
+}
+
+func (controller *Controller) Events() *Events {
+	return controller.events
+}
@@ -0,0 +1,349 @@
+package libgetgood
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/dpindur/get-good/logger"
+	logrus "github.com/sirupsen/logrus"
+	test "github.com/sirupsen/logrus/hooks/test"
+)
+
+// Serves a hit for every path up to two directories deep, so every hit
+// at the first two levels is recursed into
+func nestedServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Count(strings.Trim(r.URL.Path, "/"), "/") < 2 {
+			fmt.Fprintf(w, "page %v", r.URL.Path)
+			return
+		}
+		w.WriteHeader(404)
+	}))
+}
+
+func testOptions(t *testing.T, target string, words []string) *Options {
+	options := DefaultOptions()
+	options.URL = target
+	options.Words = words
+	options.Extensions = []string{}
+	options.DBFile = filepath.Join(t.TempDir(), "bust.db")
+	options.ClearDB = true
+	return options
+}
+
+// A slow updater with small queues and many workers used to stall the
+// pipeline, with workers blocked on the response queue while the updater
+// added the requests for a recursive hit
+func TestScanWithSlowUpdater(t *testing.T) {
+	server := nestedServer()
+	defer server.Close()
+
+	words := []string{"a", "b", "c", "d", "e", "f"}
+	options := testOptions(t, server.URL, words)
+	options.Recurse = true
+	options.Workers = 16
+	options.QueueSize = 8
+	options.PollerBatchSize = 8
+
+	// Findings are reported from the updater's goroutine, so sleeping
+	// here holds up the updater while the workers fill its queue
+	mutex := &sync.Mutex{}
+	found := make(map[string]bool)
+	options.OnFinding = func(finding *Finding) {
+		time.Sleep(10 * time.Millisecond)
+		mutex.Lock()
+		found[finding.Url] = true
+		mutex.Unlock()
+	}
+
+	scanner, err := NewScanner(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- scanner.Run(context.Background())
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(60 * time.Second):
+		scanner.Stop()
+		t.Fatal("scan deadlocked")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanner.State() != ScanCompleted {
+		t.Fatalf("scan finished in state %v", scanner.State())
+	}
+
+	db, err := OpenDatabaseConnection(options.DBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseDatabaseConnection()
+
+	// Every level of the tree is requested, and every hit recorded and
+	// reported
+	total, err := db.GetTotalRequestCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	completed, err := db.GetCompletedRequestCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := len(words) + len(words)*len(words) + len(words)*len(words)*len(words)
+	if total != expected || completed != expected {
+		t.Fatalf("expected %v requests to be completed, %v of %v were", expected, completed, total)
+	}
+
+	findings, err := db.GetFindings(FindingFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits := len(words) + len(words)*len(words)
+	if len(findings) != hits || len(found) != hits {
+		t.Fatalf("expected %v hits, %v were recorded and %v reported", hits, len(findings), len(found))
+	}
+}
+
+// Ignores the case of paths, echoing back the path requested in a page
+// long enough that it's near identical whatever the path's case
+func caseInsensitiveServer() *httptest.Server {
+	template := strings.Repeat("lorem ipsum dolor sit amet consectetur adipiscing elit ", 20)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.ToLower(r.URL.Path) {
+		case "/admin", "/login":
+			fmt.Fprintf(w, "%v you requested %v", template, r.URL.Path)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+}
+
+// Once the first hit shows the host ignores case, requests differing
+// only by case from one already made are skipped whether still in the
+// database or already queued
+func TestScanCaseInsensitiveHost(t *testing.T) {
+	server := caseInsensitiveServer()
+	defer server.Close()
+
+	options := testOptions(t, server.URL, []string{"Admin", "admin", "ADMIN", "login", "Login", "missing"})
+	options.Workers = 1
+	options.DetectCase = true
+
+	scanner, err := NewScanner(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = scanner.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenDatabaseConnection(options.DBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseDatabaseConnection()
+
+	hosts, err := db.GetCheckedHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hosts[urlOrigin(server.URL)] {
+		t.Fatalf("expected %v to be found case insensitive, checked %v", server.URL, hosts)
+	}
+	findings, err := db.GetFindings(FindingFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make([]string, 0)
+	for _, finding := range findings {
+		found = append(found, strings.TrimPrefix(finding.Url, server.URL))
+	}
+	if len(found) != 2 || found[0] != "/Admin" || found[1] != "/login" {
+		t.Fatalf("expected one hit for each path, got %v", found)
+	}
+}
+
+// Everything the scan logs, down to the workers, goes to the logger in
+// its options, with hits marked but left for the caller to format
+func TestScanLogsToOptionsLogger(t *testing.T) {
+	server := nestedServer()
+	defer server.Close()
+
+	options := testOptions(t, server.URL, []string{"a", "b"})
+	options.Recurse = true
+	logger, hook := test.NewNullLogger()
+	logger.Level = logrus.DebugLevel
+	options.Logger = logger
+
+	scanner, err := NewScanner(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = scanner.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hits := make(map[string]bool)
+	requested := false
+	for _, entry := range hook.AllEntries() {
+		if strings.Contains(entry.Message, "](fg-") {
+			t.Errorf("expected plain log messages, got %q", entry.Message)
+		}
+		if _, hit := entry.Data[HitField]; hit {
+			hits[entry.Message] = true
+		}
+		if strings.HasPrefix(entry.Message, "Http worker requesting") {
+			requested = true
+		}
+	}
+	for _, word := range []string{"a", "b"} {
+		message := fmt.Sprintf("Successful response for %v/%v", server.URL, word)
+		if !hits[message] {
+			t.Errorf("expected hit %q to be logged, got %v", message, hits)
+		}
+	}
+	if !requested {
+		t.Errorf("expected the workers to log to the options logger")
+	}
+}
+
+// The api reads the options while the scan runs, including while the
+// auto extension is being resolved
+func TestOptionsReadDuringAutoExtensions(t *testing.T) {
+	server := nestedServer()
+	defer server.Close()
+
+	options := testOptions(t, server.URL, []string{"a"})
+	options.Extensions = []string{AutoExtensions}
+
+	scanner, err := NewScanner(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan int)
+	done := make(chan int)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = scanner.Options().Extensions
+			}
+		}
+	}()
+	err = scanner.Run(context.Background())
+	close(stop)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ext := range scanner.Options().Extensions {
+		if ext == AutoExtensions {
+			t.Fatalf("expected the auto extension to be resolved, got %v", scanner.Options().Extensions)
+		}
+	}
+}
+
+// Pruning keeps the directories expanded so far, so resuming doesn't
+// request the pruned paths again and extending is refused as it would
+func TestResumePrunedScan(t *testing.T) {
+	mutex := &sync.Mutex{}
+	requested := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requested[r.URL.Path]++
+		mutex.Unlock()
+		if r.URL.Path == "/a" {
+			fmt.Fprintf(w, "page %v", r.URL.Path)
+			return
+		}
+		w.WriteHeader(404)
+	}))
+	defer server.Close()
+
+	options := testOptions(t, server.URL, []string{"a", "b"})
+	options.Recurse = true
+	scanner, err := NewScanner(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = scanner.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenDatabaseConnection(options.DBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := db.PruneRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	directories, err := db.GetDirectories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CloseDatabaseConnection()
+	if pruned != 3 {
+		t.Fatalf("expected 3 requests to be pruned, %v were", pruned)
+	}
+	if len(directories) != 2 || directories[0] != server.URL+"/" || directories[1] != server.URL+"/a/" {
+		t.Fatalf("expected the root and /a/ to be kept as expanded, got %v", directories)
+	}
+
+	mutex.Lock()
+	requested = make(map[string]int)
+	mutex.Unlock()
+	options.ClearDB = false
+	scanner, err = NewScanner(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = scanner.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanner.State() != ScanCompleted {
+		t.Fatalf("resumed scan finished in state %v", scanner.State())
+	}
+	mutex.Lock()
+	for _, path := range []string{"/b", "/a/a", "/a/b"} {
+		if requested[path] > 0 {
+			t.Errorf("expected pruned %v not to be requested again", path)
+		}
+	}
+	mutex.Unlock()
+
+	options.Extend = true
+	options.Words = []string{"a", "b", "c"}
+	scanner, err = NewScanner(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = scanner.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "pruned") {
+		t.Fatalf("expected extending a pruned scan to be refused, got %v", err)
+	}
+}
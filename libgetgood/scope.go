@@ -0,0 +1,172 @@
+package libgetgood
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ScopeRules decide which urls may be requested. Without any hosts only
+// the target's host is in scope. When include patterns are given a path
+// must match one of them, a path matching any exclude pattern is out of
+// scope whether or not it's included
+type ScopeRules struct {
+	Hosts             []string `json:"hosts" yaml:"hosts"`
+	Include           []string `json:"include" yaml:"include"`
+	Exclude           []string `json:"exclude" yaml:"exclude"`
+	BlockedExtensions []string `json:"blockedExtensions" yaml:"blocked-extensions"`
+}
+
+// Scope checks urls against a scan's scope rules
+type Scope struct {
+	hosts   []string
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	blocked map[string]bool
+}
+
+func NewScope(target string, rules ScopeRules) (*Scope, error) {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make([]string, 0, len(rules.Hosts))
+	for _, host := range rules.Hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		hosts = append(hosts, strings.ToLower(targetURL.Host))
+	}
+
+	include, err := compilePatterns(rules.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compilePatterns(rules.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	blocked := make(map[string]bool)
+	for _, ext := range rules.BlockedExtensions {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext != "" {
+			blocked[ext] = true
+		}
+	}
+
+	// Only the target's host is checked, include patterns will often
+	// only match paths beneath the target
+	scope := &Scope{hosts, include, exclude, blocked}
+	if !scope.allowsHost(targetURL) {
+		return nil, fmt.Errorf("target host %v is not in scope", targetURL.Host)
+	}
+	return scope, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scope pattern %q: %v", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Check returns why the url is out of scope, or nil if it's in scope.
+// A nil scope allows everything
+func (scope *Scope) Check(rawURL string) error {
+	if scope == nil {
+		return nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("unable to parse url: %v", err)
+	}
+	if !scope.allowsHost(u) {
+		return fmt.Errorf("host %v is not in scope", u.Host)
+	}
+
+	// Patterns match the decoded path, excludes also match the path as
+	// requested so encoding can't be used to get around them
+	urlPath := u.Path
+	if urlPath == "" {
+		urlPath = "/"
+	}
+	if len(scope.include) > 0 {
+		included := false
+		for _, re := range scope.include {
+			if re.MatchString(urlPath) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return fmt.Errorf("path %v matches no include pattern", urlPath)
+		}
+	}
+	for _, re := range scope.exclude {
+		if re.MatchString(urlPath) || re.MatchString(u.EscapedPath()) {
+			return fmt.Errorf("path %v matches exclude pattern %v", urlPath, re)
+		}
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(u.Path), "."))
+	if ext != "" && scope.blocked[ext] {
+		return fmt.Errorf("extension .%v is blocked", ext)
+	}
+	return nil
+}
+
+// Hosts may be given with or without a port, and a leading *. allows
+// the domain and any of its subdomains
+func (scope *Scope) allowsHost(u *url.URL) bool {
+	host := strings.ToLower(u.Host)
+	hostname := strings.ToLower(u.Hostname())
+	for _, allowed := range scope.hosts {
+		if allowed == host || allowed == hostname {
+			return true
+		}
+		if strings.HasPrefix(allowed, "*.") {
+			domain := allowed[2:]
+			if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Summarise the scope rules of the options for the log
+func describeScope(options *Options) string {
+	rules := options.Scope
+	hosts := rules.Hosts
+	if len(hosts) == 0 {
+		u, err := url.Parse(options.URL)
+		if err == nil {
+			hosts = []string{u.Host}
+		}
+	}
+
+	parts := []string{"hosts " + strings.Join(hosts, ", ")}
+	if len(rules.Include) > 0 {
+		parts = append(parts, "include "+strings.Join(rules.Include, ", "))
+	}
+	if len(rules.Exclude) > 0 {
+		parts = append(parts, "exclude "+strings.Join(rules.Exclude, ", "))
+	}
+	if len(rules.BlockedExtensions) > 0 {
+		parts = append(parts, "blocked extensions "+strings.Join(rules.BlockedExtensions, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,280 @@
+package libgetgood
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// Most of a seed file that is read
+const maxSeedBody = 10 * 1024 * 1024
+
+// Most sitemaps read, including those listed by sitemap indexes
+const maxSitemaps = 50
+
+// Seeds are the urls listed by one of the files a scan is seeded from
+type Seeds struct {
+	Source string
+	Urls   []string
+}
+
+type sitemapFile struct {
+	Urls     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+type crossDomainPolicy struct {
+	Allow []struct {
+		Domain string `xml:"domain,attr"`
+	} `xml:"allow-access-from"`
+}
+
+// Seeder reads the files which commonly list a site's paths before a
+// scan starts: robots.txt, including its disallowed paths, sitemaps and
+// sitemap indexes, security.txt and crossdomain.xml
+type Seeder struct {
+	client   *http.Client
+	throttle *Throttle
+	scope    *Scope
+	root     *url.URL
+	seeds    []*Seeds
+	sitemaps map[string]bool
+	logger   logrus.FieldLogger
+}
+
+func NewSeeder(client *http.Client, throttle *Throttle, scope *Scope, target string, logger logrus.FieldLogger) (*Seeder, error) {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	root := &url.URL{Scheme: targetURL.Scheme, Host: targetURL.Host, Path: "/"}
+	return &Seeder{client, throttle, scope, root, make([]*Seeds, 0), make(map[string]bool), logger}, nil
+}
+
+// Fetch reads every seed file, returning the urls listed by each file
+// found. The files themselves are included so they are recorded with
+// the scan's findings
+func (seeder *Seeder) Fetch(ctx context.Context) []*Seeds {
+	sitemaps := []string{seeder.resolve("/sitemap.xml")}
+	robots := seeder.resolve("/robots.txt")
+	body, ok := seeder.fetch(ctx, robots)
+	if ok {
+		paths, listed := parseRobots(seeder.root, body)
+		seeder.add(robots, paths)
+		sitemaps = append(listed, sitemaps...)
+	}
+
+	for len(sitemaps) > 0 && len(seeder.sitemaps) < maxSitemaps && ctx.Err() == nil {
+		sitemap := sitemaps[0]
+		sitemaps = sitemaps[1:]
+		if seeder.sitemaps[sitemap] {
+			continue
+		}
+		seeder.sitemaps[sitemap] = true
+		body, ok = seeder.fetch(ctx, sitemap)
+		if !ok {
+			continue
+		}
+		paths, nested, err := parseSitemap(body)
+		if err != nil {
+			seeder.logger.Warnf("Error parsing sitemap %v", sitemap)
+			seeder.logger.Warnf("%v", err)
+			continue
+		}
+		seeder.add(sitemap, paths)
+		sitemaps = append(sitemaps, nested...)
+	}
+
+	securityTxt := seeder.resolve("/.well-known/security.txt")
+	body, ok = seeder.fetch(ctx, securityTxt)
+	if ok {
+		seeder.add(securityTxt, parseSecurityTxt(body))
+	}
+
+	crossDomain := seeder.resolve("/crossdomain.xml")
+	body, ok = seeder.fetch(ctx, crossDomain)
+	if ok {
+		domains, err := parseCrossDomain(body)
+		if err != nil {
+			seeder.logger.Warnf("Error parsing %v", crossDomain)
+			seeder.logger.Warnf("%v", err)
+		} else if len(domains) > 0 {
+			seeder.logger.Infof("%v allows access from %v", crossDomain, strings.Join(domains, ", "))
+		}
+		seeder.add(crossDomain, nil)
+	}
+	return seeder.seeds
+}
+
+func (seeder *Seeder) resolve(path string) string {
+	u, _ := seeder.root.Parse(path)
+	return u.String()
+}
+
+// Record the urls listed by a file, resolving them against the root
+func (seeder *Seeder) add(source string, refs []string) {
+	urls := []string{source}
+	for _, ref := range refs {
+		link, ok := resolveLink(seeder.root, ref)
+		if ok {
+			urls = append(urls, link)
+		}
+	}
+	if len(urls) > 1 {
+		seeder.logger.Infof("Read %v paths from %v", len(urls)-1, source)
+	}
+	seeder.seeds = append(seeder.seeds, &Seeds{source, urls})
+}
+
+// Fetch a seed file, only a 200 counts as the file being found. Files
+// outside the scope are never requested
+func (seeder *Seeder) fetch(ctx context.Context, rawURL string) ([]byte, bool) {
+	err := seeder.scope.Check(rawURL)
+	if err != nil {
+		seeder.logger.Debugf("Not reading %v, %v", rawURL, err)
+		return nil, false
+	}
+	if !seeder.throttle.Wait(ctx) {
+		return nil, false
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, false
+	}
+	res, err := seeder.client.Do(req)
+	if err != nil {
+		seeder.logger.Warnf("Error requesting %v", rawURL)
+		seeder.logger.Warnf("%v", err)
+		return nil, false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		seeder.logger.Debugf("No %v, status %v", rawURL, res.StatusCode)
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSeedBody))
+	if err != nil {
+		seeder.logger.Warnf("Error reading %v", rawURL)
+		seeder.logger.Warnf("%v", err)
+		return nil, false
+	}
+
+	// Sitemaps are often served gzipped without a content encoding
+	if bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err == nil {
+			body, err = ioutil.ReadAll(io.LimitReader(reader, maxSeedBody))
+		}
+		if err != nil {
+			seeder.logger.Warnf("Error decompressing %v", rawURL)
+			seeder.logger.Warnf("%v", err)
+			return nil, false
+		}
+	}
+	return body, true
+}
+
+// Returns the allowed and disallowed paths of a robots.txt, cut off at
+// any wildcard, and the sitemaps it lists
+func parseRobots(root *url.URL, body []byte) ([]string, []string) {
+	paths := make([]string, 0)
+	sitemaps := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		field := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		switch field {
+		case "allow", "disallow":
+			if i := strings.IndexAny(value, "*$"); i >= 0 {
+				value = value[:i]
+			}
+			if value != "" && value != "/" {
+				paths = append(paths, value)
+			}
+		case "sitemap":
+			sitemap, ok := resolveLink(root, value)
+			if ok {
+				sitemaps = append(sitemaps, sitemap)
+			}
+		}
+	}
+	return paths, sitemaps
+}
+
+// Returns the urls of a sitemap, or the sitemaps of a sitemap index
+func parseSitemap(body []byte) ([]string, []string, error) {
+	sitemap := &sitemapFile{}
+	err := xml.Unmarshal(body, sitemap)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	urls := make([]string, 0, len(sitemap.Urls))
+	for _, loc := range sitemap.Urls {
+		urls = append(urls, strings.TrimSpace(loc.Loc))
+	}
+	nested := make([]string, 0, len(sitemap.Sitemaps))
+	for _, loc := range sitemap.Sitemaps {
+		nested = append(nested, strings.TrimSpace(loc.Loc))
+	}
+	return urls, nested, nil
+}
+
+// Returns the urls given as the values of security.txt fields, such as
+// its policy, acknowledgments and hiring pages
+func parseSecurityTxt(body []byte) []string {
+	urls := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.Index(line, ":")
+		if strings.HasPrefix(line, "#") || i < 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[i+1:])
+		lower := strings.ToLower(value)
+		if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") {
+			urls = append(urls, value)
+		}
+	}
+	return urls
+}
+
+// Returns the domains a crossdomain.xml allows access from, it lists
+// no paths but a wildcard or unexpected domains are worth reporting
+func parseCrossDomain(body []byte) ([]string, error) {
+	policy := &crossDomainPolicy{}
+	err := xml.Unmarshal(body, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	domains := make([]string, 0, len(policy.Allow))
+	for _, allow := range policy.Allow {
+		domains = append(domains, allow.Domain)
+	}
+	return domains, nil
+}
@@ -0,0 +1,57 @@
+package libgetgood
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	. "github.com/dpindur/get-good/logger"
+)
+
+// Seed files excluded from the scope are never requested, while those
+// in scope still are
+func TestSeederKeepsToScope(t *testing.T) {
+	mutex := &sync.Mutex{}
+	requested := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requested[r.URL.Path] = true
+		mutex.Unlock()
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprintf(w, "Disallow: /admin/\nSitemap: /sitemap.xml\n")
+		case "/.well-known/security.txt":
+			fmt.Fprintf(w, "Policy: /security-policy\n")
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	scope, err := NewScope(server.URL, ScopeRules{Exclude: []string{`^/robots\.txt$`, `^/sitemap\.xml$`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeder, err := NewSeeder(NewClient(5, RedirectNone, 0, scope, Logger), NewThrottle(0), scope, server.URL, Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeds := seeder.Fetch(context.Background())
+
+	for _, path := range []string{"/robots.txt", "/sitemap.xml"} {
+		if requested[path] {
+			t.Errorf("out of scope %v was requested", path)
+		}
+	}
+	for _, path := range []string{"/.well-known/security.txt", "/crossdomain.xml"} {
+		if !requested[path] {
+			t.Errorf("expected %v to be requested", path)
+		}
+	}
+	if len(seeds) != 1 || seeds[0].Source != server.URL+"/.well-known/security.txt" {
+		t.Errorf("expected only security.txt to be read, got %+v", seeds)
+	}
+}
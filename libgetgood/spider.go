@@ -0,0 +1,182 @@
+package libgetgood
+
+import (
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Most of a response body the spider parses, a detector or listing
+// check reads or the similarity hash covers, anything beyond is only
+// hashed
+const maxSpiderBody = 2 * 1024 * 1024
+
+// Most links kept from a single response
+const maxLinks = 500
+
+// Most words the spider adds to a scan's wordlist
+const maxDynamicWords = 5000
+
+const (
+	spiderHTML   = "html"
+	spiderScript = "script"
+)
+
+var (
+	attributePattern = regexp.MustCompile(`(?i)\b(?:href|src|action)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	commentPattern   = regexp.MustCompile(`(?s)<!--(.*?)-->`)
+	scriptPattern    = regexp.MustCompile(`(?is)<script[^>]*>(.*?)</script>`)
+	stringPattern    = regexp.MustCompile("\"([^\"\\\\\\n]{1,300})\"|'([^'\\\\\\n]{1,300})'|`([^`\\\\]{1,300})`")
+	pathCharsPattern = regexp.MustCompile(`^[\w\-.~%/:@+,;=?&!$]+$`)
+	extensionPattern = regexp.MustCompile(`\.[A-Za-z][A-Za-z0-9]{0,5}$`)
+	wordPattern      = regexp.MustCompile(`^[\w\-.~]{1,64}$`)
+	digitsPattern    = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// The kind of content in a response the spider can parse, or blank if
+// it can't be parsed
+func spiderKind(res *http.Response) string {
+	contentType := strings.ToLower(res.Header.Get("Content-Type"))
+	switch {
+	case strings.Contains(contentType, "html"):
+		return spiderHTML
+	case strings.Contains(contentType, "javascript"), strings.Contains(contentType, "ecmascript"):
+		return spiderScript
+	case contentType == "" && strings.HasSuffix(res.Request.URL.Path, ".js"):
+		return spiderScript
+	}
+	return ""
+}
+
+// Extract the urls referenced by a response. Html is searched for
+// links, sources and form actions, paths left in comments and strings
+// in inline scripts, scripts for string literals that look like paths.
+// Queries and fragments are dropped as only paths are busted
+func extractLinks(base *url.URL, kind string, body []byte) []string {
+	text := string(body)
+	refs := make([]string, 0)
+	if kind == spiderHTML {
+		for _, match := range attributePattern.FindAllStringSubmatch(text, -1) {
+			refs = append(refs, html.UnescapeString(match[1]+match[2]+match[3]))
+		}
+		for _, match := range commentPattern.FindAllStringSubmatch(text, -1) {
+			refs = append(refs, pathsInComment(match[1])...)
+		}
+		for _, match := range scriptPattern.FindAllStringSubmatch(text, -1) {
+			refs = append(refs, pathsInScript(match[1])...)
+		}
+	} else {
+		refs = append(refs, pathsInScript(text)...)
+	}
+
+	seen := make(map[string]bool)
+	links := make([]string, 0)
+	for _, ref := range refs {
+		link, ok := resolveLink(base, ref)
+		if !ok || seen[link] {
+			continue
+		}
+		seen[link] = true
+		links = append(links, link)
+		if len(links) == maxLinks {
+			break
+		}
+	}
+	return links
+}
+
+func pathsInScript(script string) []string {
+	paths := make([]string, 0)
+	for _, match := range stringPattern.FindAllStringSubmatch(script, -1) {
+		str := match[1] + match[2] + match[3]
+		if isPathLike(str) {
+			paths = append(paths, str)
+		}
+	}
+	return paths
+}
+
+func pathsInComment(comment string) []string {
+	paths := make([]string, 0)
+	tokens := strings.FieldsFunc(comment, func(r rune) bool {
+		return strings.ContainsRune(" \t\r\n\"'`<>()[]{},", r)
+	})
+	for _, token := range tokens {
+		if isPathLike(token) {
+			paths = append(paths, token)
+		}
+	}
+	return paths
+}
+
+// Strings are taken as paths when they are absolute urls, start like a
+// path or contain a directory and end with a file extension. Anything
+// else, such as mime types and dates, is too likely to be noise
+func isPathLike(str string) bool {
+	if !pathCharsPattern.MatchString(str) {
+		return false
+	}
+	lower := strings.ToLower(str)
+	if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") {
+		return true
+	}
+	if strings.HasPrefix(str, "/") || strings.HasPrefix(str, "./") || strings.HasPrefix(str, "../") {
+		return strings.Trim(str, "/.") != ""
+	}
+	return strings.Contains(str, "/") && extensionPattern.MatchString(str)
+}
+
+func resolveLink(base *url.URL, ref string) (string, bool) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") || strings.ContainsAny(ref, " {}<>\\") {
+		return "", false
+	}
+	u, err := base.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment = ""
+	u.RawFragment = ""
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String(), true
+}
+
+// The directories between the host's root and a link, ending with the
+// link itself, for example /a/, /a/b/ and /a/b/c.js
+func linkPaths(link string) []string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil
+	}
+	prefix := u.Scheme + "://" + u.Host + "/"
+	segments := strings.Split(strings.Trim(u.EscapedPath(), "/"), "/")
+	paths := make([]string, 0, len(segments))
+	for i := 1; i < len(segments); i++ {
+		paths = append(paths, prefix+strings.Join(segments[:i], "/")+"/")
+	}
+	return append(paths, link)
+}
+
+// Words worth adding to the wordlist from the path of a link, file
+// extensions are dropped as they are added back by the scan's own
+func linkWords(link string) []string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil
+	}
+	words := make([]string, 0)
+	for _, segment := range strings.Split(strings.Trim(u.Path, "/"), "/") {
+		word := strings.TrimSuffix(segment, path.Ext(segment))
+		if wordPattern.MatchString(word) && !digitsPattern.MatchString(word) {
+			words = append(words, word)
+		}
+	}
+	return words
+}
@@ -0,0 +1,236 @@
+package libgetgood
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Number of recent latency samples kept for calculating percentiles
+const latencySamples = 1000
+
+// Upper bounds in seconds of the request and database latency histograms
+var requestBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+var databaseBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 5}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	Bounds []float64
+	Counts []int
+	Sum    float64
+	Count  int
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds, make([]int, len(bounds)), 0, 0}
+}
+
+func (histogram *Histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range histogram.Bounds {
+		if seconds <= bound {
+			histogram.Counts[i]++
+		}
+	}
+	histogram.Sum += seconds
+	histogram.Count++
+}
+
+func (histogram *Histogram) copy() *Histogram {
+	counts := make([]int, len(histogram.Counts))
+	copy(counts, histogram.Counts)
+	return &Histogram{histogram.Bounds, counts, histogram.Sum, histogram.Count}
+}
+
+// Progress is the state of the requests table as last seen by the monitor
+type Progress struct {
+	Remaining int `json:"remaining"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+	Total     int `json:"total"`
+}
+
+// Stats collects live statistics from the http workers, updater and
+// monitor. It is safe to use from multiple goroutines
+type Stats struct {
+	mutex            *sync.Mutex
+	requests         int
+	statusCounts     map[int]int
+	errorCounts      map[string]int
+	latencies        []time.Duration
+	latencyIndex     int
+	latencyHistogram *Histogram
+	dbWriteHistogram *Histogram
+	depth            int
+	maxDepth         int
+	progress         Progress
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		mutex:            &sync.Mutex{},
+		statusCounts:     make(map[int]int),
+		errorCounts:      make(map[string]int),
+		latencies:        make([]time.Duration, 0, latencySamples),
+		latencyHistogram: newHistogram(requestBuckets),
+		dbWriteHistogram: newHistogram(databaseBuckets),
+	}
+}
+
+func (stats *Stats) RecordResponse(status int, latency time.Duration) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.requests++
+	stats.statusCounts[status]++
+	stats.addLatency(latency)
+}
+
+func (stats *Stats) RecordError(err error, latency time.Duration) {
+	stats.RecordErrorClass(ClassifyError(err), latency)
+}
+
+// RecordErrorClass records an error which has already been classified,
+// such as one reported by a remote agent
+func (stats *Stats) RecordErrorClass(class string, latency time.Duration) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.requests++
+	stats.errorCounts[class]++
+	stats.addLatency(latency)
+}
+
+func (stats *Stats) RecordDBWrite(latency time.Duration) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.dbWriteHistogram.observe(latency)
+}
+
+func (stats *Stats) SetProgress(progress Progress) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.progress = progress
+}
+
+func (stats *Stats) addLatency(latency time.Duration) {
+	stats.latencyHistogram.observe(latency)
+	if len(stats.latencies) < latencySamples {
+		stats.latencies = append(stats.latencies, latency)
+		return
+	}
+	stats.latencies[stats.latencyIndex] = latency
+	stats.latencyIndex = (stats.latencyIndex + 1) % latencySamples
+}
+
+func (stats *Stats) SetDepth(depth int) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.depth = depth
+	if depth > stats.maxDepth {
+		stats.maxDepth = depth
+	}
+}
+
+func (stats *Stats) Requests() int {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	return stats.requests
+}
+
+func (stats *Stats) StatusCounts() map[int]int {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	counts := make(map[int]int, len(stats.statusCounts))
+	for k, v := range stats.statusCounts {
+		counts[k] = v
+	}
+	return counts
+}
+
+func (stats *Stats) ErrorCounts() map[string]int {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	counts := make(map[string]int, len(stats.errorCounts))
+	for k, v := range stats.errorCounts {
+		counts[k] = v
+	}
+	return counts
+}
+
+func (stats *Stats) LatencyHistogram() *Histogram {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	return stats.latencyHistogram.copy()
+}
+
+func (stats *Stats) DBWriteHistogram() *Histogram {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	return stats.dbWriteHistogram.copy()
+}
+
+func (stats *Stats) Progress() Progress {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	return stats.progress
+}
+
+func (stats *Stats) Depth() (int, int) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	return stats.depth, stats.maxDepth
+}
+
+// LatencyPercentiles returns the 50th, 95th and 99th percentile of
+// the most recent request latencies
+func (stats *Stats) LatencyPercentiles() (time.Duration, time.Duration, time.Duration) {
+	stats.mutex.Lock()
+	sorted := make([]time.Duration, len(stats.latencies))
+	copy(sorted, stats.latencies)
+	stats.mutex.Unlock()
+
+	if len(sorted) == 0 {
+		return 0, 0, 0
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1))]
+	}
+	return percentile(0.50), percentile(0.95), percentile(0.99)
+}
+
+// ClassifyError groups a request error into a broad category
+func ClassifyError(err error) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var certErr x509.UnknownAuthorityError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset"
+	case errors.As(err, &certErr), errors.As(err, &recordErr), strings.Contains(err.Error(), "tls:"):
+		return "tls"
+	case strings.Contains(err.Error(), "EOF"):
+		return "eof"
+	default:
+		return "other"
+	}
+}
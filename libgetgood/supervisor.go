@@ -0,0 +1,180 @@
+package libgetgood
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// Policy decides what happens to a component after it fails
+type Policy string
+
+const (
+	// Start the component again, aborting once it has failed too often
+	PolicyRestart Policy = "restart"
+	// Carry on without the component
+	PolicyDegrade Policy = "degrade"
+	// Stop the scan
+	PolicyAbort Policy = "abort"
+)
+
+// Components a policy can be set for
+var supervisedComponents = []string{"updater", "expander", "poller", "monitor", "http worker", "coordinator"}
+
+// Base delay before restarting a component, multiplied by the number
+// of times it has already been restarted
+const restartDelay = 1 * time.Second
+
+// Supervisor collects the errors from a scanner's components, including
+// recovered panics, and handles each according to the component's policy
+type Supervisor struct {
+	mutex       *sync.Mutex
+	policies    map[string]Policy
+	maxRestarts int
+	restarts    map[string]int
+	errors      []*WorkerError
+	abortFunc   func(*WorkerError)
+	logger      logrus.FieldLogger
+}
+
+func NewSupervisor(policies map[string]Policy, maxRestarts int, abortFunc func(*WorkerError), logger logrus.FieldLogger) *Supervisor {
+	return &Supervisor{&sync.Mutex{}, policies, maxRestarts, make(map[string]int), make([]*WorkerError, 0), abortFunc, logger}
+}
+
+// DefaultPolicies restarts every component
+func DefaultPolicies() map[string]Policy {
+	policies := make(map[string]Policy)
+	for _, component := range supervisedComponents {
+		policies[component] = PolicyRestart
+	}
+	return policies
+}
+
+// ParsePolicies parses a comma separated list of component=policy pairs
+// on top of the given policies, any component not listed is unchanged
+func ParsePolicies(base map[string]Policy, str string) (map[string]Policy, error) {
+	policies := make(map[string]Policy)
+	for name, policy := range base {
+		policies[name] = policy
+	}
+	for _, pair := range strings.Split(str, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid policy %q, expected component=policy", pair)
+		}
+		policies[strings.TrimSpace(parts[0])] = Policy(strings.TrimSpace(parts[1]))
+	}
+	return policies, ValidatePolicies(policies)
+}
+
+func ValidatePolicies(policies map[string]Policy) error {
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		known := false
+		for _, component := range supervisedComponents {
+			known = known || name == component
+		}
+		if !known {
+			return fmt.Errorf("unknown component %q, expected one of %v", name, strings.Join(supervisedComponents, ", "))
+		}
+
+		switch policies[name] {
+		case PolicyRestart, PolicyDegrade, PolicyAbort:
+			break
+		default:
+			return fmt.Errorf("unknown policy %q for %v, expected restart, degrade or abort", policies[name], name)
+		}
+	}
+	return nil
+}
+
+// Supervise runs work until it returns without error. Errors and panics
+// are handled by the component's policy, restarting work if allowed
+func (supervisor *Supervisor) Supervise(ctx context.Context, name string, work func() error) {
+	for {
+		err := supervisor.runRecovered(work)
+		if err == nil {
+			return
+		}
+
+		restarts, policy := supervisor.handle(name, err)
+		if policy != PolicyRestart {
+			return
+		}
+
+		select {
+		case <-time.After(time.Duration(restarts) * restartDelay):
+			break
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Run work, turning a panic into an error
+func (supervisor *Supervisor) runRecovered(work func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			supervisor.logger.Debugf("%s", debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return work()
+}
+
+// Record the error and apply the component's policy, returning the
+// policy applied and how many times the component has been restarted
+func (supervisor *Supervisor) handle(name string, err error) (int, Policy) {
+	workerErr := &WorkerError{name, err}
+
+	supervisor.mutex.Lock()
+	supervisor.errors = append(supervisor.errors, workerErr)
+	policy, ok := supervisor.policies[name]
+	if !ok {
+		policy = PolicyRestart
+	}
+	if policy == PolicyRestart {
+		supervisor.restarts[name]++
+		if supervisor.restarts[name] > supervisor.maxRestarts {
+			policy = PolicyAbort
+		}
+	}
+	restarts := supervisor.restarts[name]
+	supervisor.mutex.Unlock()
+
+	supervisor.logger.Errorf("Error in worker routine: %v", name)
+	supervisor.logger.Errorf("%v", err)
+	switch policy {
+	case PolicyRestart:
+		supervisor.logger.Warnf("Restarting %v (%v of %v)", name, restarts, supervisor.maxRestarts)
+	case PolicyDegrade:
+		supervisor.logger.Warnf("Continuing without %v", name)
+	case PolicyAbort:
+		supervisor.logger.Errorf("Aborting directory bust due to %v failure", name)
+		supervisor.abortFunc(workerErr)
+	}
+	return restarts, policy
+}
+
+// Errors returns every error handled so far, oldest first
+func (supervisor *Supervisor) Errors() []*WorkerError {
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+	errors := make([]*WorkerError, len(supervisor.errors))
+	copy(errors, supervisor.errors)
+	return errors
+}
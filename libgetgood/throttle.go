@@ -0,0 +1,105 @@
+package libgetgood
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Throttle is shared between all http workers and controls whether
+// they are allowed to send requests and how quickly they may do so
+type Throttle struct {
+	mutex      *sync.Mutex
+	resumeChan chan int
+	rate       int
+	next       time.Time
+}
+
+func NewThrottle(rate int) *Throttle {
+	return &Throttle{&sync.Mutex{}, nil, rate, time.Now()}
+}
+
+func (throttle *Throttle) Pause() {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	if throttle.resumeChan == nil {
+		throttle.resumeChan = make(chan int)
+	}
+}
+
+func (throttle *Throttle) Resume() {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	if throttle.resumeChan != nil {
+		close(throttle.resumeChan)
+		throttle.resumeChan = nil
+	}
+}
+
+func (throttle *Throttle) Paused() bool {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	return throttle.resumeChan != nil
+}
+
+// SetRate sets the maximum number of requests per second across
+// all workers, zero removes the limit
+func (throttle *Throttle) SetRate(rate int) {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	throttle.rate = rate
+}
+
+func (throttle *Throttle) Rate() int {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	return throttle.rate
+}
+
+// Wait blocks while the throttle is paused and then until the rate
+// limit allows another request. Returns false if the context was
+// cancelled while waiting
+func (throttle *Throttle) Wait(ctx context.Context) bool {
+	throttle.mutex.Lock()
+	resumeChan := throttle.resumeChan
+	throttle.mutex.Unlock()
+
+	if resumeChan != nil {
+		select {
+		case <-resumeChan:
+			break
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	delay := throttle.reserve()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+			break
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reserve the next request slot and return how long to wait for it
+func (throttle *Throttle) reserve() time.Duration {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	if throttle.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	if throttle.next.Before(now) {
+		throttle.next = now
+	}
+	delay := throttle.next.Sub(now)
+	throttle.next = throttle.next.Add(time.Second / time.Duration(throttle.rate))
+	return delay
+}
@@ -1,110 +1,248 @@
 package libgetgood
 
 import (
+	"context"
 	"strings"
 	"sync"
+	"time"
 
 	. "github.com/dpindur/get-good/logger"
+	logrus "github.com/sirupsen/logrus"
 )
 
 type Updater struct {
-	running      bool
-	wg           *sync.WaitGroup
-	haltChan     chan int
-	db           *DBConn
-	errChan      chan *WorkerError
-	requestChan  chan *Request
-	responseChan chan *Response
-	words        []string
-	extensions   []string
-	recurse      bool
+	running       bool
+	wg            *sync.WaitGroup
+	ctx           context.Context
+	cancel        context.CancelFunc
+	db            *DBConn
+	supervisor    *Supervisor
+	responseChan  chan *Response
+	expander      *Expander
+	stats         *Stats
+	findingFunc   func(*Finding)
+	recurse       bool
+	hitPriority   int
+	indexPriority int
+	listedFiles   map[string]bool
+	clusters      *Clusters
+	logger        logrus.FieldLogger
 }
 
 type Request struct {
 	Url string
 }
 
-func StartUpdater(wg *sync.WaitGroup, db *DBConn, errChan chan *WorkerError, responseChan chan *Response, words []string, extensions []string, recurse bool) *Updater {
-	haltChan := make(chan int)
-	requestChan := make(chan *Request)
-	updater := &Updater{true, wg, haltChan, db, errChan, requestChan, responseChan, words, extensions, recurse}
+func StartUpdater(ctx context.Context, wg *sync.WaitGroup, db *DBConn, supervisor *Supervisor, responseChan chan *Response, expander *Expander, stats *Stats, findingFunc func(*Finding), recurse bool, hitPriority int, indexPriority int, clusters *Clusters, logger logrus.FieldLogger) *Updater {
+	ctx, cancel := context.WithCancel(ctx)
+	updater := &Updater{true, wg, ctx, cancel, db, supervisor, responseChan, expander, stats, findingFunc, recurse, hitPriority, indexPriority, make(map[string]bool), clusters, logger}
 	wg.Add(1)
 	go updater.work()
 	return updater
 }
 
-func (updater *Updater) EnqueueRequest(req *Request) {
-	updater.requestChan <- req
-}
-
 func (updater *Updater) Stop() {
-	Logger.Debugf("Sending database updater stop signal")
-	updater.haltChan <- 0
+	updater.logger.Debugf("Sending database updater stop signal")
+	updater.cancel()
 }
 
 func (updater *Updater) work() {
 	defer updater.wg.Done()
+	updater.supervisor.Supervise(updater.ctx, "updater", updater.run)
+}
 
-	Logger.Debugf("Starting database updater")
+func (updater *Updater) run() error {
+	updater.logger.Debugf("Starting database updater")
 	running := true
+	var err error
 	for running {
 		select {
-		case r := <-updater.requestChan:
-			err := updater.addURLs(r.Url)
+		case r := <-updater.responseChan:
+			err = updater.handleResponse(r)
 			if err != nil {
 				running = false
-				updater.errChan <- &WorkerError{"updater", err}
 			}
 			break
+		case <-updater.ctx.Done():
+			running = false
+			err = updater.drainResponses()
+			break
+		}
+	}
+	updater.logger.Debugf("Database updater stopped")
+	return err
+}
+
+// Record any responses still queued so completed requests aren't
+// repeated when the scan is resumed
+func (updater *Updater) drainResponses() error {
+	for {
+		select {
 		case r := <-updater.responseChan:
 			err := updater.handleResponse(r)
 			if err != nil {
-				running = false
-				updater.errChan <- &WorkerError{"updater", err}
+				return err
 			}
 			break
-		case <-updater.haltChan:
-			running = false
-			break
+		default:
+			return nil
 		}
 	}
-	Logger.Debugf("Database updater stopped")
 }
 
-func (updater *Updater) addURLs(baseURL string) error {
-	if !strings.HasSuffix(baseURL, "/") {
-		baseURL += "/"
+func (updater *Updater) handleResponse(res *Response) error {
+	if res.OutOfScope {
+		start := time.Now()
+		err := updater.db.SetRequestOutOfScope(res.Url)
+		updater.stats.RecordDBWrite(time.Since(start))
+		return err
 	}
 
-	requests := make([]string, 0)
-
-	for _, word := range updater.words {
-		for _, ext := range updater.extensions {
-			request := baseURL + word + ext
-			requests = append(requests, request)
-		}
+	// Case variants of requests already made are pruned like those
+	// still in the database
+	if res.CaseVariant {
+		start := time.Now()
+		err := updater.db.DeleteRequest(res.Url)
+		updater.stats.RecordDBWrite(time.Since(start))
+		return err
 	}
 
-	return updater.db.AddRequests(requests)
-}
-
-func (updater *Updater) handleResponse(res *Response) error {
 	if res.Success == false {
+		start := time.Now()
 		err := updater.db.SetRequestFailed(res.Url)
+		updater.stats.RecordDBWrite(time.Since(start))
 		return err
 	}
 
-	Logger.Debugf("Updating request %v", res.Url)
-	err := updater.db.SetRequestCompleted(res.Url, res.Response.StatusCode)
+	// Soft 200s for the files the detectors check are recorded without
+	// being treated as hits
+	if res.Unconfirmed {
+		updater.logger.Debugf("Response for %v doesn't match its detector's signature", res.Url)
+		start := time.Now()
+		err := updater.db.SetRequestUnconfirmed(res.Url, res.Status, res.Size, res.BodyHash, res.Redirects)
+		updater.stats.RecordDBWrite(time.Since(start))
+		return err
+	}
+
+	if res.CaseChecked {
+		err := updater.recordCase(res.Url, res.CaseInsensitive)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Hits like those already found more times than the cluster limit
+	// are recorded but neither reported nor recursed into
+	finding := &Finding{res.Url, res.Status, res.Size, res.BodyHash, res.Redirects, "", res.Detected, res.Simhash}
+	suppressed := res.Status != 404 && res.Detected == "" && updater.clusters.add(finding)
+
+	// Redirects to the same path as a directory
+	directory := isDirectoryRedirect(res)
+	// A directory's index unless it's missing, even when forbidden
+	index := strings.HasSuffix(res.Url, "/") && (res.Status == 200 || res.Status == 401 || res.Status == 403)
+	// Responses only reached by being redirected elsewhere don't count
+	success := res.Status == 200 && len(res.Redirects) == 0
+	// Exposed files and listings queue the paths they list instead
+	detected := res.Detected != ""
+	// Files shown by a listing aren't directories
+	file := updater.listedFiles[res.Url]
+	delete(updater.listedFiles, res.Url)
+	// Queued before the response is recorded so the scan is never seen as
+	// finished while the expansion is outstanding
+	recurse := updater.recurse && (success || directory || index) && !detected && !file && !suppressed
+	if recurse && directory && res.Status >= 300 && res.Status < 400 {
+		// The redirect wasn't followed, so the directory's index is
+		// requested first and only expanded if it isn't a listing
+		err := updater.addIndex(res.Redirects[0].Url)
+		if err != nil {
+			return err
+		}
+	} else if recurse {
+		updater.expander.Expand(res.Url)
+	}
+	if len(res.Links) > 0 {
+		updater.expander.Discover(res.Url, res.Links)
+	}
+	if len(res.Listed) > 0 {
+		updater.expander.List(res.Url, res.Listed)
+	}
+	if strings.HasSuffix(res.Detected, "directory listing") {
+		for _, entry := range res.Listed {
+			if !strings.HasSuffix(entry, "/") {
+				updater.listedFiles[entry] = true
+			}
+		}
+	}
+
+	updater.logger.Debugf("Updating request %v", res.Url)
+	start := time.Now()
+	err := updater.db.SetRequestCompleted(res.Url, res.Status, res.Size, res.BodyHash, res.Redirects, res.Detected, res.Simhash)
+	updater.stats.RecordDBWrite(time.Since(start))
 	if err != nil {
 		return err
 	}
 
-	// If response is successful, add recursive urls
-	if res.Response.StatusCode == 200 && updater.recurse == true {
-		Logger.Infof("[Successful response for %v](fg-green)", res.Url)
-		updater.addURLs(res.Url)
+	if suppressed {
+		updater.logger.Debugf("Suppressed hit %v", res.Url)
+		return nil
 	}
 
+	if res.Status != 404 {
+		updater.findingFunc(finding)
+
+		// A hit makes the rest of its directory more promising
+		if updater.hitPriority > 0 {
+			start = time.Now()
+			err = updater.db.BoostRequests(res.Url, updater.hitPriority)
+			updater.stats.RecordDBWrite(time.Since(start))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if res.Detected != "" {
+		updater.logger.WithField(HitField, true).Warnf("Exposed %v at %v", res.Detected, res.Url)
+	}
+	if recurse && directory {
+		updater.logger.WithField(HitField, true).Infof("Directory redirect for %v", res.Url)
+	} else if recurse {
+		updater.logger.WithField(HitField, true).Infof("Successful response for %v", res.Url)
+	}
+
+	return nil
+}
+
+// Record whether a hit's host ignores case, pruning the requests queued
+// for it which differ only by case if it does
+func (updater *Updater) recordCase(rawURL string, insensitive bool) error {
+	origin := urlOrigin(rawURL)
+	start := time.Now()
+	err := updater.db.SetHostCase(origin, insensitive)
+	updater.stats.RecordDBWrite(time.Since(start))
+	if err != nil {
+		return err
+	}
+	if !insensitive {
+		updater.logger.Infof("%v is case sensitive", origin)
+		return nil
+	}
+
+	start = time.Now()
+	pruned, err := updater.db.PruneCaseVariants(origin)
+	updater.stats.RecordDBWrite(time.Since(start))
+	if err != nil {
+		return err
+	}
+	updater.logger.WithField(HitField, true).Infof("%v is case insensitive, pruned %v queued case variants", origin, pruned)
 	return nil
 }
+
+func (updater *Updater) addIndex(index string) error {
+	updater.logger.Debugf("Requesting %v to check for a listing before expanding it", index)
+	parent := index[:strings.LastIndex(strings.TrimSuffix(index, "/"), "/")+1]
+	start := time.Now()
+	err := updater.db.AddDiscoveredRequests(parent, []string{index}, []int{updater.indexPriority}, "")
+	updater.stats.RecordDBWrite(time.Since(start))
+	return err
+}
@@ -9,6 +9,9 @@ import (
 
 var Logger = logrus.New()
 
+// HitField marks a log entry as reporting a successful response
+const HitField = "hit"
+
 func ConfigureLogger(level logrus.Level, terminal Terminal, file *os.File) {
 	timestampFormat := "2006/01/15 15:04:05"
 	fileHook := NewFileHook(file, timestampFormat, level)
@@ -18,3 +21,15 @@ func ConfigureLogger(level logrus.Level, terminal Terminal, file *os.File) {
 	Logger.AddHook(fileHook)
 	Logger.AddHook(terminalHook)
 }
+
+// ConfigureConsoleLogger logs to standard output instead of the
+// terminal, for commands which run without the terminal interface
+func ConfigureConsoleLogger(level logrus.Level, file *os.File) {
+	timestampFormat := "2006/01/15 15:04:05"
+	Logger.Level = level
+	Logger.Out = ioutil.Discard
+	Logger.AddHook(NewFileHook(os.Stdout, timestampFormat, level))
+	if file != nil {
+		Logger.AddHook(NewFileHook(file, timestampFormat, level))
+	}
+}
@@ -10,7 +10,7 @@ import (
 )
 
 type Terminal interface {
-	AddLog(log []byte)
+	AddLog(level logrus.Level, hit bool, log []byte)
 }
 
 type TerminalHook struct {
@@ -32,9 +32,14 @@ func (hook *TerminalHook) Fire(entry *logrus.Entry) error {
 	levelText := strings.ToUpper(entry.Level.String())
 	levelText = levelText[0:4]
 
-	// Extract and sort all the keys alphabetically
+	// Extract and sort all the keys alphabetically, the hit marker
+	// is passed to the terminal rather than printed
+	_, hit := entry.Data[HitField]
 	keys := make([]string, 0, len(entry.Data))
 	for k := range entry.Data {
+		if k == HitField {
+			continue
+		}
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
@@ -49,7 +54,7 @@ func (hook *TerminalHook) Fire(entry *logrus.Entry) error {
 	}
 
 	// Write buffer to terminal
-	hook.Terminal.AddLog(b.Bytes())
+	hook.Terminal.AddLog(entry.Level, hit, b.Bytes())
 	return nil
 }
 
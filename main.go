@@ -1,269 +1,137 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
-	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
-	"sync"
 
 	lib "github.com/dpindur/get-good/libgetgood"
-	. "github.com/dpindur/get-good/logger"
-	ui "github.com/dpindur/get-good/ui"
 	_ "github.com/mattn/go-sqlite3"
-	logrus "github.com/sirupsen/logrus"
 )
 
-func main() {
-	workerCount := flag.Int("workers", 5, "number of worker threads")
-	clearDB := flag.Bool("clear-db", false, "clear the database before starting")
-	dbFile := flag.String("db", "bust.db", "database file to store results")
-	logFileStr := flag.String("log-file", "bust.log", "log file to output progress to")
-	logLevelStr := flag.String("log-level", "info", "what level of logs and up should be logged (debug, info, warn, error, fatal, panic)")
-	urlStr := flag.String("url", "", "url to perform directory bust against")
-	wordsFile := flag.String("wordlist", "", "wordlist file to use")
-	extensionsFlag := flag.String("extensions", "html,php", "comma separated list of extensions to append")
-	queueSize := flag.Int("queue-size", 5000, "number of urls that can sit in the queue at one time")
-	pollerBatchSize := flag.Int("poller-batch-size", 5000, "number of urls the poller can pull from the database in one go")
-	timeout := flag.Int("timeout", 10, "http timeout in seconds, specify zero for no timeout")
-	recurse := flag.Bool("recurse", false, "recursively search directories")
-
-	flag.Parse()
-	flagsInvalid := false
-
-	// Workers
-	if *workerCount < 1 {
-		fmt.Printf("please specify 1 or more worker threads\n")
-		flagsInvalid = true
-	}
-
-	// Database File
-	if !strings.HasSuffix(*dbFile, ".db") {
-		*dbFile += ".db"
-	}
-	dbFilePath, err := filepath.Abs(*dbFile)
-	if err != nil {
-		fmt.Printf("error resolving path %v\n", *dbFile)
-		flagsInvalid = true
-	}
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(args []string) int
+}
 
-	// Url
-	urlProvided := true
-	if *urlStr == "" {
-		fmt.Printf("please provide a URL to perform the directory bust against\n")
-		flagsInvalid = true
-		urlProvided = false
-	}
-	if !strings.HasSuffix(*urlStr, "/") {
-		*urlStr += "/"
-	}
-	_, err = url.ParseRequestURI(*urlStr)
-	if err != nil && urlProvided {
-		fmt.Printf("error parsing url, please ensure it includes the protocol for example http://google.com/\n")
-		flagsInvalid = true
-	}
+var commands = []*command{
+	{"scan", "scan [flags]", "start a new directory bust", scanCommand},
+	{"resume", "resume <db> [flags]", "resume the directory bust stored in a database", resumeCommand},
+	{"export", "export [flags] <db>", "export the findings from a database", exportCommand},
+	{"stats", "stats <db>", "summarise the directory bust stored in a database", statsCommand},
+	{"diff", "diff [flags] <db> [new db]", "compare the findings of two sessions or two databases", diffCommand},
+	{"agent", "agent [flags]", "make requests leased from a scan started with -coordinator-addr", agentCommand},
+	{"merge", "merge [flags] <db> <db>...", "merge the requests of several databases into one", mergeCommand},
+	{"prune", "prune [flags] <db>", "remove requests which found nothing and shrink a database", pruneCommand},
+	{"upgrade", "upgrade <db>", "add anything newer versions store to a database from an older version", upgradeCommand},
+}
 
-	// Wordlist
-	if *wordsFile == "" {
-		fmt.Printf("please provide a wordlist file\n")
-		flagsInvalid = true
-	}
-	wordsFilePath, err := filepath.Abs(*wordsFile)
-	if err != nil {
-		fmt.Printf("error resolving path %v\n", *wordsFile)
-		flagsInvalid = true
-	}
+var helpFlags = map[string]bool{"-h": true, "-help": true, "--help": true}
 
-	// Extensions
-	splitExtensions := strings.Split(*extensionsFlag, ",")
-	extensions := make([]string, 0)
-	extensions = append(extensions, "")
-	for _, ext := range splitExtensions {
-		if !strings.HasPrefix(ext, ".") {
-			extensions = append(extensions, "."+ext)
-		} else {
-			extensions = append(extensions, ext)
+func main() {
+	// Without a command the flags are for a scan, as they were before
+	// there were commands
+	name, args := "scan", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	} else if len(args) == 1 && helpFlags[args[0]] {
+		name = "help"
+	}
+
+	if name == "help" {
+		usage()
+		os.Exit(0)
+	}
+	for _, command := range commands {
+		if command.name == name {
+			os.Exit(command.run(args))
 		}
 	}
 
-	// Logging
-	logLevel, err := logrus.ParseLevel(strings.ToLower(*logLevelStr))
-	if err != nil {
-		fmt.Printf("not a valid log level %v\n", *logLevelStr)
-		flagsInvalid = true
-	}
-
-	logFile, err := os.OpenFile(*logFileStr, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
-	if err != nil {
-		fmt.Printf("error opening logfile %v\n", *logFileStr)
-		flagsInvalid = true
-	}
-
-	// Performance modifiers
-	if *queueSize < 1 {
-		fmt.Printf("please specify 1 or more for queue size\n")
-		flagsInvalid = true
-	}
+	fmt.Printf("unknown command %v\n\n", name)
+	usage()
+	os.Exit(1)
+}
 
-	if *pollerBatchSize < 1 {
-		fmt.Printf("please specify 1 or more for poller batch size\n")
-		flagsInvalid = true
+func usage() {
+	fmt.Printf("Usage: get-good <command> [arguments]\n\nCommands:\n")
+	for _, command := range commands {
+		fmt.Printf("  %-32v%v\n", command.usage, command.description)
 	}
+	fmt.Printf("\nUse \"get-good <command> -h\" for the flags of a command\n")
+}
 
-	if *timeout < 0 {
-		fmt.Printf("please specify 0 or more for http client timeout\n")
-		flagsInvalid = true
+// Print an error from loading flags and return the exit code, asking
+// for help isn't an error
+func configError(err error) int {
+	if err == flag.ErrHelp {
+		return 0
 	}
+	fmt.Printf("%v\n", err)
+	return 1
+}
 
-	if flagsInvalid {
-		os.Exit(1)
+// Create the flags for one of the commands which work with an
+// existing database, usage is the command followed by its arguments
+func newFlagSet(usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet("get-good "+strings.Fields(usage)[0], flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: get-good %v\n", usage)
+		flags.PrintDefaults()
 	}
+	return flags
+}
 
-	pauseChan := make(chan int, 1)
-	terminal, err := ui.NewTerminal(pauseChan)
-	if err != nil {
-		os.Exit(1)
+// Open a database created by a previous directory bust, without
+// creating one if it doesn't exist
+func openExistingDatabase(filename string) (*lib.DBConn, error) {
+	filename = dbFilename(filename)
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
 	}
-	terminal.Render()
-
-	ConfigureLogger(logLevel, terminal, logFile)
-	Logger.Infof("Starting get-good directory bust of %v, press q to stop", *urlStr)
-	Logger.Infof("Worker threads: %v", *workerCount)
-	Logger.Infof("Database file: %v", dbFilePath)
-	Logger.Infof("Wordlist file: %v", wordsFilePath)
-	Logger.Infof("Extensions: (blank)%v", strings.Join(extensions, ", "))
-	Logger.Infof("Resuming existing directory bust: %v", !*clearDB)
-	Logger.Infof("Logging to file: %v", *logFileStr)
-	Logger.Infof("Configured logging level: %v", *logLevelStr)
-	Logger.Infof("Queue size: %v", *queueSize)
-	Logger.Infof("Poller batch size: %v", *pollerBatchSize)
 
-	db, err := lib.OpenDatabaseConnection(dbFilePath)
+	db, err := lib.OpenDatabaseConnection(filename)
 	if err != nil {
-		Logger.Errorf("Error opening database connection")
-		Logger.Errorf("%v", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("error opening database connection: %v", err)
 	}
 
-	defer func() {
-		err = db.CloseDatabaseConnection()
-		if err != nil {
-			Logger.Errorf("Error closing database connection")
-			Logger.Errorf("%v", err)
-			os.Exit(1)
-		}
-	}()
-
 	err = db.CreateSchema()
 	if err != nil {
-		Logger.Errorf("Error creating database schema")
-		Logger.Errorf("%v", err)
-		os.Exit(1)
-	}
-
-	if *clearDB {
-		err = db.Clear()
-		if err != nil {
-			Logger.Errorf("Error clearing database")
-			Logger.Errorf("%v", err)
-			os.Exit(1)
-		}
+		db.CloseDatabaseConnection()
+		return nil, fmt.Errorf("error creating database schema: %v", err)
 	}
+	return db, nil
+}
 
-	err = db.ResetInflightRequests()
-	if err != nil {
-		Logger.Errorf("Error resetting inflight requests")
-		Logger.Errorf("%v", err)
-		os.Exit(1)
+// Open a database created by a previous directory bust to be read,
+// leaving it unchanged. A database from an older version can't be read
+// until it has been upgraded
+func openReadOnlyDatabase(filename string) (*lib.DBConn, error) {
+	filename = dbFilename(filename)
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
 	}
 
-	err = db.ResetFailedRequests()
+	db, err := lib.OpenReadOnlyDatabase(filename)
 	if err != nil {
-		Logger.Errorf("Error resetting failed requests")
-		Logger.Errorf("%v", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("error opening database connection: %v", err)
 	}
 
-	// Process the wordlist
-	words := make([]string, 0)
-	wordlist, err := os.Open(wordsFilePath)
+	err = db.CheckSchema()
 	if err != nil {
-		Logger.Errorf("Error opening wordlist file")
-		Logger.Errorf("%v", err)
-		os.Exit(1)
-	}
-	scanner := bufio.NewScanner(wordlist)
-	for scanner.Scan() {
-		word := scanner.Text()
-		words = append(words, word)
+		db.CloseDatabaseConnection()
+		return nil, fmt.Errorf("%v was written by an older version, %v, run \"get-good upgrade %v\" to read it", filename, err, filename)
 	}
-	err = scanner.Err()
-	if err != nil {
-		Logger.Errorf("Error reading wordlist file")
-		Logger.Errorf("%v", err)
-		os.Exit(1)
-	}
-
-	// Handler for worker errors
-	errChan := make(chan *lib.WorkerError)
-	var workerErr *lib.WorkerError
-	go func() {
-		workerErr = <-errChan
-		Logger.Errorf("Error in worker routine: %v", workerErr.Worker)
-		Logger.Errorf("%v", workerErr.Error)
-	}()
-
-	// Start database workers
-	wg := &sync.WaitGroup{}
-	httpWg := &sync.WaitGroup{}
-	requestChan := make(chan *lib.Request, *queueSize)
-	responseChan := make(chan *lib.Response, *queueSize)
-	bustCompleteChan := make(chan int, 1)
-	updater := lib.StartUpdater(wg, db, errChan, responseChan, words, extensions, *recurse)
-	poller := lib.StartPoller(wg, db, *pollerBatchSize, errChan, requestChan)
-	monitor := lib.StartMonitor(wg, db, terminal, errChan, bustCompleteChan)
+	return db, nil
+}
 
-	// Start http workers
-	workers := make([]*lib.HttpWorker, 0)
-	for i := 0; i < *workerCount; i++ {
-		worker := lib.StartHttpWorker(httpWg, db, requestChan, responseChan, *timeout)
-		workers = append(workers, worker)
+// Database files are always given the .db extension
+func dbFilename(filename string) string {
+	if !strings.HasSuffix(filename, ".db") {
+		filename += ".db"
 	}
-
-	// Enqueue initial request
-	updater.EnqueueRequest(&lib.Request{*urlStr})
-	go func() {
-		select {
-		case <-bustCompleteChan:
-			Logger.Infof("Directory bust complete, stopping...")
-			break
-		case <-pauseChan:
-			Logger.Infof("Stopping...")
-			break
-		}
-
-		poller.Stop()
-		for _, worker := range workers {
-			worker.Stop()
-		}
-
-		Logger.Infof("Waiting for http workers to stop...")
-		httpWg.Wait()
-		monitor.Stop()
-		updater.Stop()
-
-		if workerErr == nil {
-			Logger.Infof("Waiting for updater, poller and monitor to stop...")
-			wg.Wait()
-			lib.CleanupClient()
-		} else {
-			Logger.Warnf("Terminating without properly halting routines... sorry")
-		}
-
-		terminal.StopLoop()
-	}()
-	terminal.Loop()
+	return filename
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	config "github.com/dpindur/get-good/config"
+	lib "github.com/dpindur/get-good/libgetgood"
+)
+
+// Settings stored in one of the databases being merged
+type mergeInput struct {
+	db           string
+	options      *lib.Options
+	wordlistHash string
+	technologies []string
+}
+
+func mergeCommand(args []string) int {
+	flags := newFlagSet("merge [flags] <db> <db>...")
+	output := flags.String("output", "", "database file to write the merged requests to, must not already exist")
+	positional, err := config.ParseFlags(flags, args)
+	if err != nil {
+		return configError(err)
+	}
+	if len(positional) < 2 {
+		fmt.Printf("please provide two or more databases to merge\n")
+		return 1
+	}
+	if *output == "" {
+		fmt.Printf("please provide the database to write the merged requests to with -output\n")
+		return 1
+	}
+	outputFile := dbFilename(*output)
+	if _, err := os.Stat(outputFile); err == nil {
+		fmt.Printf("%v already exists, please provide a new database to merge into\n", outputFile)
+		return 1
+	}
+
+	inputs := make([]*mergeInput, 0, len(positional))
+	for _, filename := range positional {
+		input, err := readMergeInput(filename)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+		inputs = append(inputs, input)
+	}
+
+	options, wordlistHash, err := mergeOptions(inputs)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	db, err := lib.OpenDatabaseConnection(outputFile)
+	if err != nil {
+		fmt.Printf("error opening database connection: %v\n", err)
+		return 1
+	}
+	defer db.CloseDatabaseConnection()
+
+	err = db.CreateSchema()
+	if err != nil {
+		fmt.Printf("error creating database schema: %v\n", err)
+		return 1
+	}
+
+	for _, input := range inputs {
+		merged, err := db.Merge(dbFilename(input.db))
+		if err != nil {
+			fmt.Printf("error merging %v: %v\n", input.db, err)
+			return 1
+		}
+		fmt.Printf("Merged %v requests from %v\n", merged, input.db)
+	}
+
+	// Store the settings so the remaining work can be resumed
+	if options != nil {
+		options.DBFile = outputFile
+		options.ClearDB = false
+		options.Extend = false
+		err = db.SaveOptions(options, wordlistHash)
+		if err != nil {
+			fmt.Printf("error saving options: %v\n", err)
+			return 1
+		}
+		_, err = db.StartSession(options.URL)
+		if err != nil {
+			fmt.Printf("error starting session: %v\n", err)
+			return 1
+		}
+		err = db.SetSessionTechnologies(mergeTechnologies(inputs))
+		if err != nil {
+			fmt.Printf("error saving technologies: %v\n", err)
+			return 1
+		}
+	}
+
+	remaining, err := db.GetRemainingRequestCount()
+	if err != nil {
+		fmt.Printf("error reading database: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Merged %v databases into %v, %v requests remaining\n", len(inputs), outputFile, remaining)
+	return 0
+}
+
+func readMergeInput(filename string) (*mergeInput, error) {
+	db, err := openReadOnlyDatabase(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer db.CloseDatabaseConnection()
+
+	options, err := db.LoadOptions()
+	if err != nil {
+		return nil, fmt.Errorf("error loading stored options from %v: %v", filename, err)
+	}
+	wordlistHash, err := db.LoadWordlistHash()
+	if err != nil {
+		return nil, fmt.Errorf("error loading stored wordlist hash from %v: %v", filename, err)
+	}
+	sessions, err := db.GetSessions()
+	if err != nil {
+		return nil, fmt.Errorf("error reading sessions from %v: %v", filename, err)
+	}
+	technologies := make([]string, 0)
+	if len(sessions) > 0 {
+		technologies = sessions[len(sessions)-1].Technologies
+	}
+	return &mergeInput{filename, options, wordlistHash, technologies}, nil
+}
+
+// Work out the settings for the merged database from those of the
+// inputs. Every input must be a bust of the same target. Inputs which
+// used different wordlists, such as a wordlist split between machines,
+// are resumed with their words combined
+func mergeOptions(inputs []*mergeInput) (*lib.Options, string, error) {
+	var options *lib.Options
+	wordlistHash := ""
+	sameWordlist := true
+	for _, input := range inputs {
+		if input.options == nil {
+			fmt.Printf("%v has no stored settings, assuming it is a bust of the same target\n", input.db)
+			continue
+		}
+		if options == nil {
+			options = input.options
+			wordlistHash = input.wordlistHash
+			continue
+		}
+
+		if input.options.URL != options.URL {
+			return nil, "", fmt.Errorf("%v is a bust of %v not %v, only busts of the same target can be merged", input.db, input.options.URL, options.URL)
+		}
+		if strings.Join(input.options.Extensions, ",") != strings.Join(options.Extensions, ",") {
+			fmt.Printf("%v used different extensions, resuming the merged bust will use %v\n", input.db, strings.Join(options.Extensions, ","))
+		}
+		if input.wordlistHash != wordlistHash {
+			sameWordlist = false
+		}
+	}
+	if options == nil || sameWordlist {
+		return options, wordlistHash, nil
+	}
+
+	words, err := combineWordlists(inputs)
+	if err != nil {
+		fmt.Printf("Unable to combine the wordlists, the merged bust can't check its wordlist is unchanged when resumed: %v\n", err)
+		return options, "", nil
+	}
+	fmt.Printf("Busts used different wordlists, resuming the merged bust will use their %v words combined\n", len(words))
+	options.Wordlist = ""
+	options.Words = words
+	return options, lib.WordlistHash(words), nil
+}
+
+// The words of every input's wordlist in the order given, each only
+// once. A wordlist which has changed since its bust was run is refused
+func combineWordlists(inputs []*mergeInput) ([]string, error) {
+	seen := make(map[string]bool)
+	combined := make([]string, 0)
+	for _, input := range inputs {
+		if input.options == nil {
+			continue
+		}
+		words := input.options.Words
+		if len(words) == 0 {
+			var err error
+			words, err = lib.ReadWordlist(input.options.Wordlist)
+			if err != nil {
+				return nil, fmt.Errorf("error reading the wordlist of %v: %v", input.db, err)
+			}
+		}
+		if input.wordlistHash != "" && lib.WordlistHash(words) != input.wordlistHash {
+			return nil, fmt.Errorf("the wordlist of %v has changed since it was run", input.db)
+		}
+		for _, word := range words {
+			if !seen[word] {
+				seen[word] = true
+				combined = append(combined, word)
+			}
+		}
+	}
+	return combined, nil
+}
+
+// Everything the inputs found the target to run
+func mergeTechnologies(inputs []*mergeInput) []string {
+	seen := make(map[string]bool)
+	technologies := make([]string, 0)
+	for _, input := range inputs {
+		for _, technology := range input.technologies {
+			if !seen[technology] {
+				seen[technology] = true
+				technologies = append(technologies, technology)
+			}
+		}
+	}
+	return technologies
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	config "github.com/dpindur/get-good/config"
+)
+
+func pruneCommand(args []string) int {
+	flags := newFlagSet("prune [flags] <db>")
+	force := flags.Bool("force", false, "prune even though the directory bust hasn't finished, resuming it will request the pruned urls again")
+	positional, err := config.ParseFlags(flags, args)
+	if err != nil {
+		return configError(err)
+	}
+	if len(positional) != 1 {
+		fmt.Printf("please provide the database to prune\n")
+		return 1
+	}
+
+	db, err := openExistingDatabase(positional[0])
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	defer db.CloseDatabaseConnection()
+
+	// Pruned requests are added again when a directory is expanded,
+	// so an unfinished bust would request them a second time
+	remaining, err := db.GetRemainingRequestCount()
+	if err != nil {
+		fmt.Printf("error reading database: %v\n", err)
+		return 1
+	}
+	if remaining > 0 && !*force {
+		fmt.Printf("directory bust has %v requests remaining, finish it first or use -force\n", remaining)
+		return 1
+	}
+
+	before := fileSize(positional[0])
+	pruned, err := db.PruneRequests()
+	if err != nil {
+		fmt.Printf("error pruning requests: %v\n", err)
+		return 1
+	}
+	err = db.Vacuum()
+	if err != nil {
+		fmt.Printf("error vacuuming database: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Removed %v requests, database shrunk from %v to %v bytes\n", pruned, before, fileSize(positional[0]))
+	return 0
+}
+
+func fileSize(filename string) int64 {
+	info, err := os.Stat(dbFilename(filename))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	api "github.com/dpindur/get-good/api"
+	config "github.com/dpindur/get-good/config"
+	lib "github.com/dpindur/get-good/libgetgood"
+	. "github.com/dpindur/get-good/logger"
+	ui "github.com/dpindur/get-good/ui"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// Amount the rate limit changes by each time it is raised or lowered
+const rateStep = 10
+
+func scanCommand(args []string) int {
+	cfg, err := config.LoadScan(args)
+	if err != nil {
+		return configError(err)
+	}
+	return runScan(cfg)
+}
+
+func resumeCommand(args []string) int {
+	cfg, err := config.LoadResume(args)
+	if err != nil {
+		return configError(err)
+	}
+	return runScan(cfg)
+}
+
+// Run a scan in the terminal, along with the metrics and api servers if enabled
+func runScan(cfg *config.Config) int {
+	flagsInvalid := false
+	for _, problem := range cfg.Validate() {
+		fmt.Printf("%v\n", problem)
+		flagsInvalid = true
+	}
+
+	// Database File
+	var err error
+	cfg.DBFile, err = filepath.Abs(dbFilename(cfg.DBFile))
+	if err != nil {
+		fmt.Printf("error resolving path %v\n", cfg.DBFile)
+		flagsInvalid = true
+	}
+
+	// Url
+	urlProvided := cfg.URL != ""
+	if !strings.HasSuffix(cfg.URL, "/") {
+		cfg.URL += "/"
+	}
+	_, err = url.ParseRequestURI(cfg.URL)
+	if err != nil && urlProvided {
+		fmt.Printf("error parsing url, please ensure it includes the protocol for example http://google.com/\n")
+		flagsInvalid = true
+	}
+
+	// Wordlist
+	if cfg.Wordlist != "" {
+		cfg.Wordlist, err = filepath.Abs(cfg.Wordlist)
+		if err != nil {
+			fmt.Printf("error resolving path %v\n", cfg.Wordlist)
+			flagsInvalid = true
+		}
+	}
+
+	// Logging
+	logLevel, err := logrus.ParseLevel(strings.ToLower(cfg.LogLevel))
+	if err != nil {
+		fmt.Printf("not a valid log level %v\n", cfg.LogLevel)
+		flagsInvalid = true
+	}
+
+	logFile, err := os.OpenFile(cfg.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		fmt.Printf("error opening logfile %v\n", cfg.LogFile)
+		flagsInvalid = true
+	}
+
+	if flagsInvalid {
+		return 1
+	}
+
+	// Key presses made while a command is handled are queued, beyond
+	// that the terminal drops them rather than blocking
+	commandChan := make(chan ui.Command, 10)
+	terminal, err := ui.NewTerminal(commandChan, cfg.LogLines)
+	if err != nil {
+		return 1
+	}
+	terminal.Render()
+
+	ConfigureLogger(logLevel, terminal, logFile)
+	Logger.Infof("Press q to stop (twice to exit immediately), p to pause/resume, +/- to add/remove workers, ]/[ to raise/lower rate limit, s to skip recursion branch")
+	Logger.Infof("Logs: up/down/pgup/pgdn/home to scroll, l to cycle level, h for hits only, / to search, esc to clear search")
+	Logger.Infof("Logging to file: %v", cfg.LogFile)
+	Logger.Infof("Configured logging level: %v", cfg.LogLevel)
+
+	events := lib.NewEvents()
+	controller := lib.NewController(events, func(report *lib.Report) {
+		displayReport(terminal, report)
+	})
+
+	var metrics *lib.MetricsServer
+	if cfg.MetricsAddr != "" {
+		metrics, err = lib.StartMetricsServer(cfg.MetricsAddr, controller, Logger)
+		if err != nil {
+			Logger.Errorf("Error starting metrics server")
+			Logger.Errorf("%v", err)
+			return 1
+		}
+		Logger.Infof("Serving metrics on: http://%v/metrics", cfg.MetricsAddr)
+	}
+
+	var server *api.Server
+	if cfg.API {
+		token := cfg.APIToken
+		if token == "" {
+			token, err = api.GenerateToken()
+			if err != nil {
+				Logger.Errorf("Error generating api token")
+				Logger.Errorf("%v", err)
+				return 1
+			}
+		}
+		server, err = api.StartServer(cfg.APIAddr, token, controller)
+		if err != nil {
+			Logger.Errorf("Error starting api server")
+			Logger.Errorf("%v", err)
+			return 1
+		}
+		Logger.Infof("Serving api on: http://%v with token %v", cfg.APIAddr, token)
+	}
+
+	if urlProvided {
+		options := cfg.Options
+		_, err = controller.Start(&options)
+		if err != nil {
+			Logger.Errorf("Error starting directory bust")
+			Logger.Errorf("%v", err)
+			return 1
+		}
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		running := true
+		for running {
+			// Without the api there is nothing left to do once the scan is done
+			var doneChan chan int
+			if scan := controller.Scanner(); scan != nil && !cfg.API {
+				doneChan = scan.Done()
+			}
+
+			select {
+			case <-doneChan:
+				running = false
+				break
+			case sig := <-signalChan:
+				Logger.Infof("Received %v", sig)
+				running = false
+				break
+			case command := <-commandChan:
+				if command == ui.Quit {
+					running = false
+					break
+				}
+				scan := controller.Scanner()
+				if scan == nil {
+					Logger.Infof("No directory bust has been started")
+					break
+				}
+				handleCommand(scan, command)
+				terminal.SetStatus(scan.Paused(), scan.Workers(), scan.Rate())
+				break
+			}
+		}
+
+		// A second quit or signal exits without waiting for the
+		// scan to finish stopping
+		if scan := controller.Scanner(); scan != nil {
+			scan.Stop()
+			waiting := true
+			for waiting {
+				select {
+				case <-scan.Done():
+					waiting = false
+					break
+				case <-signalChan:
+					Logger.Warnf("Exiting without waiting for the directory bust to stop")
+					waiting = false
+					break
+				case command := <-commandChan:
+					if command == ui.Quit {
+						Logger.Warnf("Exiting without waiting for the directory bust to stop")
+						waiting = false
+					}
+					break
+				}
+			}
+		}
+		if server != nil {
+			server.Stop()
+		}
+		if metrics != nil {
+			metrics.Stop()
+		}
+
+		terminal.StopLoop()
+	}()
+	terminal.Loop()
+
+	// The terminal has been closed, so repeat why the scan failed
+	if scan := controller.Scanner(); scan != nil && scan.Err() != nil {
+		fmt.Printf("Error running directory bust: %v\n", scan.Err())
+		return 1
+	}
+	return 0
+}
+
+// Copy a scanner report onto the terminal
+func displayReport(terminal *ui.Terminal, report *lib.Report) {
+	terminal.SetRequestsPerSecond(report.RequestsPerSecond)
+	terminal.SetETA(report.ETA)
+	terminal.SetCompletedRequests(report.Completed, report.Total)
+	terminal.SetFailedRequests(report.Failed)
+	terminal.SetStatusCounts(report.StatusCounts)
+	terminal.SetErrorCounts(report.ErrorCounts)
+	terminal.SetLatency(report.LatencyP50, report.LatencyP95, report.LatencyP99)
+	terminal.SetDepth(report.Depth, report.MaxDepth)
+	terminal.SetStatus(report.Paused, report.Workers, report.Rate)
+
+	targets := make([]ui.TargetProgress, 0, len(report.Targets))
+	for _, t := range report.Targets {
+		targets = append(targets, ui.TargetProgress{Target: t.Target, Completed: t.Completed, Total: t.Total})
+	}
+	terminal.SetTargetProgress(targets)
+
+	clusters := make([]ui.Cluster, 0, len(report.Clusters))
+	for _, c := range report.Clusters {
+		clusters = append(clusters, ui.Cluster{Url: c.Representative.Url, Status: c.Representative.Status, Count: c.Count})
+	}
+	terminal.SetClusters(clusters)
+}
+
+func handleCommand(scan *lib.Scanner, command ui.Command) {
+	switch command {
+	case ui.TogglePause:
+		if scan.Paused() {
+			scan.Resume()
+		} else {
+			scan.Pause()
+		}
+	case ui.AddWorker:
+		scan.SetWorkers(scan.Workers() + 1)
+	case ui.RemoveWorker:
+		if scan.Workers() == 1 && scan.Options().CoordinatorAddr == "" {
+			Logger.Infof("Cannot remove the last worker thread, press p to pause instead")
+			break
+		}
+		if scan.Workers() == 0 {
+			Logger.Infof("No worker threads left to remove")
+			break
+		}
+		scan.SetWorkers(scan.Workers() - 1)
+	case ui.RaiseRate:
+		if scan.Rate() == 0 {
+			Logger.Infof("Rate limit is already unlimited")
+			break
+		}
+		scan.SetRate(scan.Rate() + rateStep)
+	case ui.LowerRate:
+		lowered := scan.Rate() - rateStep
+		if scan.Rate() == 0 {
+			lowered = rateStep
+		}
+		if lowered < 1 {
+			lowered = 1
+		}
+		scan.SetRate(lowered)
+	case ui.SkipBranch:
+		scan.SkipBranch()
+	}
+}
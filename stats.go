@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	config "github.com/dpindur/get-good/config"
+	lib "github.com/dpindur/get-good/libgetgood"
+)
+
+func statsCommand(args []string) int {
+	flags := newFlagSet("stats <db>")
+	positional, err := config.ParseFlags(flags, args)
+	if err != nil {
+		return configError(err)
+	}
+	if len(positional) != 1 {
+		fmt.Printf("please provide the database to summarise\n")
+		return 1
+	}
+
+	db, err := openReadOnlyDatabase(positional[0])
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	defer db.CloseDatabaseConnection()
+
+	err = printStats(db)
+	if err != nil {
+		fmt.Printf("error reading database: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func printStats(db *lib.DBConn) error {
+	options, err := db.LoadOptions()
+	if err != nil {
+		return err
+	}
+	if options != nil {
+		fmt.Printf("Target:      %v\n", options.URL)
+		if options.Wordlist == "" {
+			fmt.Printf("Wordlist:    %v stored words\n", len(options.Words))
+		} else {
+			fmt.Printf("Wordlist:    %v\n", options.Wordlist)
+		}
+		fmt.Printf("Extensions:  %v\n", strings.Join(options.Extensions, ", "))
+		fmt.Printf("Recurse:     %v\n", options.Recurse)
+	}
+
+	total, err := db.GetTotalRequestCount()
+	if err != nil {
+		return err
+	}
+	completed, err := db.GetCompletedRequestCount()
+	if err != nil {
+		return err
+	}
+	remaining, err := db.GetRemainingRequestCount()
+	if err != nil {
+		return err
+	}
+	failed, err := db.GetFailedRequestCount()
+	if err != nil {
+		return err
+	}
+	skipped, err := db.GetSkippedRequestCount()
+	if err != nil {
+		return err
+	}
+	outOfScope, err := db.GetOutOfScopeRequestCount()
+	if err != nil {
+		return err
+	}
+	unconfirmed, err := db.GetUnconfirmedRequestCount()
+	if err != nil {
+		return err
+	}
+	targets, err := db.GetTargetCount()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Requests:    %v total, %v completed, %v remaining, %v failed, %v skipped, %v out of scope, %v unconfirmed\n", total, completed, remaining, failed, skipped, outOfScope, unconfirmed)
+	fmt.Printf("Directories: %v\n", targets)
+
+	counts, err := db.GetStatusCounts()
+	if err != nil {
+		return err
+	}
+	statuses := make([]int, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+
+	fmt.Printf("Statuses:\n")
+	for _, status := range statuses {
+		fmt.Printf("  %v  %v\n", status, counts[status])
+	}
+
+	sessions, err := db.GetSessions()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sessions:\n")
+	for _, session := range sessions {
+		fmt.Printf("  %v  %v  %v", session.ID, session.Started.Format("2006-01-02 15:04:05"), session.URL)
+		if len(session.Technologies) > 0 {
+			fmt.Printf("  (%v)", strings.Join(session.Technologies, ", "))
+		}
+		fmt.Printf("\n")
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package ui
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Number of requests per second samples kept for the sparkline
+const rateSamples = 200
+
+// Width of the bars drawn in the status code histogram
+const histogramWidth = 12
+
+type TargetProgress struct {
+	Target    string
+	Completed int
+	Total     int
+}
+
+// Cluster is a group of near identical hits, shown by its first hit
+type Cluster struct {
+	Url    string
+	Status int
+	Count  int
+}
+
+func (terminal *Terminal) SetStatusCounts(counts map[int]int) {
+	statuses := make([]int, 0, len(counts))
+	max := 0
+	for status, count := range counts {
+		statuses = append(statuses, status)
+		if count > max {
+			max = count
+		}
+	}
+	sort.Ints(statuses)
+
+	b := &strings.Builder{}
+	for _, status := range statuses {
+		count := counts[status]
+		width := count * histogramWidth / max
+		if width == 0 {
+			width = 1
+		}
+		bar := strings.Repeat("█", width) + strings.Repeat(" ", histogramWidth-width)
+		fmt.Fprintf(b, "%v [%v](%v) %v\n", status, bar, statusColor(status), count)
+	}
+
+	terminal.mutex.Lock()
+	terminal.StatusCounts = b.String()
+	terminal.mutex.Unlock()
+}
+
+func statusColor(status int) string {
+	switch {
+	case status < 300:
+		return "fg-green"
+	case status < 400:
+		return "fg-cyan"
+	case status < 500:
+		return "fg-yellow"
+	default:
+		return "fg-red"
+	}
+}
+
+func (terminal *Terminal) SetLatency(p50 time.Duration, p95 time.Duration, p99 time.Duration) {
+	terminal.mutex.Lock()
+	terminal.Latency = fmt.Sprintf("p50 %v  p95 %v  p99 %v", roundDuration(p50), roundDuration(p95), roundDuration(p99))
+	terminal.mutex.Unlock()
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	if d > time.Second {
+		return d.Round(10 * time.Millisecond)
+	}
+	return d.Round(time.Millisecond)
+}
+
+func (terminal *Terminal) SetErrorCounts(counts map[string]int) {
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return counts[kinds[i]] > counts[kinds[j]] })
+
+	b := &strings.Builder{}
+	for _, kind := range kinds {
+		fmt.Fprintf(b, "[%v](fg-red): %v\n", kind, counts[kind])
+	}
+
+	terminal.mutex.Lock()
+	terminal.ErrorCounts = b.String()
+	terminal.mutex.Unlock()
+}
+
+func (terminal *Terminal) SetETA(eta time.Duration) {
+	terminal.mutex.Lock()
+	defer terminal.mutex.Unlock()
+	if eta <= 0 {
+		terminal.ETA = "unknown"
+		return
+	}
+	terminal.ETA = eta.Round(time.Second).String()
+}
+
+func (terminal *Terminal) SetDepth(depth int, maxDepth int) {
+	terminal.mutex.Lock()
+	terminal.Depth = fmt.Sprintf("%v (max %v)", depth, maxDepth)
+	terminal.mutex.Unlock()
+}
+
+func (terminal *Terminal) SetTargetProgress(targets []TargetProgress) {
+	b := &strings.Builder{}
+	for _, target := range targets {
+		percent := 0.0
+		if target.Total > 0 {
+			percent = float64(target.Completed) / float64(target.Total) * 100
+		}
+		fmt.Fprintf(b, "%v %v/%v (%.0f%%)\n", targetPath(target.Target), target.Completed, target.Total, percent)
+	}
+
+	terminal.mutex.Lock()
+	terminal.Targets = b.String()
+	terminal.mutex.Unlock()
+}
+
+func (terminal *Terminal) SetClusters(clusters []Cluster) {
+	b := &strings.Builder{}
+	for _, cluster := range clusters {
+		fmt.Fprintf(b, "[%v](%v) %v x%v\n", cluster.Status, statusColor(cluster.Status), targetPath(cluster.Url), cluster.Count)
+	}
+
+	terminal.mutex.Lock()
+	terminal.Clusters = b.String()
+	terminal.mutex.Unlock()
+}
+
+// Strip the scheme and host from a target to save space
+func targetPath(target string) string {
+	if target == "" {
+		return "(unknown)"
+	}
+	scheme := strings.Index(target, "://")
+	if scheme < 0 {
+		return target
+	}
+	path := strings.Index(target[scheme+3:], "/")
+	if path < 0 {
+		return "/"
+	}
+	return target[scheme+3+path:]
+}
+
+// Called with the terminal mutex held
+func (terminal *Terminal) addRateSample(rps float64) {
+	terminal.RateSamples = append(terminal.RateSamples, int(rps+0.5))
+	if len(terminal.RateSamples) > rateSamples {
+		terminal.RateSamples = terminal.RateSamples[len(terminal.RateSamples)-rateSamples:]
+	}
+}
+
+func (terminal *Terminal) dashboardText() (string, string, string) {
+	histogram := terminal.StatusCounts
+	latency := terminal.Latency + "\n\n" + terminal.ErrorCounts
+	progress := fmt.Sprintf("ETA: %v\nDepth: %v\n\n%v", terminal.ETA, terminal.Depth, terminal.Targets)
+	if terminal.Clusters != "" {
+		progress += "\nSimilar hits:\n" + terminal.Clusters
+	}
+	return histogram, latency, progress
+}
@@ -0,0 +1,81 @@
+package ui
+
+import (
+	"strings"
+	"sync"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+type LogLine struct {
+	Level logrus.Level
+	Hit   bool
+	Text  string
+}
+
+type LogFilter struct {
+	Level    logrus.Level
+	HitsOnly bool
+	Search   string
+}
+
+func (filter *LogFilter) Matches(line *LogLine) bool {
+	if line.Level > filter.Level {
+		return false
+	}
+	if filter.HitsOnly && !line.Hit {
+		return false
+	}
+	if filter.Search != "" && !strings.Contains(strings.ToLower(line.Text), strings.ToLower(filter.Search)) {
+		return false
+	}
+	return true
+}
+
+// LogBuffer is a fixed size ring buffer of log lines which is safe
+// to write to from multiple goroutines. Once full the oldest lines
+// are overwritten
+type LogBuffer struct {
+	mutex *sync.Mutex
+	lines []LogLine
+	start int
+	count int
+}
+
+func NewLogBuffer(size int) *LogBuffer {
+	if size < 1 {
+		size = 1
+	}
+	return &LogBuffer{&sync.Mutex{}, make([]LogLine, size), 0, 0}
+}
+
+func (buffer *LogBuffer) Add(line LogLine) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	size := len(buffer.lines)
+	if buffer.count < size {
+		buffer.lines[(buffer.start+buffer.count)%size] = line
+		buffer.count++
+		return
+	}
+
+	buffer.lines[buffer.start] = line
+	buffer.start = (buffer.start + 1) % size
+}
+
+// Lines returns the lines matching the filter, newest first
+func (buffer *LogBuffer) Lines(filter LogFilter) []LogLine {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	size := len(buffer.lines)
+	lines := make([]LogLine, 0)
+	for i := buffer.count - 1; i >= 0; i-- {
+		line := buffer.lines[(buffer.start+i)%size]
+		if filter.Matches(&line) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
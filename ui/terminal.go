@@ -2,15 +2,65 @@ package ui
 
 import (
 	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
 	ui "github.com/gizak/termui"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// Command is sent by the terminal when a control key is pressed
+type Command int
+
+const (
+	Quit Command = iota
+	TogglePause
+	AddWorker
+	RemoveWorker
+	RaiseRate
+	LowerRate
+	SkipBranch
 )
 
+var keyCommands = map[string]Command{
+	"q":   Quit,
+	"C-c": Quit,
+	"p":   TogglePause,
+	"+":   AddWorker,
+	"-":   RemoveWorker,
+	"]":   RaiseRate,
+	"[":   LowerRate,
+	"s":   SkipBranch,
+}
+
+// Levels the log pane filter cycles through, from most to least verbose
+var filterLevels = []logrus.Level{
+	logrus.DebugLevel,
+	logrus.InfoLevel,
+	logrus.WarnLevel,
+	logrus.ErrorLevel,
+}
+
 type Terminal struct {
-	Logs              string
+	Logs              *LogBuffer
+	LogFilter         LogFilter
+	LogScroll         int
+	Searching         bool
 	RequestsPerSecond string
 	RequestsCompleted string
 	FailedRequests    string
+	Status            string
+	StatusCounts      string
+	Latency           string
+	ErrorCounts       string
+	ETA               string
+	Depth             string
+	Targets           string
+	Clusters          string
+	RateSamples       []int
 	Widgets           *Widgets
+	mutex             *sync.Mutex
 }
 
 type Widgets struct {
@@ -18,35 +68,78 @@ type Widgets struct {
 	requestsPerSecond *ui.Par
 	requestsCompleted *ui.Par
 	failedRequests    *ui.Par
+	status            *ui.Par
+	statusCounts      *ui.Par
+	latency           *ui.Par
+	progress          *ui.Par
+	rate              *ui.Sparklines
 }
 
-func NewTerminal(pauseChan chan int) (*Terminal, error) {
+// Heights of the fixed size rows above the log pane
+const (
+	summaryHeight   = 3
+	dashboardHeight = 10
+	sparklineHeight = 5
+)
+
+func NewTerminal(commandChan chan Command, logSize int) (*Terminal, error) {
 	err := ui.Init()
 	if err != nil {
 		return nil, err
 	}
 
 	terminal := &Terminal{
-		Logs:              "",
+		Logs:              NewLogBuffer(logSize),
+		LogFilter:         LogFilter{Level: logrus.DebugLevel},
 		RequestsPerSecond: "0 r/s",
 		RequestsCompleted: "0/0 (0%)",
 		FailedRequests:    "0",
+		Status:            "Running",
+		Latency:           "p50 0s  p95 0s  p99 0s",
+		ETA:               "unknown",
+		Depth:             "0 (max 0)",
+		RateSamples:       make([]int, 0),
 		Widgets:           NewWidgets(),
+		mutex:             &sync.Mutex{},
 	}
 
 	ui.Body.AddRows(
 		ui.NewRow(
-			ui.NewCol(4, 0, terminal.Widgets.requestsPerSecond),
-			ui.NewCol(4, 0, terminal.Widgets.requestsCompleted),
-			ui.NewCol(4, 0, terminal.Widgets.failedRequests),
+			ui.NewCol(3, 0, terminal.Widgets.requestsPerSecond),
+			ui.NewCol(3, 0, terminal.Widgets.requestsCompleted),
+			ui.NewCol(3, 0, terminal.Widgets.failedRequests),
+			ui.NewCol(3, 0, terminal.Widgets.status),
+		),
+		ui.NewRow(
+			ui.NewCol(4, 0, terminal.Widgets.statusCounts),
+			ui.NewCol(4, 0, terminal.Widgets.latency),
+			ui.NewCol(4, 0, terminal.Widgets.progress),
+		),
+		ui.NewRow(
+			ui.NewCol(12, 0, terminal.Widgets.rate),
 		),
 		ui.NewRow(
 			ui.NewCol(12, 0, terminal.Widgets.logs),
 		),
 	)
 
-	ui.Handle("/sys/kbd/q", func(ui.Event) {
-		pauseChan <- 0
+	// All keys go through a single handler so that the search
+	// prompt can capture keys which are otherwise commands
+	ui.Handle("/sys/kbd", func(e ui.Event) {
+		kbd, ok := e.Data.(ui.EvtKbd)
+		if !ok {
+			return
+		}
+		// Commands are dropped rather than freezing the terminal when
+		// the command loop is busy, for example while shutting down
+		command, ok := terminal.handleKey(kbd.KeyStr)
+		if ok {
+			select {
+			case commandChan <- command:
+			default:
+			}
+		}
+		terminal.Render()
 	})
 
 	ui.Handle("/timer/1s", func(e ui.Event) {
@@ -64,14 +157,89 @@ func (terminal *Terminal) StopLoop() {
 	ui.StopLoop()
 }
 
-func (terminal *Terminal) AddLog(log []byte) {
-	str := fmt.Sprintf("%s\n", log)
-	terminal.Logs = str + terminal.Logs
+// Handle a key press, returning a command if the key maps to one
+func (terminal *Terminal) handleKey(key string) (Command, bool) {
+	terminal.mutex.Lock()
+	defer terminal.mutex.Unlock()
+
+	if terminal.Searching {
+		search := terminal.LogFilter.Search
+		switch key {
+		case "<enter>":
+			terminal.Searching = false
+		case "<escape>":
+			terminal.Searching = false
+			search = ""
+		case "<backspace>", "C-8":
+			if len(search) > 0 {
+				_, size := utf8.DecodeLastRuneInString(search)
+				search = search[:len(search)-size]
+			}
+		case "<space>":
+			search += " "
+		default:
+			if utf8.RuneCountInString(key) == 1 {
+				search += key
+			}
+		}
+		terminal.LogFilter.Search = search
+		terminal.LogScroll = 0
+		return 0, false
+	}
+
+	page := terminal.logHeight() - 2
+	switch key {
+	case "<up>":
+		terminal.LogScroll--
+	case "<down>":
+		terminal.LogScroll++
+	case "<previous>":
+		terminal.LogScroll -= page
+	case "<next>":
+		terminal.LogScroll += page
+	case "<home>":
+		terminal.LogScroll = 0
+	case "l":
+		terminal.LogFilter.Level = nextFilterLevel(terminal.LogFilter.Level)
+		terminal.LogScroll = 0
+	case "h":
+		terminal.LogFilter.HitsOnly = !terminal.LogFilter.HitsOnly
+		terminal.LogScroll = 0
+	case "/":
+		terminal.Searching = true
+	case "<escape>":
+		terminal.LogFilter.Search = ""
+		terminal.LogScroll = 0
+	default:
+		command, ok := keyCommands[key]
+		return command, ok
+	}
+
+	if terminal.LogScroll < 0 {
+		terminal.LogScroll = 0
+	}
+	return 0, false
+}
+
+func nextFilterLevel(level logrus.Level) logrus.Level {
+	for i, l := range filterLevels {
+		if l == level {
+			return filterLevels[(i+1)%len(filterLevels)]
+		}
+	}
+	return filterLevels[0]
+}
+
+func (terminal *Terminal) AddLog(level logrus.Level, hit bool, log []byte) {
+	terminal.Logs.Add(LogLine{level, hit, string(log)})
 	terminal.Render()
 }
 
-func (terminal *Terminal) SetRequestsPerSecond(rps int) {
-	terminal.RequestsPerSecond = fmt.Sprintf("%v r/s", rps)
+func (terminal *Terminal) SetRequestsPerSecond(rps float64) {
+	terminal.mutex.Lock()
+	terminal.RequestsPerSecond = fmt.Sprintf("%.1f r/s", rps)
+	terminal.addRateSample(rps)
+	terminal.mutex.Unlock()
 	terminal.Render()
 }
 
@@ -81,39 +249,151 @@ func (terminal *Terminal) SetCompletedRequests(completed int, total int) {
 	}
 
 	percent := float64(completed) / float64(total) * 100
+	terminal.mutex.Lock()
 	terminal.RequestsCompleted = fmt.Sprintf("%v/%v (%.2f%%)", completed, total, percent)
+	terminal.mutex.Unlock()
 	terminal.Render()
 }
 
 func (terminal *Terminal) SetFailedRequests(failed int) {
+	terminal.mutex.Lock()
 	terminal.FailedRequests = fmt.Sprintf("%v", failed)
+	terminal.mutex.Unlock()
+	terminal.Render()
+}
+
+func (terminal *Terminal) SetStatus(paused bool, workers int, rate int) {
+	state := "Running"
+	if paused {
+		state = "Paused"
+	}
+	rateText := "unlimited"
+	if rate > 0 {
+		rateText = fmt.Sprintf("%v r/s", rate)
+	}
+	terminal.mutex.Lock()
+	terminal.Status = fmt.Sprintf("%v, %v workers, %v", state, workers, rateText)
+	terminal.mutex.Unlock()
 	terminal.Render()
 }
 
 func (terminal *Terminal) Render() {
+	terminal.mutex.Lock()
+	defer terminal.mutex.Unlock()
+
 	ui.Body.Align()
-	terminal.Widgets.logs.Height = ui.TermHeight() - 3
-	terminal.Widgets.logs.Text = terminal.Logs
+	terminal.Widgets.logs.Height = terminal.logHeight()
+	terminal.Widgets.logs.BorderLabel = terminal.logLabel()
+	terminal.Widgets.logs.Text = terminal.logText()
 	terminal.Widgets.requestsPerSecond.Text = terminal.RequestsPerSecond
 	terminal.Widgets.requestsCompleted.Text = terminal.RequestsCompleted
 	terminal.Widgets.failedRequests.Text = terminal.FailedRequests
+	terminal.Widgets.status.Text = terminal.Status
+	histogram, latency, progress := terminal.dashboardText()
+	terminal.Widgets.statusCounts.Text = histogram
+	terminal.Widgets.latency.Text = latency
+	terminal.Widgets.progress.Text = progress
+	terminal.Widgets.rate.Lines[0].Data = append([]int(nil), terminal.RateSamples...)
 	ui.Render(ui.Body)
 }
 
+func (terminal *Terminal) logHeight() int {
+	height := ui.TermHeight() - summaryHeight - dashboardHeight - sparklineHeight
+	if height < 3 {
+		return 3
+	}
+	return height
+}
+
+// Build the text for the visible portion of the log pane, clamping
+// the scroll position to the number of lines available
+func (terminal *Terminal) logText() string {
+	lines := terminal.Logs.Lines(terminal.LogFilter)
+	visible := terminal.logHeight() - 2
+	if visible < 1 {
+		visible = 1
+	}
+
+	maxScroll := len(lines) - visible
+	if maxScroll < 0 {
+		maxScroll = 0
+	}
+	if terminal.LogScroll > maxScroll {
+		terminal.LogScroll = maxScroll
+	}
+
+	end := terminal.LogScroll + visible
+	if end > len(lines) {
+		end = len(lines)
+	}
+
+	b := &strings.Builder{}
+	for _, line := range lines[terminal.LogScroll:end] {
+		if line.Hit {
+			fmt.Fprintf(b, "[%v](%v)", line.Text, hitColor(line.Level))
+		} else {
+			b.WriteString(line.Text)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Hits logged as warnings, such as exposed files, stand out in red
+func hitColor(level logrus.Level) string {
+	if level <= logrus.WarnLevel {
+		return "fg-red"
+	}
+	return "fg-green"
+}
+
+func (terminal *Terminal) logLabel() string {
+	label := fmt.Sprintf("Logs [level: %v]", terminal.LogFilter.Level)
+	if terminal.LogFilter.HitsOnly {
+		label += " [hits only]"
+	}
+	if terminal.Searching {
+		label += fmt.Sprintf(" [search: %v_]", terminal.LogFilter.Search)
+	} else if terminal.LogFilter.Search != "" {
+		label += fmt.Sprintf(" [search: %v]", terminal.LogFilter.Search)
+	}
+	if terminal.LogScroll > 0 {
+		label += fmt.Sprintf(" [scrolled %v]", terminal.LogScroll)
+	}
+	return label
+}
+
 func NewWidgets() *Widgets {
 	widgets := &Widgets{
 		logs:              ui.NewPar(""),
 		requestsPerSecond: ui.NewPar("0 r/s"),
 		requestsCompleted: ui.NewPar("0/0 (0%)"),
 		failedRequests:    ui.NewPar("0"),
+		status:            ui.NewPar("Running"),
+		statusCounts:      ui.NewPar(""),
+		latency:           ui.NewPar(""),
+		progress:          ui.NewPar(""),
+		rate:              ui.NewSparklines(ui.NewSparkline()),
 	}
-	widgets.logs.Height = ui.TermHeight() - 3
+	widgets.logs.Height = ui.TermHeight() - summaryHeight - dashboardHeight - sparklineHeight
 	widgets.logs.BorderLabel = "Logs"
-	widgets.requestsPerSecond.Height = 3
+	widgets.requestsPerSecond.Height = summaryHeight
 	widgets.requestsPerSecond.BorderLabel = "Requests per second"
-	widgets.requestsCompleted.Height = 3
+	widgets.requestsCompleted.Height = summaryHeight
 	widgets.requestsCompleted.BorderLabel = "Requests completed"
-	widgets.failedRequests.Height = 3
+	widgets.failedRequests.Height = summaryHeight
 	widgets.failedRequests.BorderLabel = "Failed requests"
+	widgets.status.Height = summaryHeight
+	widgets.status.BorderLabel = "Status"
+	widgets.statusCounts.Height = dashboardHeight
+	widgets.statusCounts.BorderLabel = "Status codes"
+	widgets.latency.Height = dashboardHeight
+	widgets.latency.BorderLabel = "Latency and errors"
+	widgets.progress.Height = dashboardHeight
+	widgets.progress.BorderLabel = "Progress"
+	widgets.rate.Height = sparklineHeight
+	widgets.rate.BorderLabel = "Requests per second history"
+	widgets.rate.Lines[0].Height = sparklineHeight - 2
+	widgets.rate.Lines[0].LineColor = ui.ColorGreen
 	return widgets
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	config "github.com/dpindur/get-good/config"
+)
+
+func upgradeCommand(args []string) int {
+	flags := newFlagSet("upgrade <db>")
+	positional, err := config.ParseFlags(flags, args)
+	if err != nil {
+		return configError(err)
+	}
+	if len(positional) != 1 {
+		fmt.Printf("please provide the database to upgrade\n")
+		return 1
+	}
+
+	// Opening a database to write to adds anything it's missing
+	db, err := openExistingDatabase(positional[0])
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	db.CloseDatabaseConnection()
+
+	fmt.Printf("Upgraded %v\n", dbFilename(positional[0]))
+	return 0
+}